@@ -29,6 +29,14 @@ describe('useAuth', () => {
     expect(auth.isAuthenticated.value).toBe(true)
   })
 
+  it('should accept a hex: encoded 32 byte key from localStorage', () => {
+    const validToken = 'hex:' + 'a'.repeat(64)
+    localStorage.setItem('uploader_auth_token', validToken)
+
+    const auth = useAuth()
+    expect(auth.token.value).toBe(validToken)
+  })
+
   it('should reject invalid token format from localStorage', () => {
     const invalidToken = 'invalid-token'
     localStorage.setItem('uploader_auth_token', invalidToken)
@@ -2,15 +2,17 @@ import type { AuthResponse } from '~/types/api'
 
 const TOKEN_KEY = 'uploader_auth_token'
 
+// Tokens are "hex:" + 64 hex characters, or 32 hex characters for server key
+// IDs and keys issued before hex: keys
 const validateToken = (token: string | null): boolean => {
-  return token !== null && token.length === 32 && /^[0-9a-f]+$/i.test(token)
+  return token !== null && /^(hex:[0-9a-f]{64}|[0-9a-f]{32})$/i.test(token)
 }
 
 export const useAuth = () => {
   const token = useState<string | null>('auth_token', () => {
     if (import.meta.client) {
       const stored = localStorage.getItem(TOKEN_KEY)
-      // Validate token format (should be 32 hex characters)
+      // Validate token format (see validateToken)
       if (validateToken(stored)) {
         return stored
       }
@@ -6,6 +6,11 @@ export const useUploadApi = () => {
   const config = useRuntimeConfig()
   const baseURL = config.public.apiBaseUrl || 'http://localhost:1323'
 
+  // Server-managed keys are referred to by ID in a different header.
+  const keyHeaders = (token: string): Record<string, string> => {
+    return config.public.keyMode === 'server' ? { 'key-id': token } : { key: token }
+  }
+
   const getAuthToken = (): string | null => {
     if (import.meta.client) {
       return localStorage.getItem(TOKEN_KEY)
@@ -25,9 +30,7 @@ export const useUploadApi = () => {
     try {
       const response = await $fetch<UploadResponse>(`${baseURL}/file/upload`, {
         method: 'POST',
-        headers: {
-          key: token
-        },
+        headers: keyHeaders(token),
         body: formData
       })
 
@@ -48,9 +51,7 @@ export const useUploadApi = () => {
 
     try {
       const response = await fetch(url, {
-        headers: {
-          key: token
-        }
+        headers: keyHeaders(token)
       })
 
       if (!response.ok) {
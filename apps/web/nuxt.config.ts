@@ -19,7 +19,10 @@ export default defineNuxtConfig({
 
   runtimeConfig: {
     public: {
-      apiBaseUrl: process.env.NUXT_PUBLIC_API_BASE_URL || 'http://localhost:1323'
+      apiBaseUrl: process.env.NUXT_PUBLIC_API_BASE_URL || 'http://localhost:1323',
+      // 'server' when the Go API runs with UPLOADER_KEY_MODE=server: the login
+      // route asks it for a key ID and requests send that instead of a key.
+      keyMode: process.env.NUXT_PUBLIC_KEY_MODE || 'client'
     }
   },
 
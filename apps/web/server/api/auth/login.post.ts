@@ -1,15 +1,30 @@
 import type { AuthResponse } from '~/types/api'
 
 function generateEncryptionKey(): string {
-  // Generate a random 32-character hex string (16 bytes = 32 hex chars)
-  const bytes = new Uint8Array(16)
+  // Generate 32 random bytes as a hex-encoded key ("hex:" + 64 hex chars), so
+  // the key carries the full 256 bits
+  const bytes = new Uint8Array(32)
   crypto.getRandomValues(bytes)
-  return Array.from(bytes)
+  return 'hex:' + Array.from(bytes)
     .map(b => b.toString(16).padStart(2, '0'))
     .join('')
 }
 
 export default defineEventHandler(async (event): Promise<AuthResponse> => {
+  const config = useRuntimeConfig()
+
+  if (config.public.keyMode === 'server') {
+    // The API generates and keeps the key; the client only holds its ID.
+    const baseURL = config.public.apiBaseUrl || 'http://localhost:1323'
+    const response = await $fetch<{ key_id: string }>(`${baseURL}/keys`, {
+      method: 'POST'
+    })
+
+    return {
+      token: response.key_id
+    }
+  }
+
   const key = generateEncryptionKey()
 
   return {
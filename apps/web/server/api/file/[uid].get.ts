@@ -55,9 +55,7 @@ export default defineEventHandler(async (event) => {
 
   try {
     const response = await fetch(url, {
-      headers: {
-        key
-      }
+      headers: config.public.keyMode === 'server' ? { 'key-id': key } : { key }
     })
 
     if (!response.ok) {
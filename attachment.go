@@ -11,6 +11,9 @@ import (
 	"github.com/google/uuid"
 )
 
+// DEFAULT_OWNER_ID owns every attachment until requests carry a user identity.
+const DEFAULT_OWNER_ID = 1
+
 type Attachment struct {
 	UID              uuid.UUID
 	OwnerID          int
@@ -20,12 +23,67 @@ type Attachment struct {
 	MimeType         string
 	LocalPath        string
 	PreviewLocalPath string
+	// Digest and PreviewDigest are the hex encoded SHA-256 of the plaintext of
+	// each variant, set by StorageService.Upload. They are empty for attachments
+	// uploaded before digests were recorded.
+	Digest        string
+	PreviewDigest string
+	// ExpiresAt, when set, is when the attachment's data key expires. After that
+	// the keystore refuses the key and the sweeper deletes it, so the attachment
+	// can never be decrypted again.
+	ExpiresAt time.Time
+	// ContentID names the content-addressed blob that holds the attachment's
+	// variants when it is shared with every attachment of the same content. It
+	// is empty for attachments stored under their own UID.
+	ContentID string
+}
+
+// Expired reports whether the attachment's key has expired at now.
+func (a *Attachment) Expired(now time.Time) bool {
+	return !a.ExpiresAt.IsZero() && !now.Before(a.ExpiresAt)
 }
 
 func (a *Attachment) GetFilePaths() []string {
 	return []string{a.LocalPath, a.PreviewLocalPath}
 }
 
+// GetLocalPath returns the working file that holds variant, which is empty when
+// the variant was not staged.
+func (a *Attachment) GetLocalPath(variant string) string {
+	if variant == VARIANT_PREVIEW {
+		return a.PreviewLocalPath
+	}
+	return a.LocalPath
+}
+
+// GetDigest returns the recorded digest of variant.
+func (a *Attachment) GetDigest(variant string) string {
+	if variant == VARIANT_PREVIEW {
+		return a.PreviewDigest
+	}
+	return a.Digest
+}
+
+// SetDigest records the digest of variant.
+func (a *Attachment) SetDigest(variant, digest string) {
+	if variant == VARIANT_PREVIEW {
+		a.PreviewDigest = digest
+	} else {
+		a.Digest = digest
+	}
+}
+
+// EncryptionContext returns the context that the blob for variant is bound to.
+func (a *Attachment) EncryptionContext(variant string) EncryptionContext {
+	return EncryptionContext{
+		AttachmentUID: a.UID,
+		Variant:       variant,
+		OwnerID:       a.OwnerID,
+		ExpiresAt:     a.ExpiresAt,
+		ContentID:     a.ContentID,
+	}
+}
+
 // CreatePreviewLocalPath adds .preview into the localpath befroe the file extenion
 func (a *Attachment) CreatePreviewLocalPath() string {
 	// Find the last dot (.) in the FileName
@@ -94,17 +152,22 @@ func NewAttachment(file *multipart.FileHeader, requestUser int) *Attachment {
 }
 
 type Upload struct {
-	FileName    string    `json:"file_name"`
-	PreviewURL  string    `json:"preview_url"`
-	DownloadURL string    `json:"download_url"`
-	UploadedAt  time.Time `json:"uploaded_at"`
+	FileName    string     `json:"file_name"`
+	PreviewURL  string     `json:"preview_url"`
+	DownloadURL string     `json:"download_url"`
+	UploadedAt  time.Time  `json:"uploaded_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
 }
 
 func NewUpload(attachment *Attachment, previewURL, downloadURL string) (*Upload, error) {
-	return &Upload{
+	upload := &Upload{
 		FileName:    attachment.FileName,
 		PreviewURL:  previewURL,
 		DownloadURL: downloadURL,
 		UploadedAt:  time.Now(),
-	}, nil
+	}
+	if !attachment.ExpiresAt.IsZero() {
+		upload.ExpiresAt = &attachment.ExpiresAt
+	}
+	return upload, nil
 }
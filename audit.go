@@ -0,0 +1,34 @@
+package uploader
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// AUDIT_SHRED records that an attachment's data key was destroyed.
+	AUDIT_SHRED = "shred"
+
+	// AUDIT_SHRED_PENDING records that an attachment's data key is about to be
+	// destroyed. It is followed by AUDIT_SHRED once the key is gone.
+	AUDIT_SHRED_PENDING = "shred_pending"
+)
+
+// AuditEvent is an append-only record of a security relevant action.
+type AuditEvent struct {
+	ID            int64     `json:"id"`
+	Action        string    `json:"action"`
+	AttachmentUID uuid.UUID `json:"attachment_uid"`
+	OwnerID       int       `json:"owner_id"`
+	Detail        string    `json:"detail,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// AuditService stores audit events. Events are never updated or deleted, and
+// outlive the attachments they refer to.
+type AuditService interface {
+	Record(event *AuditEvent) error
+	// List returns the events for an attachment, oldest first.
+	List(attachmentUID uuid.UUID) ([]*AuditEvent, error)
+}
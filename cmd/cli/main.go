@@ -1 +1,322 @@
 package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/storage"
+)
+
+const usage = `usage: cli <command> [flags]
+
+commands:
+  rotate-key   re-key every stored file from one encryption key to another
+  migrate      copy every stored file from one storage backend to another
+  fsck         check stored files against the filer database
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "rotate-key":
+		err = rotateKey(os.Args[2:])
+	case "migrate":
+		err = migrate(os.Args[2:])
+	case "fsck":
+		err = fsck(os.Args[2:])
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+// rotateKey asks a running server to rotate the caller's key. The server owns
+// the keystore holding the wrapped data keys, so rotation has to happen there.
+// Keys can be passed as flags or through UPLOADER_KEY and UPLOADER_NEW_KEY to
+// keep them out of the process list. Against a server managing keys itself only
+// the key ID is needed and the server picks the new key.
+func rotateKey(args []string) error {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	server := flags.String("server", getEnv("UPLOADER_SERVER", "http://localhost:1323"), "base URL of the uploader server")
+	oldKey := flags.String("old-key", getEnv("UPLOADER_KEY", ""), "current encryption key")
+	newKey := flags.String("new-key", getEnv("UPLOADER_NEW_KEY", ""), "new encryption key")
+	keyID := flags.String("key-id", getEnv("UPLOADER_KEY_ID", ""), "key ID, when the server manages keys")
+	timeout := flags.Duration("timeout", 30*time.Minute, "how long to wait for the rotation to finish")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	body := []byte("{}")
+	if *keyID == "" {
+		if *oldKey == "" || *newKey == "" {
+			return errors.New("either -key-id or both -old-key and -new-key are required")
+		}
+
+		var err error
+		body, err = json.Marshal(map[string]string{"new_key": *newKey})
+		if err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*server, "/")+"/keys/rotate", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if *keyID != "" {
+		request.Header.Set("key-id", *keyID)
+	} else {
+		request.Header.Set("key", *oldKey)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	payload, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s: %s", response.Status, strings.TrimSpace(string(payload)))
+	}
+
+	fmt.Println(strings.TrimSpace(string(payload)))
+	return nil
+}
+
+// backend is a storage backend that blobs can be listed and copied in and out
+// of.
+type backend interface {
+	storage.Replica
+	uploader.BlobLister
+}
+
+// migrate copies the ciphertext of every attachment in the filer database from
+// one backend to another. Both backends are configured with the same
+// environment variables as the server. Files are never decrypted, so no keys
+// are needed; stop the server, or at least uploads, while it runs. Running it
+// again after a failure continues where it stopped.
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "local", "backend to copy from: local or s3")
+	to := flags.String("to", "s3", "backend to copy to: local or s3")
+	database := flags.String("db", "filer.sqlite", "path of the filer database")
+	concurrency := flags.Int("concurrency", uploader.DEFAULT_MIGRATION_CONCURRENCY, "how many files to copy at once")
+	dryRun := flags.Bool("dry-run", false, "report what would be copied without copying it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == *to {
+		return errors.New("-from and -to must name different backends")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	sqlite, err := db.NewSQLiteDatabase(*database)
+	if err != nil {
+		return err
+	}
+	defer sqlite.Close()
+	if err := sqlite.CreateTable(); err != nil {
+		return err
+	}
+
+	source, err := openBackend(*from)
+	if err != nil {
+		return err
+	}
+	destination, err := openBackend(*to)
+	if err != nil {
+		return err
+	}
+	if !*dryRun {
+		if err := destination.Initialise(ctx); err != nil {
+			return err
+		}
+	}
+
+	migrator := uploader.NewMigrator(db.NewSqliteFilerService(sqlite), source, destination, db.NewSqliteCheckpointService(sqlite))
+	result, err := migrator.Migrate(ctx, uploader.MigrationOptions{
+		Name:        *from + "-to-" + *to,
+		Concurrency: *concurrency,
+		DryRun:      *dryRun,
+	})
+	if result != nil {
+		payload, _ := json.Marshal(result)
+		fmt.Println(string(payload))
+	}
+	if err != nil {
+		return err
+	}
+	if len(result.Missing) > 0 {
+		return fmt.Errorf("%d attachments have no stored original in %s", len(result.Missing), *from)
+	}
+	return nil
+}
+
+// fsck checks the blobs in a backend against the attachments in the filer
+// database, reporting orphaned blobs and attachments missing their original or
+// preview. Orphans can be quarantined, and with UPLOADER_STORAGE_MIRRORS set,
+// missing blobs repaired from another replica. It exits non-zero when anything
+// is left wrong.
+func fsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	name := flags.String("backend", getEnv("UPLOADER_STORAGE", "local"), "backend to check: local or s3")
+	database := flags.String("db", "filer.sqlite", "path of the filer database")
+	grace := flags.Duration("grace", uploader.DEFAULT_FSCK_GRACE, "how old a blob must be to count as an orphan")
+	quarantine := flags.Bool("quarantine", false, "move orphaned blobs into the quarantine area")
+	repair := flags.Bool("repair", false, "copy missing blobs back from the replicas in UPLOADER_STORAGE_MIRRORS")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	sqlite, err := db.NewSQLiteDatabase(*database)
+	if err != nil {
+		return err
+	}
+	defer sqlite.Close()
+	if err := sqlite.CreateTable(); err != nil {
+		return err
+	}
+
+	checked, err := openBackend(*name)
+	if err != nil {
+		return err
+	}
+
+	checker := uploader.NewFsck(db.NewSqliteFilerService(sqlite), checked, uploader.FsckOptions{
+		Grace:      *grace,
+		Quarantine: *quarantine,
+		Repair:     *repair,
+	})
+	if getEnvBool("UPLOADER_DEDUP", false) {
+		checker.SetBlobRefs(db.NewSqliteBlobRefService(sqlite))
+	}
+	if *repair {
+		mirrors := getEnv("UPLOADER_STORAGE_MIRRORS", "")
+		if mirrors == "" {
+			return errors.New("-repair needs UPLOADER_STORAGE_MIRRORS")
+		}
+
+		var replicas []storage.Replica
+		for _, replicaName := range append([]string{getEnv("UPLOADER_STORAGE", "local")}, strings.Split(mirrors, ",")...) {
+			replica, err := openBackend(strings.TrimSpace(replicaName))
+			if err != nil {
+				return err
+			}
+			replicas = append(replicas, replica)
+		}
+		// Blobs are copied without decrypting them, so no keystore is needed.
+		checker.SetRepairer(storage.NewMirrorStorage(encryption.NewAESService(nil), replicas[0], replicas[1:]...))
+	}
+
+	report, err := checker.Check(ctx, time.Now())
+	if report != nil {
+		payload, _ := json.Marshal(report)
+		fmt.Println(string(payload))
+	}
+	if err != nil {
+		return err
+	}
+	if !report.Clean() {
+		return fmt.Errorf("%d orphaned blobs, %d attachments missing their original and %d missing their preview in %s",
+			len(report.Orphans)-report.Quarantined, len(report.Missing), len(report.MissingPreviews), *name)
+	}
+	return nil
+}
+
+// openBackend returns the storage backend called name, configured the same way
+// as in the server.
+func openBackend(name string) (backend, error) {
+	// Blobs are copied without decrypting them, so no keystore is needed.
+	encryptionService := encryption.NewAESService(nil)
+
+	switch name {
+	case "local":
+		return storage.NewLocalStorage(getEnv("UPLOADER_LOCAL_UPLOAD_PATH", "temp/"), getEnv("UPLOADER_LOCAL_VAULT_PATH", "vault/"), encryptionService), nil
+	case "s3":
+		s3Storage := storage.NewS3Storage(&storage.S3Options{
+			Endpoint:       getEnv("UPLOADER_S3_ENDPOINT", ""),
+			Bucket:         getEnv("UPLOADER_S3_BUCKET", "uploader"),
+			Region:         getEnv("UPLOADER_S3_REGION", "us-east-1"),
+			Prefix:         getEnv("UPLOADER_S3_PREFIX", ""),
+			ForcePathStyle: getEnvBool("UPLOADER_S3_FORCE_PATH_STYLE", true),
+			AccessKeyID:    getEnv("AWS_ACCESS_KEY_ID", ""),
+			SecretKey:      getEnv("AWS_SECRET_ACCESS_KEY", ""),
+			PartSize:       int64(getEnvInt("UPLOADER_S3_PART_SIZE_MIB", storage.DEFAULT_PART_SIZE>>20)) << 20,
+			Concurrency:    getEnvInt("UPLOADER_S3_UPLOAD_CONCURRENCY", storage.DEFAULT_UPLOAD_CONCURRENCY),
+		}, encryptionService)
+		if s3Storage == nil {
+			return nil, errors.New("invalid S3 configuration")
+		}
+		return s3Storage, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+}
+
+// getEnv retrieves an environment variable or returns a default value
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvInt retrieves an environment variable as an integer or returns a default value
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// getEnvBool retrieves an environment variable as a boolean or returns a default value
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
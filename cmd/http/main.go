@@ -2,67 +2,192 @@ package main
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"fmt"
+	"log"
+	nethttp "net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bencleary/uploader"
 	"github.com/bencleary/uploader/internal/db"
 	"github.com/bencleary/uploader/internal/encryption"
 	"github.com/bencleary/uploader/internal/http"
 	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/kms"
 	"github.com/bencleary/uploader/internal/preview"
 	"github.com/bencleary/uploader/internal/scaler"
 	"github.com/bencleary/uploader/internal/storage"
 )
 
 func main() {
-	keyService := keystore.NewInMemoryKeyStore()
+	sqlite, err := db.NewSQLiteDatabase("filer.sqlite")
+
+	if err != nil {
+		panic(err)
+	}
+
+	sqlite.CreateTable()
+
+	keyService, err := newKeyStore(sqlite)
+	if err != nil {
+		panic(err)
+	}
+
+	// With UPLOADER_KMS_ADDR set, keys are wrapped by an external KMS before
+	// they reach the keystore.
+	var kmsOptions *kms.TransitOptions
+	if kmsAddr := getEnv("UPLOADER_KMS_ADDR", ""); kmsAddr != "" {
+		kmsOptions = &kms.TransitOptions{
+			Address:  kmsAddr,
+			Token:    getEnv("UPLOADER_KMS_TOKEN", ""),
+			KeyName:  getEnv("UPLOADER_KMS_KEY", "uploader"),
+			Timeout:  getEnvDuration("UPLOADER_KMS_TIMEOUT", kms.DEFAULT_TIMEOUT),
+			Retries:  getEnvInt("UPLOADER_KMS_RETRIES", kms.DEFAULT_RETRIES),
+			CacheTTL: getEnvDuration("UPLOADER_KMS_CACHE_TTL", kms.DEFAULT_CACHE_TTL),
+		}
+		kmsClient, err := kms.NewTransitClient(*kmsOptions)
+		if err != nil {
+			panic(err)
+		}
+		keyService = keystore.NewKMSKeyStore(keyService, kmsClient)
+	}
 
-	encryptionService := encryption.NewAESService(keyService)
+	// Uploads with a TTL store keys that expire; the sweeper deletes them.
+	sweepInterval, err := time.ParseDuration(getEnv("UPLOADER_KEY_SWEEP_INTERVAL", "1m"))
+	if err != nil || sweepInterval <= 0 {
+		panic(fmt.Sprintf("invalid UPLOADER_KEY_SWEEP_INTERVAL: %v", err))
+	}
+	go uploader.NewKeySweeper(keyService, sweepInterval).Run(context.Background())
+
+	algorithm, err := encryption.AlgorithmByName(getEnv("UPLOADER_ENCRYPTION_ALGORITHM", "aes-gcm"))
+	if err != nil {
+		panic(err)
+	}
+
+	encryptionService := encryption.NewEncryptionService(keyService, algorithm)
+
+	// Passphrase keys ("pass:...") are stretched with a KDF whose cost is
+	// recorded per blob, so these can be raised without breaking old uploads.
+	var kdf encryption.KDFParams
+	switch kdfName := getEnv("UPLOADER_KDF", "argon2id"); kdfName {
+	case "argon2id":
+		kdf = encryption.DefaultArgon2id
+		kdf.Time = uint32(getEnvInt("UPLOADER_ARGON2_TIME", int(kdf.Time)))
+		kdf.Memory = uint32(getEnvInt("UPLOADER_ARGON2_MEMORY_KIB", int(kdf.Memory)))
+		kdf.Threads = uint8(getEnvInt("UPLOADER_ARGON2_THREADS", int(kdf.Threads)))
+	case "scrypt":
+		kdf = encryption.DefaultScrypt
+		kdf.LogN = uint8(getEnvInt("UPLOADER_SCRYPT_LOG_N", int(kdf.LogN)))
+	default:
+		panic(fmt.Sprintf("unknown key derivation function %q", kdfName))
+	}
+	if err := encryptionService.SetKDF(kdf); err != nil {
+		panic(err)
+	}
 
 	// Load storage configuration from environment variables
 	storageType := getEnv("UPLOADER_STORAGE", "local")
-	var storageService uploader.StorageService
+	primary, err := newStorage(storageType, encryptionService)
+	if err != nil {
+		panic(err)
+	}
 
-	if storageType == "s3" {
-		s3Options := &storage.S3Options{
-			Endpoint:       getEnv("UPLOADER_S3_ENDPOINT", ""),
-			Bucket:         getEnv("UPLOADER_S3_BUCKET", "uploader"),
-			Region:         getEnv("UPLOADER_S3_REGION", "us-east-1"),
-			Prefix:         getEnv("UPLOADER_S3_PREFIX", ""),
-			ForcePathStyle: getEnvBool("UPLOADER_S3_FORCE_PATH_STYLE", true),
-			AccessKeyID:    getEnv("AWS_ACCESS_KEY_ID", ""),
-			SecretKey:      getEnv("AWS_SECRET_ACCESS_KEY", ""),
-		}
+	// With dedup on, identical uploads share one content-addressed blob.
+	var blobRefs uploader.BlobRefService
+	if getEnvBool("UPLOADER_DEDUP", false) {
+		blobRefs = db.NewSqliteBlobRefService(sqlite)
+	}
 
-		s3Storage := storage.NewS3Storage(s3Options, encryptionService)
-		if s3Storage == nil {
-			panic("failed to initialize S3 storage: invalid configuration")
+	// With UPLOADER_STORAGE_MIRRORS set, every upload is also copied to each of
+	// the listed backends, and reads fall back to them.
+	var storageService uploader.StorageService
+	var mirror *storage.MirrorStorage
+	backends := []storageBackend{primary}
+	if mirrors := getEnv("UPLOADER_STORAGE_MIRRORS", ""); mirrors != "" {
+		names := map[string]bool{storageType: true}
+		var secondaries []storage.Replica
+		for _, name := range strings.Split(mirrors, ",") {
+			name = strings.TrimSpace(name)
+			if names[name] {
+				panic(fmt.Sprintf("storage backend %q is used more than once", name))
+			}
+			names[name] = true
+
+			secondary, err := newStorage(name, encryptionService)
+			if err != nil {
+				panic(err)
+			}
+			secondaries = append(secondaries, secondary)
+			backends = append(backends, secondary)
 		}
-		storageService = s3Storage
+		mirror = storage.NewMirrorStorage(encryptionService, primary, secondaries...)
+		mirror.SetDedup(blobRefs)
+		storageService = mirror
 	} else {
-		// Default to local storage
-		uploadPath := getEnv("UPLOADER_LOCAL_UPLOAD_PATH", "temp/")
-		vaultPath := getEnv("UPLOADER_LOCAL_VAULT_PATH", "vault/")
-		storageService = storage.NewLocalStorage(uploadPath, vaultPath, encryptionService)
+		primary.SetDedup(blobRefs)
+		storageService = primary
 	}
 
-	err := storageService.Initialise(context.Background())
+	err = storageService.Initialise(context.Background())
 	if err != nil {
 		panic(fmt.Sprintf("failed to initialize storage: %v", err))
 	}
 
-	sqlite, err := db.NewSQLiteDatabase("filer.sqlite")
+	filingService := db.NewSqliteFilerService(sqlite)
+	checkpointService := db.NewSqliteCheckpointService(sqlite)
+	recipientService := db.NewSqliteRecipientService(sqlite)
+	auditService := db.NewSqliteAuditService(sqlite)
 
-	if err != nil {
-		panic(err)
+	// Mirrored blobs that went missing from a replica are copied back from
+	// another.
+	if mirror != nil {
+		repairInterval, err := time.ParseDuration(getEnv("UPLOADER_MIRROR_REPAIR_INTERVAL", "1h"))
+		if err != nil || repairInterval <= 0 {
+			panic(fmt.Sprintf("invalid UPLOADER_MIRROR_REPAIR_INTERVAL: %v", err))
+		}
+		go uploader.NewRepairJob(filingService, mirror, repairInterval).Run(context.Background())
 	}
 
-	sqlite.CreateTable()
+	// Uploads staged by the primary are deleted once stored; the janitor deletes
+	// any left behind, such as by a crash.
+	janitorInterval, err := time.ParseDuration(getEnv("UPLOADER_JANITOR_INTERVAL", "10m"))
+	if err != nil || janitorInterval <= 0 {
+		panic(fmt.Sprintf("invalid UPLOADER_JANITOR_INTERVAL: %v", err))
+	}
+	stagingMaxAge := getEnvDuration("UPLOADER_STAGING_MAX_AGE", uploader.DEFAULT_STAGING_MAX_AGE)
+	go uploader.NewJanitor(primary, stagingMaxAge, janitorInterval).Run(context.Background())
 
-	filingService := db.NewSqliteFilerService(sqlite)
+	// Metrics are served apart from the API so they can stay off the public
+	// port. A metrics listener that fails is logged; the API keeps serving.
+	if metricsAddr := getEnv("UPLOADER_METRICS_ADDR", ""); metricsAddr != "" {
+		mux := nethttp.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		go func() {
+			log.Printf("serving metrics on %s: %v", metricsAddr, nethttp.ListenAndServe(metricsAddr, mux))
+		}()
+	}
+
+	// Every backend is checked against the filer for orphaned and missing blobs.
+	fsckInterval, err := time.ParseDuration(getEnv("UPLOADER_FSCK_INTERVAL", "24h"))
+	if err != nil || fsckInterval <= 0 {
+		panic(fmt.Sprintf("invalid UPLOADER_FSCK_INTERVAL: %v", err))
+	}
+	for _, backend := range backends {
+		fsck := uploader.NewFsck(filingService, backend, uploader.FsckOptions{
+			Grace:      getEnvDuration("UPLOADER_FSCK_GRACE", uploader.DEFAULT_FSCK_GRACE),
+			Quarantine: getEnvBool("UPLOADER_FSCK_QUARANTINE", false),
+			Repair:     mirror != nil,
+		})
+		fsck.SetBlobRefs(blobRefs)
+		if mirror != nil {
+			fsck.SetRepairer(mirror)
+		}
+		go fsck.Run(context.Background(), fsckInterval)
+	}
 
 	supportedImageScalerMimeTypes := []string{"image/png", "image/gif", "image/jpeg"}
 	drawScaler := scaler.NewDrawImageScaler(supportedImageScalerMimeTypes)
@@ -75,11 +200,158 @@ func main() {
 	previewService.Register("image/gif", imagePreviewGenerator)
 	previewService.Register("image/jpeg", imagePreviewGenerator)
 
-	server := http.NewServer(filingService, storageService, drawScaler, previewService)
+	keyRotator := uploader.NewKeyRotator(filingService, storageService, encryptionService, checkpointService)
+
+	// With UPLOADER_KEY_MODE=server the server generates and keeps user keys and
+	// clients send only a key ID.
+	var keyManager *uploader.KeyManager
+	switch keyMode := getEnv("UPLOADER_KEY_MODE", "client"); keyMode {
+	case "client":
+	case "server":
+		wrapper, err := newKeyWrapper(kmsOptions)
+		if err != nil {
+			panic(err)
+		}
+		keyManager = uploader.NewKeyManager(keyService, wrapper)
+	default:
+		panic(fmt.Sprintf("unknown key mode %q", keyMode))
+	}
+
+	shareManager := uploader.NewShareManager(recipientService, encryptionService)
+	shredder := uploader.NewShredder(filingService, storageService, encryptionService, recipientService, auditService)
+	recoveryManager := uploader.NewRecoveryManager(keyService, auditService)
+
+	uploads := uploader.NewUploadPipeline(filingService, storageService, encryptionService, drawScaler, previewService, http.MAX_IMAGE_WIDTH, http.PREVIEW_WIDTH)
+
+	server := http.NewServer(filingService, storageService, uploads, keyRotator, keyManager, shareManager, shredder, recoveryManager)
 
 	server.Start()
 }
 
+// storageBackend is a storage backend that can be mirrored, checked, swept, or
+// dedup uploads itself.
+type storageBackend interface {
+	storage.Replica
+	uploader.BlobLister
+	uploader.Stager
+	SetDedup(refs uploader.BlobRefService)
+}
+
+// newStorage builds the storage backend called name: local or s3.
+func newStorage(name string, encryptionService uploader.EncryptionService) (storageBackend, error) {
+	switch name {
+	case "local":
+		uploadPath := getEnv("UPLOADER_LOCAL_UPLOAD_PATH", "temp/")
+		vaultPath := getEnv("UPLOADER_LOCAL_VAULT_PATH", "vault/")
+		return storage.NewLocalStorage(uploadPath, vaultPath, encryptionService), nil
+	case "s3":
+		s3Options := &storage.S3Options{
+			Endpoint:       getEnv("UPLOADER_S3_ENDPOINT", ""),
+			Bucket:         getEnv("UPLOADER_S3_BUCKET", "uploader"),
+			Region:         getEnv("UPLOADER_S3_REGION", "us-east-1"),
+			Prefix:         getEnv("UPLOADER_S3_PREFIX", ""),
+			ForcePathStyle: getEnvBool("UPLOADER_S3_FORCE_PATH_STYLE", true),
+			AccessKeyID:    getEnv("AWS_ACCESS_KEY_ID", ""),
+			SecretKey:      getEnv("AWS_SECRET_ACCESS_KEY", ""),
+			PartSize:       int64(getEnvInt("UPLOADER_S3_PART_SIZE_MIB", storage.DEFAULT_PART_SIZE>>20)) << 20,
+			Concurrency:    getEnvInt("UPLOADER_S3_UPLOAD_CONCURRENCY", storage.DEFAULT_UPLOAD_CONCURRENCY),
+		}
+
+		s3Storage := storage.NewS3Storage(s3Options, encryptionService)
+		if s3Storage == nil {
+			return nil, errors.New("failed to initialize S3 storage: invalid configuration")
+		}
+		return s3Storage, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", name)
+	}
+}
+
+// newKeyStore builds the keystore named by UPLOADER_KEYSTORE, sqlite unless set
+// otherwise. The file and sqlite keystores are sealed with the master key from
+// masterKey, so the server refuses to start until one is configured. Data keys
+// kept by the memory keystore are lost on restart, and every upload with them,
+// so it has to be asked for.
+func newKeyStore(sqlite *db.DB) (uploader.KeyStoreService, error) {
+	switch kind := getEnv("UPLOADER_KEYSTORE", "sqlite"); kind {
+	case "memory":
+		return keystore.NewInMemoryKeyStore(), nil
+	case "file":
+		key, err := masterKey(kind)
+		if err != nil {
+			return nil, err
+		}
+		return keystore.NewFileKeyStore(getEnv("UPLOADER_KEYSTORE_PATH", "keystore.sealed"), key)
+	case "sqlite":
+		key, err := masterKey(kind)
+		if err != nil {
+			return nil, err
+		}
+		return db.NewSqliteKeyStoreService(sqlite, key)
+	default:
+		return nil, fmt.Errorf("unknown keystore %q", kind)
+	}
+}
+
+// masterKey reads the master key for the keystore kind from
+// UPLOADER_KEYSTORE_MASTER_KEY or, if that is unset, from the file named by
+// UPLOADER_KEYSTORE_MASTER_KEY_FILE.
+func masterKey(kind string) ([]byte, error) {
+	value := os.Getenv("UPLOADER_KEYSTORE_MASTER_KEY")
+	if value == "" {
+		path := os.Getenv("UPLOADER_KEYSTORE_MASTER_KEY_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("UPLOADER_KEYSTORE=%s needs UPLOADER_KEYSTORE_MASTER_KEY or UPLOADER_KEYSTORE_MASTER_KEY_FILE (set UPLOADER_KEYSTORE=memory to keep keys only until a restart)", kind)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value = string(data)
+	}
+	return keystore.ParseMasterKey(value)
+}
+
+// newKeyWrapper returns what wraps server-managed user keys: the KMS transit
+// key named by UPLOADER_KMS_USER_KEY when a KMS is configured, or else a local
+// key read from UPLOADER_KEY_WRAPPING_KEY or the file named by
+// UPLOADER_KEY_WRAPPING_KEY_FILE. Use a key other than the keystore master key,
+// so the keystore alone does not give up the user keys. The KMS keystore
+// already wraps every entry with UPLOADER_KMS_KEY, so the user key wrapper must
+// be a different transit key.
+func newKeyWrapper(kmsOptions *kms.TransitOptions) (uploader.KeyWrapper, error) {
+	if kmsOptions != nil {
+		options := *kmsOptions
+		options.KeyName = getEnv("UPLOADER_KMS_USER_KEY", "uploader-user-keys")
+		if options.KeyName == kmsOptions.KeyName {
+			return nil, fmt.Errorf("UPLOADER_KMS_USER_KEY must name a different transit key than UPLOADER_KMS_KEY")
+		}
+		client, err := kms.NewTransitClient(options)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
+	value := os.Getenv("UPLOADER_KEY_WRAPPING_KEY")
+	if value == "" {
+		path := os.Getenv("UPLOADER_KEY_WRAPPING_KEY_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("UPLOADER_KEY_MODE=server needs UPLOADER_KEY_WRAPPING_KEY, UPLOADER_KEY_WRAPPING_KEY_FILE or UPLOADER_KMS_ADDR")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value = string(data)
+	}
+	key, err := keystore.ParseMasterKey(value)
+	if err != nil {
+		return nil, err
+	}
+	return kms.NewLocalWrapper(key)
+}
+
 // getEnv retrieves an environment variable or returns a default value
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -88,6 +360,16 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvInt retrieves an environment variable as an integer or returns a default value
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
 // getEnvBool retrieves an environment variable as a boolean or returns a default value
 func getEnvBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
@@ -98,3 +380,13 @@ func getEnvBool(key string, defaultValue bool) bool {
 	}
 	return defaultValue
 }
+
+// getEnvDuration retrieves an environment variable as a duration or returns a default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(strings.TrimSpace(value)); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,22 @@
+// Command kms-emulator serves the Vault Transit endpoints the uploader uses,
+// with keys held in memory, for local development and tests. Keys are lost when
+// it exits, and with them everything wrapped by it.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/bencleary/uploader/internal/kms"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8200", "address to listen on")
+	token := flag.String("token", os.Getenv("UPLOADER_KMS_TOKEN"), "token clients must send in X-Vault-Token; empty accepts any")
+	flag.Parse()
+
+	log.Printf("kms emulator listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, kms.NewEmulator(*token)))
+}
@@ -3,9 +3,80 @@ package uploader
 import (
 	"context"
 	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Variants of an attachment that are stored as separate blobs.
+const (
+	VARIANT_ORIGINAL = "original"
+	VARIANT_PREVIEW  = "preview"
 )
 
+// EncryptionContext identifies the blob being sealed. It is bound to the
+// ciphertext as associated data, so a blob only decrypts in the context it was
+// written for and cannot be swapped with another variant or attachment.
+type EncryptionContext struct {
+	AttachmentUID uuid.UUID
+	Variant       string
+	OwnerID       int
+	// ExpiresAt, when set, is when the data key created for the attachment
+	// expires. It is not bound to the blob.
+	ExpiresAt time.Time
+	// ContentID, when set, names the content-addressed blob being sealed. It is
+	// bound in place of the attachment and owner, so the one blob decrypts for
+	// every attachment that references it.
+	ContentID string
+}
+
+// KeyID returns the identifier of the data key for the context. Every variant of
+// an attachment shares one data key.
+func (c EncryptionContext) KeyID() string {
+	if c.AttachmentUID == uuid.Nil {
+		return ""
+	}
+	return c.AttachmentUID.String()
+}
+
 type EncryptionService interface {
-	EncryptStream(ctx context.Context, src io.Reader, key string) (io.ReadCloser, error)
-	DecryptStream(ctx context.Context, src io.Reader, ket string) (io.ReadCloser, error)
+	// EncryptStream encrypts src for the blob described by ec. Implementations
+	// backed by a KeyStoreService seal the blob with a per-attachment data key
+	// that is itself wrapped with key.
+	EncryptStream(ctx context.Context, src io.Reader, ec EncryptionContext, key string) (io.ReadCloser, error)
+	// DecryptStream decrypts src, failing if it was not written for ec. When ctx
+	// carries a recipient (see WithRecipient) with access to the blob, key is
+	// that recipient's key.
+	DecryptStream(ctx context.Context, src io.Reader, ec EncryptionContext, key string) (io.ReadCloser, error)
+	// DecryptBlob returns a seekable reader over the plaintext of blob that only
+	// reads and decrypts the parts of it that are needed. It returns a
+	// NOTIMPLEMENTED error for blob formats that can only be read in full.
+	DecryptBlob(ctx context.Context, blob Blob, ec EncryptionContext, key string) (io.ReadSeekCloser, error)
+	// CheckKey checks key against the blob's stored key verification value
+	// without reading the blob, failing with an UNAUTHORIZED error when it does
+	// not match. Blobs without a verification value pass unchecked.
+	CheckKey(ctx context.Context, ec EncryptionContext, key string) error
+	// ContentKey gives the attachment in ec a data key derived from digest, a
+	// hash of the plaintext of every variant, wrapped with key, and returns the
+	// content ID naming the blob. Attachments of the same owner and key with
+	// the same content get the same data key and content ID, so they can share
+	// one blob. It returns a
+	// NOTIMPLEMENTED error when content keys are not supported.
+	ContentKey(ctx context.Context, ec EncryptionContext, digest []byte, key string) (string, error)
+	// RotateKey re-wraps the data key for keyID from oldKey to newKey without
+	// touching the blob. It returns a NOTFOUND error when keyID has no data key.
+	RotateKey(ctx context.Context, keyID, oldKey, newKey string) error
+	// ShareKey wraps the data key for keyID, unlocked with the owner's key, with
+	// recipientKey so recipientID can decrypt the blob too, until expiresAt if it
+	// is set. It returns a NOTFOUND error when keyID has no data key.
+	ShareKey(ctx context.Context, keyID, key, recipientID, recipientKey string, expiresAt time.Time) error
+	// UnshareKey removes recipientID's copy of the data key for keyID after
+	// checking that key is the owner's.
+	UnshareKey(ctx context.Context, keyID, key, recipientID string) error
+	// VerifyKey checks that key is the owner's key for keyID.
+	VerifyKey(ctx context.Context, keyID, key string) error
+	// DestroyKey deletes the data key for keyID and the copies wrapped for
+	// recipientIDs, and confirms they are gone. Blobs sealed with it can no
+	// longer be decrypted.
+	DestroyKey(ctx context.Context, keyID string, recipientIDs []string) error
 }
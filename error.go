@@ -1,9 +1,13 @@
 package uploader
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 const (
 	CONFLICT       = "conflict"
+	EXPIRED        = "expired"
 	INTERNAL       = "internal"
 	INVALID        = "invalid"
 	NOTFOUND       = "not_found"
@@ -26,3 +30,15 @@ func Errorf(code, format string, args ...interface{}) *Error {
 		Message: fmt.Sprintf(format, args...),
 	}
 }
+
+// ErrorCode returns the code of an *Error, or INTERNAL for any other non-nil error.
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return INTERNAL
+}
@@ -6,4 +6,31 @@ type FilerService interface {
 	Record(attachment *Attachment) error
 	Fetch(fileUID uuid.UUID) (*Attachment, error)
 	Delete(fileUID uuid.UUID) error
+	// List returns every attachment owned by ownerID in upload order.
+	List(ownerID int) ([]*Attachment, error)
+	// ListAll returns every attachment of every owner in upload order.
+	ListAll() ([]*Attachment, error)
+}
+
+// CheckpointService persists progress markers for long running jobs so they can
+// resume where they stopped.
+type CheckpointService interface {
+	// Load returns the saved position for name, or "" if there is none.
+	Load(name string) (string, error)
+	Save(name, position string) error
+	Clear(name string) error
+}
+
+// BlobRefService records which attachments reference each content-addressed
+// blob, so that a blob shared by several attachments is only deleted with the
+// last of them.
+type BlobRefService interface {
+	// AddRef records that attachmentUID references the blob contentID.
+	AddRef(contentID string, attachmentUID uuid.UUID) error
+	// Ref returns the blob attachmentUID references, or "" if none.
+	Ref(attachmentUID uuid.UUID) (string, error)
+	// RemoveRef drops attachmentUID's reference.
+	RemoveRef(attachmentUID uuid.UUID) error
+	// Refs returns how many attachments reference contentID.
+	Refs(contentID string) (int, error)
 }
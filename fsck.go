@@ -0,0 +1,223 @@
+package uploader
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// DEFAULT_FSCK_GRACE is how old a blob has to be before Fsck calls it an
+// orphan. A younger blob may belong to an upload that is not recorded yet.
+const DEFAULT_FSCK_GRACE = time.Hour
+
+// FsckOptions controls what Fsck does about the problems it finds.
+type FsckOptions struct {
+	// Grace is how old a blob has to be to count as an orphan;
+	// DEFAULT_FSCK_GRACE if unset.
+	Grace time.Duration
+	// Quarantine moves orphaned blobs aside.
+	Quarantine bool
+	// Repair restores missing blobs from another replica, when a Repairer is
+	// set.
+	Repair bool
+}
+
+// FsckReport lists where a storage backend and the filer disagree.
+type FsckReport struct {
+	Attachments int `json:"attachments"`
+	Blobs       int `json:"blobs"`
+	// Orphans are blobs that no attachment refers to.
+	Orphans     []StoredBlob `json:"orphans,omitempty"`
+	Quarantined int          `json:"quarantined"`
+	// Missing lists the attachments whose original is not stored.
+	Missing []string `json:"missing,omitempty"`
+	// MissingPreviews lists the attachments with a recorded preview that is not
+	// stored.
+	MissingPreviews []string `json:"missing_previews,omitempty"`
+	// Repaired lists the attachments whose missing blobs were copied back from
+	// another replica.
+	Repaired []string `json:"repaired,omitempty"`
+}
+
+// Clean reports whether the check found nothing that is still wrong.
+func (r *FsckReport) Clean() bool {
+	return len(r.Orphans) == r.Quarantined && len(r.Missing) == 0 && len(r.MissingPreviews) == 0
+}
+
+// Fsck cross-checks the blobs in a storage backend against the attachments
+// recorded in the filer. It finds orphans, such as blobs left behind when
+// recording an upload failed, and attachments whose blobs are missing.
+type Fsck struct {
+	filer    FilerService
+	blobs    BlobLister
+	refs     BlobRefService
+	repairer Repairer
+	options  FsckOptions
+}
+
+func NewFsck(filer FilerService, blobs BlobLister, options FsckOptions) *Fsck {
+	if options.Grace <= 0 {
+		options.Grace = DEFAULT_FSCK_GRACE
+	}
+
+	return &Fsck{
+		filer:   filer,
+		blobs:   blobs,
+		options: options,
+	}
+}
+
+// SetBlobRefs keeps content-addressed blobs that are referenced in refs from
+// being called orphans, as an upload adds its reference before it is recorded.
+// Set it when dedup is on.
+func (f *Fsck) SetBlobRefs(refs BlobRefService) {
+	f.refs = refs
+}
+
+// SetRepairer restores missing blobs with repairer when FsckOptions.Repair is
+// set.
+func (f *Fsck) SetRepairer(repairer Repairer) {
+	f.repairer = repairer
+}
+
+// blobID identifies a blob variant of an attachment or of shared content.
+type blobID struct {
+	uid       string
+	contentID string
+	preview   bool
+}
+
+func attachmentBlobID(attachment *Attachment, preview bool) blobID {
+	if attachment.ContentID != "" {
+		return blobID{contentID: attachment.ContentID, preview: preview}
+	}
+	return blobID{uid: attachment.UID.String(), preview: preview}
+}
+
+// Check compares the backend with the filer as of now. Blobs modified within
+// the grace period before now are never called orphans. Attachments are listed
+// before blobs and again afterwards, so uploads and deletes made during the
+// check are not reported.
+func (f *Fsck) Check(ctx context.Context, now time.Time) (*FsckReport, error) {
+	attachments, err := f.filer.ListAll()
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := f.blobs.ListBlobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &FsckReport{Attachments: len(attachments), Blobs: len(stored)}
+	missing, missingPreviews := findMissing(attachments, stored)
+
+	if f.options.Repair && f.repairer != nil && len(missing)+len(missingPreviews) > 0 {
+		for _, attachment := range attachments {
+			uid := attachment.UID.String()
+			if !missing[uid] && !missingPreviews[uid] {
+				continue
+			}
+			if _, err := f.repairer.Repair(ctx, attachment); ErrorCode(err) == NOTFOUND {
+				continue
+			} else if err != nil {
+				return report, err
+			}
+			report.Repaired = append(report.Repaired, uid)
+		}
+
+		if len(report.Repaired) > 0 {
+			if stored, err = f.blobs.ListBlobs(ctx); err != nil {
+				return report, err
+			}
+			missing, missingPreviews = findMissing(attachments, stored)
+		}
+	}
+
+	// Anything uploaded or deleted since the first listing is left alone.
+	current, err := f.filer.ListAll()
+	if err != nil {
+		return report, err
+	}
+	recorded := make(map[string]bool)
+	contents := make(map[string]bool)
+	for _, attachment := range current {
+		recorded[attachment.UID.String()] = true
+		if attachment.ContentID != "" {
+			contents[attachment.ContentID] = true
+		}
+	}
+
+	for _, attachment := range attachments {
+		uid := attachment.UID.String()
+		if !recorded[uid] {
+			continue
+		}
+		if missing[uid] {
+			report.Missing = append(report.Missing, uid)
+		}
+		if missingPreviews[uid] {
+			report.MissingPreviews = append(report.MissingPreviews, uid)
+		}
+	}
+
+	cutoff := now.Add(-f.options.Grace)
+	for _, blob := range stored {
+		if blob.ModTime.After(cutoff) || recorded[blob.UID] || contents[blob.ContentID] {
+			continue
+		}
+		if blob.ContentID != "" && f.refs != nil {
+			refs, err := f.refs.Refs(blob.ContentID)
+			if err != nil {
+				return report, err
+			}
+			if refs > 0 {
+				continue
+			}
+		}
+
+		report.Orphans = append(report.Orphans, blob)
+		if f.options.Quarantine {
+			if err := f.blobs.QuarantineBlob(ctx, blob); err != nil {
+				return report, err
+			}
+			report.Quarantined++
+		}
+	}
+	return report, nil
+}
+
+// findMissing returns the UIDs of the attachments whose original, or recorded
+// preview, is not among stored.
+func findMissing(attachments []*Attachment, stored []StoredBlob) (map[string]bool, map[string]bool) {
+	present := make(map[blobID]bool, len(stored))
+	for _, blob := range stored {
+		present[blobID{uid: blob.UID, contentID: blob.ContentID, preview: blob.Preview}] = true
+	}
+
+	missing := make(map[string]bool)
+	missingPreviews := make(map[string]bool)
+	for _, attachment := range attachments {
+		uid := attachment.UID.String()
+		if !present[attachmentBlobID(attachment, false)] {
+			missing[uid] = true
+		}
+		// Only attachments recorded with a preview digest are known to have one.
+		if attachment.PreviewDigest != "" && !present[attachmentBlobID(attachment, true)] {
+			missingPreviews[uid] = true
+		}
+	}
+	return missing, missingPreviews
+}
+
+// Run checks every interval until ctx is done, and logs what it finds.
+func (f *Fsck) Run(ctx context.Context, interval time.Duration) {
+	runEvery(ctx, interval, "checking storage", func(now time.Time) error {
+		report, err := f.Check(ctx, now)
+		if report != nil && (len(report.Orphans) > 0 || len(report.Missing) > 0 || len(report.MissingPreviews) > 0 || len(report.Repaired) > 0) {
+			log.Printf("storage check: %d orphaned blobs (%d quarantined), %d attachments missing their original, %d missing their preview, %d repaired",
+				len(report.Orphans), report.Quarantined, len(report.Missing), len(report.MissingPreviews), len(report.Repaired))
+		}
+		return err
+	})
+}
@@ -0,0 +1,118 @@
+package uploader_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/storage"
+)
+
+func TestFsckCheck(t *testing.T) {
+	ctx := context.Background()
+	filer := db.NewSqliteFilerService(newTestDatabase(t))
+	uploadDir := t.TempDir()
+	store := storage.NewLocalStorage(uploadDir, t.TempDir(), encryption.NewAESService(keystore.NewInMemoryKeyStore()))
+
+	uploadAttachment(t, store, filer, "fine", testKey)
+	noOriginal := uploadAttachment(t, store, filer, "no original", testKey)
+	noPreview := uploadAttachment(t, store, filer, "no preview", testKey)
+	for _, path := range []string{
+		filepath.Join(uploadDir, noOriginal.UID.String(), noOriginal.UID.String()+".enc"),
+		filepath.Join(uploadDir, noPreview.UID.String(), noPreview.UID.String()+".preview.enc"),
+	} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An upload whose record was never written leaves orphaned blobs.
+	orphan := uploadAttachment(t, store, filer, "orphan", testKey)
+	if err := filer.Delete(orphan.UID); err != nil {
+		t.Fatal(err)
+	}
+
+	fsck := uploader.NewFsck(filer, store, uploader.FsckOptions{})
+	report, err := fsck.Check(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Attachments != 3 || report.Blobs != 6 {
+		t.Fatalf("expected 3 attachments and 6 blobs, got %+v", report)
+	}
+	if !slices.Equal(report.Missing, []string{noOriginal.UID.String()}) {
+		t.Fatalf("expected %s to be missing its original, got %v", noOriginal.UID, report.Missing)
+	}
+	if !slices.Equal(report.MissingPreviews, []string{noPreview.UID.String()}) {
+		t.Fatalf("expected %s to be missing its preview, got %v", noPreview.UID, report.MissingPreviews)
+	}
+	// The orphan is too new to tell from an upload still being recorded.
+	if len(report.Orphans) != 0 {
+		t.Fatalf("expected recent blobs to be left alone, got %+v", report.Orphans)
+	}
+
+	later := time.Now().Add(2 * uploader.DEFAULT_FSCK_GRACE)
+	if report, err = fsck.Check(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 2 || report.Quarantined != 0 || report.Clean() {
+		t.Fatalf("expected the orphan's 2 blobs to be reported, got %+v", report)
+	}
+	for _, blob := range report.Orphans {
+		if blob.UID != orphan.UID.String() {
+			t.Fatalf("unexpected orphan %+v", blob)
+		}
+	}
+
+	quarantine := uploader.NewFsck(filer, store, uploader.FsckOptions{Quarantine: true})
+	if report, err = quarantine.Check(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+	if report.Quarantined != 2 {
+		t.Fatalf("expected 2 blobs quarantined, got %+v", report)
+	}
+	if report, err = quarantine.Check(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 0 {
+		t.Fatalf("expected quarantined blobs to be gone, got %+v", report.Orphans)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, storage.QUARANTINE_DIRECTORY, orphan.UID.String(), orphan.UID.String()+".enc")); err != nil {
+		t.Fatalf("expected the orphan to be kept in quarantine: %v", err)
+	}
+}
+
+func TestFsckRepairsMirror(t *testing.T) {
+	ctx := context.Background()
+	filer := db.NewSqliteFilerService(newTestDatabase(t))
+	aes := encryption.NewAESService(keystore.NewInMemoryKeyStore())
+	uploadDir := t.TempDir()
+	primary := storage.NewLocalStorage(uploadDir, t.TempDir(), aes)
+	secondary, _ := newFakeS3Storage(t, aes)
+	mirror := storage.NewMirrorStorage(aes, primary, secondary)
+
+	attachment := uploadAttachment(t, mirror, filer, "mirrored", testKey)
+	if err := os.RemoveAll(filepath.Join(uploadDir, attachment.UID.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	fsck := uploader.NewFsck(filer, primary, uploader.FsckOptions{Repair: true})
+	fsck.SetRepairer(mirror)
+	report, err := fsck.Check(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.Repaired, []string{attachment.UID.String()}) || !report.Clean() {
+		t.Fatalf("expected %s to be repaired, got %+v", attachment.UID, report)
+	}
+	if got := readAttachment(t, primary, attachment, true, testKey); got != "mirrored" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+}
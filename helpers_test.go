@@ -0,0 +1,101 @@
+package uploader_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/s3test"
+	"github.com/bencleary/uploader/internal/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	testKey      = "12345678901234567890123456789012"
+	otherTestKey = "abcdefghijklmnopqrstuvwxyz123456"
+)
+
+// newTestDatabase returns an in-memory SQLite database with its tables created.
+func newTestDatabase(t *testing.T) *db.DB {
+	t.Helper()
+
+	database, err := db.NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+// newFakeS3Storage returns S3 storage backed by an in-process fake S3.
+func newFakeS3Storage(t *testing.T, encryption uploader.EncryptionService) (*storage.S3Storage, *s3test.Server) {
+	t.Helper()
+
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+
+	store := storage.NewS3Storage(&storage.S3Options{
+		Endpoint:       server.URL,
+		Bucket:         "uploader",
+		Region:         "us-east-1",
+		Prefix:         t.TempDir(),
+		ForcePathStyle: true,
+		AccessKeyID:    "test",
+		SecretKey:      "test",
+	}, encryption)
+	if err := store.Initialise(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store, server
+}
+
+// uploadAttachment stores contents as the original and preview of a new
+// attachment through store, and records it with filer.
+func uploadAttachment(t *testing.T, store uploader.StorageService, filer uploader.FilerService, contents, key string) *uploader.Attachment {
+	t.Helper()
+
+	dir := t.TempDir()
+	attachment := &uploader.Attachment{
+		UID:              uuid.New(),
+		OwnerID:          uploader.DEFAULT_OWNER_ID,
+		FileName:         "test.png",
+		LocalPath:        filepath.Join(dir, "test.png"),
+		PreviewLocalPath: filepath.Join(dir, "test.preview.png"),
+	}
+	for _, path := range attachment.GetFilePaths() {
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Upload(context.Background(), attachment, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := filer.Record(attachment); err != nil {
+		t.Fatal(err)
+	}
+	return attachment
+}
+
+// readAttachment downloads a variant of attachment through store.
+func readAttachment(t *testing.T, store uploader.StorageService, attachment *uploader.Attachment, preview bool, key string) string {
+	t.Helper()
+
+	reader, err := store.Download(context.Background(), attachment, preview, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	contents, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
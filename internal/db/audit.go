@@ -0,0 +1,53 @@
+package db
+
+import (
+	"github.com/bencleary/uploader"
+	"github.com/google/uuid"
+)
+
+var _ uploader.AuditService = (*SqliteAudit)(nil)
+
+type SqliteAudit struct {
+	db *DB
+}
+
+func NewSqliteAuditService(db *DB) *SqliteAudit {
+	return &SqliteAudit{
+		db: db,
+	}
+}
+
+func (s *SqliteAudit) Record(event *uploader.AuditEvent) error {
+	result, err := s.db.db.Exec(`
+		INSERT INTO audit_log (action, attachment_uid, owner_id, detail, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, event.Action, event.AttachmentUID.String(), event.OwnerID, event.Detail, event.CreatedAt)
+	if err != nil {
+		return err
+	}
+	event.ID, err = result.LastInsertId()
+	return err
+}
+
+func (s *SqliteAudit) List(attachmentUID uuid.UUID) ([]*uploader.AuditEvent, error) {
+	rows, err := s.db.db.Query(`
+		SELECT id, action, owner_id, detail, created_at
+		FROM audit_log
+		WHERE attachment_uid = ?
+		ORDER BY id
+	`, attachmentUID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*uploader.AuditEvent
+	for rows.Next() {
+		event := &uploader.AuditEvent{AttachmentUID: attachmentUID}
+		if err := rows.Scan(&event.ID, &event.Action, &event.OwnerID, &event.Detail, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/google/uuid"
+)
+
+func TestSqliteAudit(t *testing.T) {
+	db, err := NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audit := NewSqliteAuditService(db)
+	uid := uuid.New()
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	event := &uploader.AuditEvent{Action: uploader.AUDIT_SHRED, AttachmentUID: uid, OwnerID: 1, Detail: "key_destroyed=true", CreatedAt: at}
+	if err := audit.Record(event); err != nil {
+		t.Fatal(err)
+	}
+	if event.ID == 0 {
+		t.Fatal("expected the event ID to be set")
+	}
+	if err := audit.Record(&uploader.AuditEvent{Action: uploader.AUDIT_SHRED, AttachmentUID: uuid.New(), CreatedAt: at}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := audit.List(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected one event, got %d", len(events))
+	}
+	got := events[0]
+	if got.ID != event.ID || got.Action != uploader.AUDIT_SHRED || got.OwnerID != 1 || got.Detail != event.Detail || !got.CreatedAt.Equal(at) {
+		t.Fatalf("unexpected event %+v", got)
+	}
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/google/uuid"
+)
+
+var _ uploader.BlobRefService = (*SqliteBlobRefs)(nil)
+
+// SqliteBlobRefs keeps one row per attachment that references a
+// content-addressed blob, so adding or removing a reference twice does not
+// throw the count off.
+type SqliteBlobRefs struct {
+	db *DB
+}
+
+func NewSqliteBlobRefService(db *DB) *SqliteBlobRefs {
+	return &SqliteBlobRefs{
+		db: db,
+	}
+}
+
+func (s *SqliteBlobRefs) AddRef(contentID string, attachmentUID uuid.UUID) error {
+	_, err := s.db.db.Exec(`
+		INSERT INTO blob_refs (attachment_uid, content_id, created_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(attachment_uid) DO UPDATE SET content_id = excluded.content_id
+	`, attachmentUID.String(), contentID, time.Now().UTC())
+	return err
+}
+
+func (s *SqliteBlobRefs) Ref(attachmentUID uuid.UUID) (string, error) {
+	var contentID string
+	err := s.db.db.QueryRow(`
+		SELECT content_id
+		FROM blob_refs
+		WHERE attachment_uid = ?
+	`, attachmentUID.String()).Scan(&contentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return contentID, err
+}
+
+func (s *SqliteBlobRefs) RemoveRef(attachmentUID uuid.UUID) error {
+	_, err := s.db.db.Exec(`
+		DELETE FROM blob_refs
+		WHERE attachment_uid = ?
+	`, attachmentUID.String())
+	return err
+}
+
+func (s *SqliteBlobRefs) Refs(contentID string) (int, error) {
+	var refs int
+	err := s.db.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM blob_refs
+		WHERE content_id = ?
+	`, contentID).Scan(&refs)
+	return refs, err
+}
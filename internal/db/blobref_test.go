@@ -0,0 +1,45 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSqliteBlobRefs(t *testing.T) {
+	db, err := NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	refs := NewSqliteBlobRefService(db)
+	first, second := uuid.New(), uuid.New()
+	for _, uid := range []uuid.UUID{first, second, first} {
+		if err := refs.AddRef("meme", uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Adding the same reference twice counts once.
+	if count, err := refs.Refs("meme"); err != nil || count != 2 {
+		t.Fatalf("expected 2 references, got %d (%v)", count, err)
+	}
+	if contentID, err := refs.Ref(first); err != nil || contentID != "meme" {
+		t.Fatalf("expected reference to meme, got %q (%v)", contentID, err)
+	}
+
+	for _, uid := range []uuid.UUID{first, first} {
+		if err := refs.RemoveRef(uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := refs.Refs("meme"); err != nil || count != 1 {
+		t.Fatalf("expected 1 reference, got %d (%v)", count, err)
+	}
+	if contentID, err := refs.Ref(first); err != nil || contentID != "" {
+		t.Fatalf("expected no reference, got %q (%v)", contentID, err)
+	}
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/bencleary/uploader"
+)
+
+var _ uploader.CheckpointService = (*SqliteCheckpoints)(nil)
+
+type SqliteCheckpoints struct {
+	db *DB
+}
+
+func NewSqliteCheckpointService(db *DB) *SqliteCheckpoints {
+	return &SqliteCheckpoints{
+		db: db,
+	}
+}
+
+func (s *SqliteCheckpoints) Load(name string) (string, error) {
+	var position string
+	err := s.db.db.QueryRow(`
+		SELECT position
+		FROM checkpoints
+		WHERE name = ?
+	`, name).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return position, nil
+}
+
+func (s *SqliteCheckpoints) Save(name, position string) error {
+	_, err := s.db.db.Exec(`
+		INSERT INTO checkpoints (name, position, updated_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(name) DO UPDATE SET position = excluded.position, updated_at = excluded.updated_at
+	`, name, position)
+	return err
+}
+
+func (s *SqliteCheckpoints) Clear(name string) error {
+	_, err := s.db.db.Exec(`
+		DELETE FROM checkpoints
+		WHERE name = ?
+	`, name)
+	return err
+}
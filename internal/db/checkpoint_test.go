@@ -0,0 +1,50 @@
+package db
+
+import "testing"
+
+func TestSqliteCheckpoints(t *testing.T) {
+	db, err := NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoints := NewSqliteCheckpointService(db)
+
+	position, err := checkpoints.Load("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != "" {
+		t.Fatal("expected no checkpoint")
+	}
+
+	if err := checkpoints.Save("job", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkpoints.Save("job", "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	position, err = checkpoints.Load("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != "second" {
+		t.Fatalf("expected latest checkpoint, got %q", position)
+	}
+
+	if err := checkpoints.Clear("job"); err != nil {
+		t.Fatal(err)
+	}
+	position, err = checkpoints.Load("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != "" {
+		t.Fatal("expected checkpoint to be cleared")
+	}
+}
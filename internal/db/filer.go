@@ -1,6 +1,9 @@
 package db
 
 import (
+	"database/sql"
+	"time"
+
 	"github.com/bencleary/uploader"
 	"github.com/google/uuid"
 )
@@ -19,9 +22,9 @@ func NewSqliteFilerService(db *DB) *SqliteFiler {
 
 func (s *SqliteFiler) Record(attachment *uploader.Attachment) error {
 	_, err := s.db.db.Exec(`
-		INSERT INTO uploads (uuid, owner_id, file_name, file_size, extension, mime_type)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, attachment.UID.String(), attachment.OwnerID, attachment.FileName, attachment.FileSize, attachment.Extension, attachment.MimeType)
+		INSERT INTO uploads (uuid, owner_id, file_name, file_size, extension, mime_type, digest, preview_digest, expires_at, content_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, attachment.UID.String(), attachment.OwnerID, attachment.FileName, attachment.FileSize, attachment.Extension, attachment.MimeType, attachment.Digest, attachment.PreviewDigest, nullTime(attachment.ExpiresAt), attachment.ContentID)
 	if err != nil {
 		return err
 	}
@@ -30,17 +33,19 @@ func (s *SqliteFiler) Record(attachment *uploader.Attachment) error {
 
 func (s *SqliteFiler) Fetch(fileUID uuid.UUID) (*uploader.Attachment, error) {
 	row := s.db.db.QueryRow(`
-		SELECT owner_id, file_name, file_size, extension, mime_type
+		SELECT owner_id, file_name, file_size, extension, mime_type, digest, preview_digest, expires_at, content_id
 		FROM uploads
 		WHERE uuid = ?
 	`, fileUID.String())
 
 	attachment := &uploader.Attachment{UID: fileUID}
 
-	err := row.Scan(&attachment.OwnerID, &attachment.FileName, &attachment.FileSize, &attachment.Extension, &attachment.MimeType)
+	var expiresAt sql.NullTime
+	err := row.Scan(&attachment.OwnerID, &attachment.FileName, &attachment.FileSize, &attachment.Extension, &attachment.MimeType, &attachment.Digest, &attachment.PreviewDigest, &expiresAt, &attachment.ContentID)
 	if err != nil {
 		return nil, err
 	}
+	attachment.ExpiresAt = expiresAt.Time
 
 	return attachment, nil
 }
@@ -55,3 +60,60 @@ func (s *SqliteFiler) Delete(fileUID uuid.UUID) error {
 	}
 	return nil
 }
+
+func (s *SqliteFiler) List(ownerID int) ([]*uploader.Attachment, error) {
+	rows, err := s.db.db.Query(`
+		SELECT uuid, owner_id, file_name, file_size, extension, mime_type, digest, preview_digest, expires_at, content_id
+		FROM uploads
+		WHERE owner_id = ?
+		ORDER BY id
+	`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	return scanAttachments(rows)
+}
+
+func (s *SqliteFiler) ListAll() ([]*uploader.Attachment, error) {
+	rows, err := s.db.db.Query(`
+		SELECT uuid, owner_id, file_name, file_size, extension, mime_type, digest, preview_digest, expires_at, content_id
+		FROM uploads
+		ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return scanAttachments(rows)
+}
+
+// scanAttachments reads the attachments selected by List or ListAll.
+func scanAttachments(rows *sql.Rows) ([]*uploader.Attachment, error) {
+	defer rows.Close()
+
+	var attachments []*uploader.Attachment
+	for rows.Next() {
+		var (
+			uid       string
+			expiresAt sql.NullTime
+		)
+		attachment := &uploader.Attachment{}
+		err := rows.Scan(&uid, &attachment.OwnerID, &attachment.FileName, &attachment.FileSize, &attachment.Extension, &attachment.MimeType, &attachment.Digest, &attachment.PreviewDigest, &expiresAt, &attachment.ContentID)
+		if err != nil {
+			return nil, err
+		}
+		attachment.ExpiresAt = expiresAt.Time
+		if attachment.UID, err = uuid.Parse(uid); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, rows.Err()
+}
+
+// nullTime stores a zero time as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	if t.IsZero() {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"testing"
+	"time"
 
 	"github.com/bencleary/uploader"
 	"github.com/google/uuid"
@@ -144,3 +145,129 @@ func TestFilerDelete(t *testing.T) {
 	}
 
 }
+
+func TestFilerList(t *testing.T) {
+	db, err := NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filer := NewSqliteFilerService(db)
+
+	var owned, all []uuid.UUID
+	for _, ownerID := range []int{1, 2, 1} {
+		attachment := &uploader.Attachment{
+			UID:      uuid.New(),
+			OwnerID:  ownerID,
+			FileName: "test",
+		}
+		if err := filer.Record(attachment); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, attachment.UID)
+		if ownerID == 1 {
+			owned = append(owned, attachment.UID)
+		}
+	}
+
+	attachments, err := filer.List(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(attachments) != len(owned) {
+		t.Fatalf("expected %d attachments, got %d", len(owned), len(attachments))
+	}
+	for i, attachment := range attachments {
+		if attachment.UID != owned[i] {
+			t.Fatal("expected attachments in upload order")
+		}
+	}
+
+	attachments, err = filer.ListAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != len(all) {
+		t.Fatalf("expected %d attachments of every owner, got %d", len(all), len(attachments))
+	}
+	for i, attachment := range attachments {
+		if attachment.UID != all[i] {
+			t.Fatal("expected every attachment in upload order")
+		}
+	}
+}
+
+func TestFilerRecordsDigests(t *testing.T) {
+	db, err := NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	filer := NewSqliteFilerService(db)
+	attachment := &uploader.Attachment{
+		UID:           uuid.New(),
+		OwnerID:       1,
+		FileName:      "test",
+		Digest:        "aa",
+		PreviewDigest: "bb",
+		ContentID:     "cc",
+	}
+	if err := filer.Record(attachment); err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := filer.Fetch(attachment.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.Digest != "aa" || row.PreviewDigest != "bb" {
+		t.Fatalf("expected recorded digests, got %q and %q", row.Digest, row.PreviewDigest)
+	}
+	if row.ContentID != "cc" {
+		t.Fatalf("expected content ID cc, got %q", row.ContentID)
+	}
+}
+
+func TestFilerRecordsExpiry(t *testing.T) {
+	db, err := NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	filer := NewSqliteFilerService(db)
+	expiresAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	expiring := &uploader.Attachment{UID: uuid.New(), OwnerID: 1, FileName: "expiring", ExpiresAt: expiresAt}
+	permanent := &uploader.Attachment{UID: uuid.New(), OwnerID: 1, FileName: "permanent"}
+	for _, attachment := range []*uploader.Attachment{expiring, permanent} {
+		if err := filer.Record(attachment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	row, err := filer.Fetch(expiring.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !row.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("expected expiry %s, got %s", expiresAt, row.ExpiresAt)
+	}
+
+	attachments, err := filer.List(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 2 || !attachments[0].ExpiresAt.Equal(expiresAt) || !attachments[1].ExpiresAt.IsZero() {
+		t.Fatalf("unexpected expiries %+v", attachments)
+	}
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bencleary/uploader"
+)
+
+var _ uploader.KeyStoreService = (*SqliteKeyStore)(nil)
+
+// KEY_ALGORITHM names how the key material in the keys table is sealed. It is
+// stored per row so rows can be resealed with another algorithm later.
+const KEY_ALGORITHM = "aes-256-gcm"
+
+// KeyRecord describes a key in the keys table without its key material.
+// LastUsedAt and RotatedAt are zero when the key was never read or replaced,
+// and ExpiresAt is zero for keys that never expire.
+type KeyRecord struct {
+	KeyID      string
+	Algorithm  string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	RotatedAt  time.Time
+	ExpiresAt  time.Time
+}
+
+// SqliteKeyStore keeps keys in the keys table of the filer database. Key
+// material is sealed with AES-256-GCM under a master key, with the key ID as
+// associated data so a sealed value cannot be moved to another row. Timestamps
+// are stored in UTC, so lifecycle questions can be answered in SQL:
+//
+//	SELECT key_id FROM keys
+//	WHERE COALESCE(last_used_at, created_at) < datetime('now', '-90 days')
+type SqliteKeyStore struct {
+	db   *DB
+	aead cipher.AEAD
+}
+
+// NewSqliteKeyStoreService returns a keystore sealed with masterKey, which
+// must be 32 bytes.
+func NewSqliteKeyStoreService(db *DB, masterKey []byte) (*SqliteKeyStore, error) {
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes")
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SqliteKeyStore{
+		db:   db,
+		aead: aead,
+	}, nil
+}
+
+// StoreKey adds a key, or replaces it and sets rotated_at if it exists. A
+// replaced key keeps its expiry.
+func (s *SqliteKeyStore) StoreKey(id string, key []byte) error {
+	sealed, err := s.seal(id, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.db.Exec(`
+		INSERT INTO keys (key_id, wrapped_key, algorithm, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(key_id) DO UPDATE SET wrapped_key = excluded.wrapped_key, algorithm = excluded.algorithm, rotated_at = excluded.created_at
+	`, id, sealed, KEY_ALGORITHM, time.Now().UTC())
+	return err
+}
+
+// StoreKeyWithExpiry is StoreKey that also sets expires_at, or clears it for a
+// zero expiresAt.
+func (s *SqliteKeyStore) StoreKeyWithExpiry(id string, key []byte, expiresAt time.Time) error {
+	sealed, err := s.seal(id, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.db.Exec(`
+		INSERT INTO keys (key_id, wrapped_key, algorithm, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(key_id) DO UPDATE SET wrapped_key = excluded.wrapped_key, algorithm = excluded.algorithm, rotated_at = excluded.created_at, expires_at = excluded.expires_at
+	`, id, sealed, KEY_ALGORITHM, time.Now().UTC(), nullTime(expiresAt))
+	return err
+}
+
+// seal encrypts key material under the master key, bound to id.
+func (s *SqliteKeyStore) seal(id string, key []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, key, []byte(id)), nil
+}
+
+// RetrieveKey returns a key and records when it was last used.
+func (s *SqliteKeyStore) RetrieveKey(id string) ([]byte, error) {
+	var (
+		sealed    []byte
+		algorithm string
+		expiresAt sql.NullTime
+	)
+	err := s.db.db.QueryRow(`
+		SELECT wrapped_key, algorithm, expires_at
+		FROM keys
+		WHERE key_id = ?
+	`, id).Scan(&sealed, &algorithm, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, uploader.Errorf(uploader.NOTFOUND, "key not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid && !time.Now().Before(expiresAt.Time) {
+		return nil, uploader.Errorf(uploader.EXPIRED, "key expired at %s", expiresAt.Time.Format(time.RFC3339))
+	}
+
+	if algorithm != KEY_ALGORITHM {
+		return nil, fmt.Errorf("key %s is sealed with unsupported algorithm %q", id, algorithm)
+	}
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("key %s is corrupt", id)
+	}
+	key, err := s.aead.Open(nil, sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("key %s could not be opened with the master key", id)
+	}
+
+	if _, err := s.db.db.Exec(`
+		UPDATE keys
+		SET last_used_at = ?
+		WHERE key_id = ?
+	`, time.Now().UTC(), id); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *SqliteKeyStore) DeleteKey(id string) error {
+	_, err := s.db.db.Exec(`
+		DELETE FROM keys
+		WHERE key_id = ?
+	`, id)
+	return err
+}
+
+func (s *SqliteKeyStore) DeleteExpiredKeys(now time.Time) (int, error) {
+	result, err := s.db.db.Exec(`
+		DELETE FROM keys
+		WHERE expires_at IS NOT NULL AND expires_at <= ?
+	`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+// UnusedSince returns the keys that have not been read since cutoff, counting
+// keys that were never read from when they were created, oldest first.
+func (s *SqliteKeyStore) UnusedSince(cutoff time.Time) ([]*KeyRecord, error) {
+	rows, err := s.db.db.Query(`
+		SELECT key_id, algorithm, created_at, last_used_at, rotated_at, expires_at
+		FROM keys
+		WHERE COALESCE(last_used_at, created_at) < ?
+		ORDER BY COALESCE(last_used_at, created_at), key_id
+	`, cutoff.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*KeyRecord
+	for rows.Next() {
+		var (
+			record                         = &KeyRecord{}
+			lastUsed, rotatedAt, expiresAt sql.NullTime
+		)
+		if err := rows.Scan(&record.KeyID, &record.Algorithm, &record.CreatedAt, &lastUsed, &rotatedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		record.LastUsedAt = lastUsed.Time
+		record.RotatedAt = rotatedAt.Time
+		record.ExpiresAt = expiresAt.Time
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
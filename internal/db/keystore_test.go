@@ -0,0 +1,175 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+)
+
+var testMasterKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestKeyStore(t *testing.T) *SqliteKeyStore {
+	t.Helper()
+
+	db, err := NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewSqliteKeyStoreService(db, testMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestSqliteKeyStore(t *testing.T) {
+	keys := newTestKeyStore(t)
+
+	if err := keys.StoreKey("key", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	var sealed []byte
+	if err := keys.db.db.QueryRow(`SELECT wrapped_key FROM keys WHERE key_id = 'key'`).Scan(&sealed); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("expected key material to be sealed")
+	}
+
+	key, err := keys.RetrieveKey("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "secret" {
+		t.Fatalf("unexpected key %q", key)
+	}
+
+	// A sealed value copied to another row does not open.
+	if _, err := keys.db.db.Exec(`INSERT INTO keys (key_id, wrapped_key, algorithm, created_at) VALUES ('copy', ?, ?, ?)`, sealed, KEY_ALGORITHM, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.RetrieveKey("copy"); err == nil {
+		t.Fatal("expected a moved key to be rejected")
+	}
+
+	if err := keys.DeleteKey("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.RetrieveKey("key"); uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected NOTFOUND error, got %v", err)
+	}
+}
+
+func TestSqliteKeyStoreLifecycle(t *testing.T) {
+	keys := newTestKeyStore(t)
+
+	for _, id := range []string{"fresh", "stale", "unread"} {
+		if err := keys.StoreKey(id, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := keys.RetrieveKey("stale"); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.StoreKey("fresh", []byte("rotated")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.RetrieveKey("fresh"); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().UTC().AddDate(0, 0, -100)
+	if _, err := keys.db.db.Exec(`UPDATE keys SET last_used_at = ? WHERE key_id = 'stale'`, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.db.db.Exec(`UPDATE keys SET created_at = ? WHERE key_id = 'unread'`, old.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := keys.UnusedSince(time.Now().AddDate(0, 0, -90))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].KeyID != "stale" || records[1].KeyID != "unread" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	if records[0].LastUsedAt.IsZero() || !records[1].LastUsedAt.IsZero() {
+		t.Fatalf("unexpected last used times %+v %+v", records[0], records[1])
+	}
+
+	// The same question asked in plain SQL.
+	rows, err := keys.db.db.Query(`
+		SELECT key_id FROM keys
+		WHERE COALESCE(last_used_at, created_at) < datetime('now', '-90 days')
+		ORDER BY key_id
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) != 2 || ids[0] != "stale" || ids[1] != "unread" {
+		t.Fatalf("unexpected SQL result %v", ids)
+	}
+
+	var rotatedAt *time.Time
+	if err := keys.db.db.QueryRow(`SELECT rotated_at FROM keys WHERE key_id = 'fresh'`).Scan(&rotatedAt); err != nil {
+		t.Fatal(err)
+	}
+	if rotatedAt == nil {
+		t.Fatal("expected replacing a key to set rotated_at")
+	}
+}
+
+func TestSqliteKeyStoreExpiry(t *testing.T) {
+	keys := newTestKeyStore(t)
+	now := time.Now()
+
+	if err := keys.StoreKeyWithExpiry("expired", []byte("secret"), now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.StoreKeyWithExpiry("live", []byte("secret"), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.StoreKey("live", []byte("rewrapped")); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.StoreKey("forever", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := keys.RetrieveKey("expired"); uploader.ErrorCode(err) != uploader.EXPIRED {
+		t.Fatalf("expected EXPIRED error, got %v", err)
+	}
+	if key, err := keys.RetrieveKey("live"); err != nil || string(key) != "rewrapped" {
+		t.Fatalf("unexpected key %q: %v", key, err)
+	}
+
+	deleted, err := keys.DeleteExpiredKeys(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Fatalf("expected 1 key deleted, got %d", deleted)
+	}
+	// The replaced key kept its expiry.
+	if deleted, _ := keys.DeleteExpiredKeys(now.Add(2 * time.Hour)); deleted != 1 {
+		t.Fatalf("expected the replaced key to expire, got %d deleted", deleted)
+	}
+	if _, err := keys.RetrieveKey("forever"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"github.com/bencleary/uploader"
+	"github.com/google/uuid"
+)
+
+var _ uploader.RecipientService = (*SqliteRecipients)(nil)
+
+type SqliteRecipients struct {
+	db *DB
+}
+
+func NewSqliteRecipientService(db *DB) *SqliteRecipients {
+	return &SqliteRecipients{
+		db: db,
+	}
+}
+
+func (s *SqliteRecipients) AddRecipient(recipient *uploader.Recipient) error {
+	_, err := s.db.db.Exec(`
+		INSERT INTO recipients (attachment_uid, recipient_id, granted_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(attachment_uid, recipient_id) DO UPDATE SET granted_at = excluded.granted_at
+	`, recipient.AttachmentUID.String(), recipient.RecipientID, recipient.GrantedAt)
+	return err
+}
+
+func (s *SqliteRecipients) RemoveRecipient(attachmentUID uuid.UUID, recipientID string) error {
+	_, err := s.db.db.Exec(`
+		DELETE FROM recipients
+		WHERE attachment_uid = ? AND recipient_id = ?
+	`, attachmentUID.String(), recipientID)
+	return err
+}
+
+func (s *SqliteRecipients) ListRecipients(attachmentUID uuid.UUID) ([]*uploader.Recipient, error) {
+	rows, err := s.db.db.Query(`
+		SELECT recipient_id, granted_at
+		FROM recipients
+		WHERE attachment_uid = ?
+		ORDER BY granted_at, recipient_id
+	`, attachmentUID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []*uploader.Recipient
+	for rows.Next() {
+		recipient := &uploader.Recipient{AttachmentUID: attachmentUID}
+		if err := rows.Scan(&recipient.RecipientID, &recipient.GrantedAt); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, rows.Err()
+}
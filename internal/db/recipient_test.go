@@ -0,0 +1,57 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/google/uuid"
+)
+
+func TestSqliteRecipients(t *testing.T) {
+	db, err := NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipients := NewSqliteRecipientService(db)
+	uid := uuid.New()
+	granted := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for i, id := range []string{"bob", "carol"} {
+		err := recipients.AddRecipient(&uploader.Recipient{AttachmentUID: uid, RecipientID: id, GrantedAt: granted.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Sharing with another attachment must not show up.
+	if err := recipients.AddRecipient(&uploader.Recipient{AttachmentUID: uuid.New(), RecipientID: "dave", GrantedAt: granted}); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := recipients.ListRecipients(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].RecipientID != "bob" || list[1].RecipientID != "carol" {
+		t.Fatalf("unexpected recipients %+v", list)
+	}
+	if !list[0].GrantedAt.Equal(granted) || list[0].AttachmentUID != uid {
+		t.Fatalf("unexpected recipient %+v", list[0])
+	}
+
+	if err := recipients.RemoveRecipient(uid, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	list, err = recipients.ListRecipients(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].RecipientID != "carol" {
+		t.Fatalf("expected only carol, got %+v", list)
+	}
+}
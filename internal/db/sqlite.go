@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -38,5 +39,116 @@ func (d *DB) CreateTable() error {
 			mime_type TEXT
 		)
 	`)
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the table was first released.
+	columns := []struct{ name, definition string }{
+		{"digest", "TEXT NOT NULL DEFAULT ''"},
+		{"preview_digest", "TEXT NOT NULL DEFAULT ''"},
+		{"expires_at", "DATETIME"},
+		{"content_id", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, column := range columns {
+		if err := d.addColumn("uploads", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	_, err = d.db.Exec(`
+		CREATE TABLE IF NOT EXISTS checkpoints (
+			name TEXT PRIMARY KEY,
+			position TEXT,
+			updated_at DATETIME
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(`
+		CREATE TABLE IF NOT EXISTS recipients (
+			attachment_uid TEXT,
+			recipient_id TEXT,
+			granted_at DATETIME,
+			PRIMARY KEY (attachment_uid, recipient_id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(`
+		CREATE TABLE IF NOT EXISTS blob_refs (
+			attachment_uid TEXT PRIMARY KEY,
+			content_id TEXT NOT NULL,
+			created_at DATETIME
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(`CREATE INDEX IF NOT EXISTS blob_refs_content_id ON blob_refs (content_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY,
+			action TEXT,
+			attachment_uid TEXT,
+			owner_id INTEGER,
+			detail TEXT,
+			created_at DATETIME
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(`
+		CREATE TABLE IF NOT EXISTS keys (
+			key_id TEXT PRIMARY KEY,
+			wrapped_key BLOB NOT NULL,
+			algorithm TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_used_at DATETIME,
+			rotated_at DATETIME,
+			expires_at DATETIME
+		)
+	`)
+	return err
+}
+
+// addColumn adds a column to table unless it already exists, so databases
+// created by older versions pick up new columns.
+func (d *DB) addColumn(table, column, definition string) error {
+	rows, err := d.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, primaryKey int
+			name, columnType         string
+			defaultValue             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
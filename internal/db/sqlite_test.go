@@ -1,7 +1,10 @@
 package db
 
 import (
+	"path/filepath"
 	"testing"
+
+	"github.com/google/uuid"
 )
 
 func TestNewSQLiteDatabase(t *testing.T) {
@@ -32,3 +35,46 @@ func TestSQLiteDatabaseCreateTable(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSQLiteDatabaseCreateTableAddsColumns(t *testing.T) {
+	db, err := NewSQLiteDatabase(filepath.Join(t.TempDir(), "filer.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The uploads table as created before digests were recorded.
+	_, err = db.db.Exec(`
+		CREATE TABLE uploads (
+			id INTEGER PRIMARY KEY,
+			uuid TEXT,
+			owner_id INTEGER,
+			file_name TEXT,
+			file_size INTEGER,
+			extension TEXT,
+			mime_type TEXT
+		)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := uuid.New()
+	if _, err := db.db.Exec(`INSERT INTO uploads (uuid, owner_id, file_name, file_size, extension, mime_type) VALUES (?, 1, 'old', 0, '', '')`, uid.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Running it twice must be harmless.
+	for i := 0; i < 2; i++ {
+		if err := db.CreateTable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attachment, err := NewSqliteFilerService(db).Fetch(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.Digest != "" {
+		t.Fatalf("expected no digest for an old row, got %q", attachment.Digest)
+	}
+}
@@ -1,13 +1,18 @@
 package encryption
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/bencleary/uploader"
 )
@@ -18,44 +23,90 @@ import (
 // Ensure service implements interface.
 var _ uploader.EncryptionService = (*AES)(nil)
 
+// DATA_KEY_SIZE is the size of the random data key generated for each blob.
+const DATA_KEY_SIZE = 32
+
+// AES seals blobs with AES-256-GCM, or another registered Algorithm. When a
+// keystore is configured it uses envelope encryption: every keyID gets a random
+// data key which is wrapped with the caller's key and kept in the keystore, so
+// changing the caller's key only means re-wrapping the data key rather than
+// re-encrypting the blob.
 type AES struct {
-	keystore uploader.KeyStoreService
+	keystore  uploader.KeyStoreService
+	algorithm Algorithm
+	kdf       KDFParams
+
+	// contentSecret caches the secret that content keys are derived from.
+	contentMu     sync.Mutex
+	contentSecret []byte
 }
 
 func NewAESService(keystore uploader.KeyStoreService) *AES {
+	return NewEncryptionService(keystore, AESGCM{})
+}
+
+// NewEncryptionService creates a service that seals new blobs with algorithm.
+// Blobs are always decrypted with the algorithm recorded in their header.
+func NewEncryptionService(keystore uploader.KeyStoreService, algorithm Algorithm) *AES {
 	return &AES{
-		keystore: keystore,
+		keystore:  keystore,
+		algorithm: algorithm,
+		kdf:       DefaultArgon2id,
 	}
 }
 
+// SetKDF changes the key derivation used for passphrase keys from now on.
+// Existing blobs keep the parameters recorded in their headers. Costs above
+// what is accepted when reading a header are rejected, as blobs written with
+// them could not be read back.
+func (a *AES) SetKDF(params KDFParams) error {
+	if err := params.validate(); err != nil {
+		return err
+	}
+	a.kdf = params
+	return nil
+}
+
+var ErrInvalidKey = errors.New("key must be 32 characters and not a single repeated character, or 32 bytes encoded as hex: or b64:")
+
+// IsValidKey reports whether key can be used as an encryption key.
 func IsValidKey(key string) bool {
+	return ValidateKey(key) == nil
+}
+
+// ValidateKey checks key against the accepted formats: 32 characters of raw key
+// material, 32 bytes encoded with HEX_KEY_PREFIX or BASE64_KEY_PREFIX, or a
+// PASSPHRASE_PREFIX passphrase that meets the strength policy.
+func ValidateKey(key string) error {
+	if IsPassphrase(key) {
+		return CheckPassphrase(key)
+	}
+	if isEncodedKey(key) {
+		_, err := keyMaterial(key)
+		return err
+	}
 
 	if len(key) != 32 {
-		return false
+		return ErrInvalidKey
 	}
 
 	_, err := aes.NewCipher([]byte(key))
 	if err != nil {
-		return false
+		return ErrInvalidKey
 	}
 
 	firstChar := key[0]
 	for i := 1; i < len(key); i++ {
 		if key[i] != firstChar {
-			return true
+			return nil
 		}
 	}
 
-	return false
+	return ErrInvalidKey
 }
 
 func (a *AES) encrypt(data []byte, key string) ([]byte, error) {
-	block, err := aes.NewCipher([]byte(key))
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM([]byte(key))
 	if err != nil {
 		return nil, err
 	}
@@ -70,12 +121,7 @@ func (a *AES) encrypt(data []byte, key string) ([]byte, error) {
 }
 
 func (a *AES) decrypt(ciphertext []byte, key string) ([]byte, error) {
-	block, err := aes.NewCipher([]byte(key))
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM([]byte(key))
 	if err != nil {
 		return nil, err
 	}
@@ -94,29 +140,301 @@ func (a *AES) decrypt(ciphertext []byte, key string) ([]byte, error) {
 	return plaintext, nil
 }
 
-func (a *AES) EncryptStream(ctx context.Context, src io.Reader, key string) (io.ReadCloser, error) {
-	encryptedContent, err := io.ReadAll(src)
+// EncryptStream returns a reader producing the segmented ciphertext of src. The
+// plaintext is sealed one CHUNK_SIZE segment at a time as the reader is consumed
+// and every segment is bound to ec.
+func (a *AES) EncryptStream(ctx context.Context, src io.Reader, ec uploader.EncryptionContext, key string) (io.ReadCloser, error) {
+	keyID := ec.KeyID()
+	if a.keystore == nil || keyID == "" {
+		return a.encryptWithKey(ctx, src, key, binding(ec))
+	}
+
+	dataKey, err := a.dataKey(ctx, keyID, key)
+	if err != nil {
+		return nil, err
+	}
+	if dataKey == nil {
+		if dataKey, err = a.newDataKey(keyID, key, ec.ExpiresAt); err != nil {
+			return nil, err
+		}
+	}
+	return a.encryptWith(ctx, src, dataKey, nil, binding(ec))
+}
+
+// DecryptStream returns a reader producing the plaintext of a stream written by
+// EncryptStream. The first segment is authenticated before returning so that a
+// wrong key fails here rather than part way through a response. A segment that
+// fails once the key is known to be right is reported as corruption.
+func (a *AES) DecryptStream(ctx context.Context, src io.Reader, ec uploader.EncryptionContext, key string) (io.ReadCloser, error) {
+	source, checked, err := a.keySource(ctx, ec, key)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := a.decryptWith(ctx, src, source, binding(ec))
+	if err != nil {
+		return nil, openError(ec, err, checked)
+	}
+	return reader, nil
+}
+
+// keySource returns where the key for the blob described by ec comes from: its
+// unwrapped data key, or the caller's key for blobs without one. When ctx names
+// a recipient the blob was shared with, the recipient's copy of the data key is
+// unwrapped instead of the owner's. checked reports whether key was verified by
+// unwrapping a data key; otherwise only decrypting the blob tells.
+func (a *AES) keySource(ctx context.Context, ec uploader.EncryptionContext, key string) (source keySource, checked bool, err error) {
+	keyID := ec.KeyID()
+	if a.keystore == nil || keyID == "" {
+		return callerKey(ctx, key), false, nil
+	}
+
+	if recipientID := uploader.RecipientFromContext(ctx); recipientID != "" {
+		dataKey, err := a.recipientDataKey(ctx, keyID, key, recipientID)
+		if err != nil {
+			return nil, false, err
+		}
+		if dataKey != nil {
+			return fixedKey(dataKey), true, nil
+		}
+	}
+
+	dataKey, err := a.dataKey(ctx, keyID, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if dataKey == nil {
+		return callerKey(ctx, key), false, nil
+	}
+	return fixedKey(dataKey), true, nil
+}
+
+// keySource resolves the key material for a blob from its header, which is nil
+// for blobs written before headers existed.
+type keySource func(h *header) ([]byte, error)
+
+// callerKey uses the caller's key material (see keyMaterial), or stretches it
+// with the KDF recorded in the header when the blob was sealed under a
+// passphrase, reusing a key stretched under the same header earlier in the
+// request.
+func callerKey(ctx context.Context, key string) keySource {
+	return func(h *header) ([]byte, error) {
+		if h == nil || h.kdf == nil {
+			return keyMaterial(key)
+		}
+		return h.kdf.deriveCached(ctx, key)
+	}
+}
+
+// fixedKey always uses the given key material, such as an unwrapped data key.
+func fixedKey(key []byte) keySource {
+	return func(*header) ([]byte, error) {
+		return key, nil
+	}
+}
+
+// encryptWithKey seals src under the caller's key. Passphrases are stretched
+// with the service KDF and a fresh salt, both of which go into the header.
+func (a *AES) encryptWithKey(ctx context.Context, src io.Reader, key string, binding []byte) (io.ReadCloser, error) {
+	if !IsPassphrase(key) {
+		material, err := keyMaterial(key)
+		if err != nil {
+			return nil, err
+		}
+		return a.encryptWith(ctx, src, material, nil, binding)
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	kdf := a.kdf.withSalt(salt)
+	derived, err := kdf.derive(key)
+	if err != nil {
+		return nil, err
+	}
+	return a.encryptWith(ctx, src, derived, kdf, binding)
+}
+
+func (a *AES) encryptWith(ctx context.Context, src io.Reader, key []byte, kdf *KDFParams, binding []byte) (io.ReadCloser, error) {
+	aead, err := a.algorithm.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &header{
+		version:   HEADER_VERSION,
+		algorithm: a.algorithm.ID(),
+		kdf:       kdf,
+		prefix:    make([]byte, noncePrefixSize),
+	}
+	if _, err = rand.Read(h.prefix); err != nil {
+		return nil, err
+	}
+
+	return newEncryptReader(ctx, src, aead, h, binding), nil
+}
+
+// decryptWith opens a stream with the key material from keyFor, checking that it
+// is bound to binding. Blobs without a header are read through decryptLegacy.
+func (a *AES) decryptWith(ctx context.Context, src io.Reader, keyFor keySource, binding []byte) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(src)
+	if start, _ := buffered.Peek(len(magic)); !hasMagic(start) {
+		key, err := keyFor(nil)
+		if err != nil {
+			return nil, err
+		}
+		return a.decryptLegacy(buffered, key)
+	}
+
+	h, raw, err := readHeader(buffered)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm, err := LookupAlgorithm(h.algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := keyFor(h)
 	if err != nil {
 		return nil, err
 	}
 
-	encryptedData, err := a.encrypt(encryptedContent, key)
+	aead, err := algorithm.NewAEAD(key)
 	if err != nil {
 		return nil, err
 	}
 
-	return io.NopCloser(bytes.NewReader(encryptedData)), nil
+	ad, err := associatedData(h, raw, binding)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := newDecryptReader(ctx, buffered, aead, h.prefix, ad)
+	if err := reader.prime(); err != nil {
+		return nil, err
+	}
+
+	return reader, nil
 }
-func (a *AES) DecryptStream(ctx context.Context, src io.Reader, key string) (io.ReadCloser, error) {
-	decryptedContent, err := io.ReadAll(src)
+
+// seal encrypts a small value, such as a data key, under the caller's key using
+// the same self-describing format as blobs.
+func (a *AES) seal(plaintext []byte, key string) ([]byte, error) {
+	encrypted, err := a.encryptWithKey(context.Background(), bytes.NewReader(plaintext), key, nil)
 	if err != nil {
 		return nil, err
 	}
+	return io.ReadAll(encrypted)
+}
+
+// open reverses seal. The value is kept in ctx's uploader.KeyCache, so a data
+// key unwrapped to check a key is not unwrapped again to decrypt with it.
+func (a *AES) open(ctx context.Context, sealed []byte, key string) ([]byte, error) {
+	id := sha256.New()
+	id.Write([]byte("open\x00"))
+	id.Write(sealed)
+	id.Write([]byte(key))
+	return uploader.KeyCacheFromContext(ctx).Key(hex.EncodeToString(id.Sum(nil)), func() ([]byte, error) {
+		decrypted, err := a.decryptWith(ctx, bytes.NewReader(sealed), callerKey(ctx, key), nil)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(decrypted)
+	})
+}
 
-	decryptedData, err := a.decrypt(decryptedContent, key)
+// dataKey returns the data key that seals the blob identified by keyID,
+// unwrapping it with key. It returns nil when none exists, which for an
+// existing blob means it predates envelope encryption and is sealed with key
+// itself. An expired data key fails with an EXPIRED error.
+func (a *AES) dataKey(ctx context.Context, keyID, key string) ([]byte, error) {
+	wrapped, err := a.keystore.RetrieveKey(keyID)
+	if uploader.ErrorCode(err) == uploader.NOTFOUND {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := a.open(ctx, wrapped, key)
 	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return dataKey, nil
+}
+
+// newDataKey generates a data key for keyID and stores it wrapped with key,
+// expiring at expiresAt if it is set.
+func (a *AES) newDataKey(keyID, key string, expiresAt time.Time) ([]byte, error) {
+	dataKey := make([]byte, DATA_KEY_SIZE)
+	if _, err := rand.Read(dataKey); err != nil {
 		return nil, err
 	}
 
-	return io.NopCloser(bytes.NewReader(decryptedData)), nil
+	wrapped, err := a.seal(dataKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.keystore.StoreKeyWithExpiry(keyID, wrapped, expiresAt); err != nil {
+		return nil, err
+	}
+	return dataKey, nil
+}
+
+// RotateKey re-wraps the data key for keyID under newKey. Rotating a data key
+// that is already wrapped with newKey succeeds, so an interrupted rotation can be
+// run again.
+func (a *AES) RotateKey(ctx context.Context, keyID, oldKey, newKey string) error {
+	if a.keystore == nil {
+		return uploader.Errorf(uploader.NOTFOUND, "no data key for %s", keyID)
+	}
+
+	wrapped, err := a.keystore.RetrieveKey(keyID)
+	if err != nil {
+		return err
+	}
+
+	dataKey, err := a.open(ctx, wrapped, oldKey)
+	if err != nil {
+		if _, err := a.open(ctx, wrapped, newKey); err == nil {
+			return nil
+		}
+		return ErrAuthentication
+	}
+
+	rewrapped, err := a.seal(dataKey, newKey)
+	if err != nil {
+		return err
+	}
+	return a.keystore.StoreKey(keyID, rewrapped)
+}
+
+// DestroyKey crypto-shreds keyID: the wrapped data key and every recipient copy
+// are deleted, then read back to confirm the keystore no longer has them.
+func (a *AES) DestroyKey(ctx context.Context, keyID string, recipientIDs []string) error {
+	if a.keystore == nil {
+		return uploader.Errorf(uploader.NOTFOUND, "no data key for %s", keyID)
+	}
+
+	ids := []string{keyID}
+	for _, recipientID := range recipientIDs {
+		ids = append(ids, recipientKeyID(keyID, recipientID))
+	}
+	// Recipient copies go first so a failure part way never leaves them
+	// without the owner's copy to retry from.
+	for i := len(ids) - 1; i >= 0; i-- {
+		if err := a.keystore.DeleteKey(ids[i]); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range ids {
+		if _, err := a.keystore.RetrieveKey(id); uploader.ErrorCode(err) != uploader.NOTFOUND {
+			return uploader.Errorf(uploader.INTERNAL, "key %s was not destroyed", id)
+		}
+	}
+	return nil
 }
@@ -3,8 +3,27 @@ package encryption
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/google/uuid"
+)
+
+var (
+	testContext = uploader.EncryptionContext{
+		AttachmentUID: uuid.MustParse("8f3a2c1e-5b7d-4e9f-a0c2-d4e6f8a0b2c4"),
+		Variant:       uploader.VARIANT_ORIGINAL,
+		OwnerID:       uploader.DEFAULT_OWNER_ID,
+	}
+	previewContext = uploader.EncryptionContext{
+		AttachmentUID: testContext.AttachmentUID,
+		Variant:       uploader.VARIANT_PREVIEW,
+		OwnerID:       uploader.DEFAULT_OWNER_ID,
+	}
 )
 
 func TestIsValidKey(t *testing.T) {
@@ -38,6 +57,31 @@ func TestIsValidKey(t *testing.T) {
 			key:      "123456789012345678901234567890123",
 			expected: false,
 		},
+		{
+			name:     "hex encoded 32 bytes",
+			key:      "hex:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			expected: true,
+		},
+		{
+			name:     "hex encoded 16 bytes",
+			key:      "hex:000102030405060708090a0b0c0d0e0f",
+			expected: false,
+		},
+		{
+			name:     "base64url encoded 32 bytes",
+			key:      "b64:AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8",
+			expected: true,
+		},
+		{
+			name:     "base64url encoded 32 bytes with padding",
+			key:      "b64:AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+			expected: true,
+		},
+		{
+			name:     "invalid base64",
+			key:      "b64:not base64!",
+			expected: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -87,7 +131,7 @@ func TestAESServiceEncryptStream(t *testing.T) {
 	key := "some-secret-key"
 	aes := NewAESService(nil)
 	data := bytes.NewBufferString("some-data")
-	_, err := aes.EncryptStream(context.Background(), data, key)
+	_, err := aes.EncryptStream(context.Background(), data, uploader.EncryptionContext{}, key)
 	if err == nil {
 		t.Fatal(err)
 	}
@@ -97,11 +141,11 @@ func TestAESServiceDecryptStream(t *testing.T) {
 	key := "some-secret-key1"
 	aes := NewAESService(nil)
 	data := bytes.NewBufferString("some-data")
-	enc, err := aes.EncryptStream(context.Background(), data, key)
+	enc, err := aes.EncryptStream(context.Background(), data, uploader.EncryptionContext{}, key)
 	if err != nil {
 		t.Fatal(err)
 	}
-	dec, err := aes.DecryptStream(context.Background(), enc, key)
+	dec, err := aes.DecryptStream(context.Background(), enc, uploader.EncryptionContext{}, key)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -114,3 +158,234 @@ func TestAESServiceDecryptStream(t *testing.T) {
 		t.Fatal("decrypted data does not match")
 	}
 }
+
+func TestAESEnvelopeEncryption(t *testing.T) {
+	ks := keystore.NewInMemoryKeyStore()
+	aes := NewAESService(ks)
+	key := "12345678901234567890123456789012"
+	keyID := testContext.KeyID()
+
+	enc, err := aes.EncryptStream(context.Background(), bytes.NewBufferString("some-data"), testContext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := ks.RetrieveKey(keyID)
+	if err != nil {
+		t.Fatal("expected wrapped data key to be stored", err)
+	}
+	if bytes.Contains(wrapped, []byte(key)) {
+		t.Fatal("wrapped data key must not contain the caller key")
+	}
+
+	// The blob is sealed with the data key, not the caller's key.
+	if _, err := NewAESService(nil).DecryptStream(context.Background(), bytes.NewReader(ciphertext), testContext, key); err == nil {
+		t.Fatal("expected blob not to decrypt with the caller key directly")
+	}
+
+	dec, err := aes.DecryptStream(context.Background(), bytes.NewReader(ciphertext), testContext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "some-data" {
+		t.Fatal("decrypted data does not match")
+	}
+
+	if _, err := aes.DecryptStream(context.Background(), bytes.NewReader(ciphertext), testContext, "abcdefghijklmnopqrstuvwxyz123456"); err == nil {
+		t.Fatal("expected wrong key to fail to unwrap the data key")
+	}
+}
+
+func TestAESEnvelopeReusesDataKey(t *testing.T) {
+	ks := keystore.NewInMemoryKeyStore()
+	aes := NewAESService(ks)
+	key := "12345678901234567890123456789012"
+
+	if _, err := aes.EncryptStream(context.Background(), bytes.NewBufferString("original"), testContext, key); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := ks.RetrieveKey(testContext.KeyID())
+
+	if _, err := aes.EncryptStream(context.Background(), bytes.NewBufferString("preview"), previewContext, key); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := ks.RetrieveKey(testContext.KeyID())
+
+	if !bytes.Equal(first, second) {
+		t.Fatal("expected variants of one attachment to share a data key")
+	}
+}
+
+func TestAESEnvelopeLegacyBlob(t *testing.T) {
+	key := "12345678901234567890123456789012"
+	enc, err := NewAESService(nil).EncryptStream(context.Background(), bytes.NewBufferString("legacy"), testContext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No data key exists for blobs written before envelope encryption.
+	dec, err := NewAESService(keystore.NewInMemoryKeyStore()).DecryptStream(context.Background(), enc, testContext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "legacy" {
+		t.Fatal("decrypted data does not match")
+	}
+}
+
+func TestAESRotateKey(t *testing.T) {
+	ks := keystore.NewInMemoryKeyStore()
+	aes := NewAESService(ks)
+	oldKey := "12345678901234567890123456789012"
+	newKey := "abcdefghijklmnopqrstuvwxyz123456"
+
+	enc, err := aes.EncryptStream(context.Background(), bytes.NewBufferString("some-data"), testContext, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := aes.RotateKey(context.Background(), testContext.KeyID(), oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+	// Rotating again is a no-op so interrupted rotations can be retried.
+	if err := aes.RotateKey(context.Background(), testContext.KeyID(), oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := aes.DecryptStream(context.Background(), bytes.NewReader(ciphertext), testContext, oldKey); err == nil {
+		t.Fatal("expected old key to be rejected after rotation")
+	}
+	dec, err := aes.DecryptStream(context.Background(), bytes.NewReader(ciphertext), testContext, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "some-data" {
+		t.Fatal("decrypted data does not match")
+	}
+
+	err = aes.RotateKey(context.Background(), "missing", oldKey, newKey)
+	if uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected NOTFOUND for a blob without a data key, got %v", err)
+	}
+}
+
+func TestAESBindsEncryptionContext(t *testing.T) {
+	key := "12345678901234567890123456789012"
+
+	for _, service := range []*AES{NewAESService(nil), NewAESService(keystore.NewInMemoryKeyStore())} {
+		enc, err := service.EncryptStream(context.Background(), bytes.NewBufferString("some-data"), testContext, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := io.ReadAll(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		otherOwner := testContext
+		otherOwner.OwnerID++
+		for _, ec := range []uploader.EncryptionContext{previewContext, otherOwner, {}} {
+			if _, err := service.DecryptStream(context.Background(), bytes.NewReader(ciphertext), ec, key); err == nil {
+				t.Fatalf("expected blob bound to %+v not to decrypt as %+v", testContext, ec)
+			}
+		}
+
+		dec, err := service.DecryptStream(context.Background(), bytes.NewReader(ciphertext), testContext, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "some-data" {
+			t.Fatal("decrypted data does not match")
+		}
+	}
+}
+
+func TestAESRejectsUnboundBlob(t *testing.T) {
+	key := "12345678901234567890123456789012"
+	aead, err := newGCM([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Version 2 blobs were written before encryption contexts were bound, so
+	// they would decrypt under any context.
+	h := &header{version: 2, algorithm: ALGORITHM_AES_GCM, prefix: make([]byte, noncePrefixSize)}
+	ciphertext, err := io.ReadAll(newEncryptReader(context.Background(), bytes.NewBufferString("unbound"), aead, h, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewAESService(nil).DecryptStream(context.Background(), bytes.NewReader(ciphertext), previewContext, key); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("expected an unbound blob to be refused under a context, got %v", err)
+	}
+
+	dec, err := NewAESService(nil).DecryptStream(context.Background(), bytes.NewReader(ciphertext), uploader.EncryptionContext{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "unbound" {
+		t.Fatal("decrypted data does not match")
+	}
+}
+
+func TestAESDestroyKey(t *testing.T) {
+	ks := keystore.NewInMemoryKeyStore()
+	aes := NewAESService(ks)
+	key := "12345678901234567890123456789012"
+	recipientKey := "abcdefghijklmnopqrstuvwxyz123456"
+
+	enc, err := aes.EncryptStream(context.Background(), bytes.NewBufferString("some-data"), testContext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aes.ShareKey(context.Background(), testContext.KeyID(), key, "bob", recipientKey, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := aes.DestroyKey(context.Background(), testContext.KeyID(), []string{"bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ks.RetrieveKey(testContext.KeyID()); uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected the data key to be gone, got %v", err)
+	}
+	if _, err := aes.DecryptStream(context.Background(), bytes.NewReader(ciphertext), testContext, key); err == nil {
+		t.Fatal("expected the blob to be unreadable once its key is destroyed")
+	}
+	ctx := uploader.WithRecipient(context.Background(), "bob")
+	if _, err := aes.DecryptStream(ctx, bytes.NewReader(ciphertext), testContext, recipientKey); err == nil {
+		t.Fatal("expected the recipient copy to be destroyed too")
+	}
+}
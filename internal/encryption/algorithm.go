@@ -0,0 +1,92 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Algorithm identifiers written into the blob header. They are part of the
+// stored format and must never be reused.
+const (
+	ALGORITHM_AES_GCM           byte = 1
+	ALGORITHM_CHACHA20_POLY1305 byte = 2
+)
+
+// Algorithm is an AEAD construction that can seal blob segments. Every
+// algorithm must use 12 byte nonces so the segment nonce layout is shared.
+type Algorithm interface {
+	ID() byte
+	Name() string
+	NewAEAD(key []byte) (cipher.AEAD, error)
+}
+
+var algorithms = make(map[byte]Algorithm)
+
+// RegisterAlgorithm makes an algorithm available for encryption by name and for
+// decryption by the ID recorded in blob headers.
+func RegisterAlgorithm(algorithm Algorithm) {
+	algorithms[algorithm.ID()] = algorithm
+}
+
+// LookupAlgorithm returns the registered algorithm with the given ID.
+func LookupAlgorithm(id byte) (Algorithm, error) {
+	algorithm, ok := algorithms[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption algorithm %d", id)
+	}
+	return algorithm, nil
+}
+
+// AlgorithmByName returns the registered algorithm with the given name.
+func AlgorithmByName(name string) (Algorithm, error) {
+	for _, algorithm := range algorithms {
+		if algorithm.Name() == name {
+			return algorithm, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown encryption algorithm %q", name)
+}
+
+type AESGCM struct{}
+
+func (AESGCM) ID() byte {
+	return ALGORITHM_AES_GCM
+}
+
+func (AESGCM) Name() string {
+	return "aes-gcm"
+}
+
+func (AESGCM) NewAEAD(key []byte) (cipher.AEAD, error) {
+	return newGCM(key)
+}
+
+type ChaCha20Poly1305 struct{}
+
+func (ChaCha20Poly1305) ID() byte {
+	return ALGORITHM_CHACHA20_POLY1305
+}
+
+func (ChaCha20Poly1305) Name() string {
+	return "chacha20-poly1305"
+}
+
+func (ChaCha20Poly1305) NewAEAD(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func init() {
+	RegisterAlgorithm(AESGCM{})
+	RegisterAlgorithm(ChaCha20Poly1305{})
+}
@@ -0,0 +1,66 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/bencleary/uploader"
+)
+
+func TestLookupAlgorithm(t *testing.T) {
+	for _, id := range []byte{ALGORITHM_AES_GCM, ALGORITHM_CHACHA20_POLY1305} {
+		algorithm, err := LookupAlgorithm(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if algorithm.ID() != id {
+			t.Fatalf("expected algorithm %d, got %d", id, algorithm.ID())
+		}
+	}
+
+	if _, err := LookupAlgorithm(0); err == nil {
+		t.Fatal("expected error for unknown algorithm")
+	}
+}
+
+func TestAlgorithmByName(t *testing.T) {
+	algorithm, err := AlgorithmByName("chacha20-poly1305")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithm.ID() != ALGORITHM_CHACHA20_POLY1305 {
+		t.Fatal("expected chacha20-poly1305")
+	}
+
+	if _, err := AlgorithmByName("rot13"); err == nil {
+		t.Fatal("expected error for unknown algorithm")
+	}
+}
+
+func TestChaCha20Poly1305RoundTrip(t *testing.T) {
+	service := NewEncryptionService(nil, ChaCha20Poly1305{})
+	plaintext := bytes.Repeat([]byte("chacha"), CHUNK_SIZE)
+
+	enc, err := service.EncryptStream(context.Background(), bytes.NewReader(plaintext), uploader.EncryptionContext{}, streamTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ciphertext[5] != ALGORITHM_CHACHA20_POLY1305 {
+		t.Fatal("expected algorithm to be recorded in the header")
+	}
+
+	// The algorithm is taken from the header, not from the service.
+	decrypted, err := decryptAll(NewAESService(nil), ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("decrypted data does not match")
+	}
+}
@@ -0,0 +1,53 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bencleary/uploader"
+)
+
+// CheckKey verifies key before any blob is read. The wrapped data key acts as
+// the verification value: it is sealed with the caller's key, so unwrapping it
+// fails for any other key. For a recipient (see uploader.WithRecipient) their
+// own copy is checked. Blobs without a data key predate envelope encryption and
+// can only be checked by decrypting them, which fails with the same error.
+//
+// The unwrapped data key is kept in ctx's uploader.KeyCache, so decrypting
+// with the same context afterwards does not unwrap it, or stretch a
+// passphrase, again.
+func (a *AES) CheckKey(ctx context.Context, ec uploader.EncryptionContext, key string) error {
+	_, _, err := a.keySource(ctx, ec, key)
+	if errors.Is(err, ErrAuthentication) {
+		return wrongKey(ec)
+	}
+	return err
+}
+
+// wrongKey is the error for a key that does not open the blob described by ec.
+// It is an UNAUTHORIZED uploader error that also matches ErrAuthentication.
+func wrongKey(ec uploader.EncryptionContext) error {
+	return fmt.Errorf("%w: %w", uploader.Errorf(uploader.UNAUTHORIZED, "encryption key does not match %s", ec.KeyID()), ErrAuthentication)
+}
+
+// corrupt is the error for a blob that fails authentication under a key known
+// to be right, so it was damaged or tampered with. It is an INTERNAL uploader
+// error that also matches ErrCorrupt.
+func corrupt(ec uploader.EncryptionContext) error {
+	return fmt.Errorf("%w: %w", uploader.Errorf(uploader.INTERNAL, "stored blob for %s is corrupt", ec.KeyID()), ErrCorrupt)
+}
+
+// openError maps a failure to open the blob described by ec. When key was not
+// checked by unwrapping a data key, the first segment authenticated is the key
+// check, and failing it is reported as a wrong key. Any other failed segment,
+// or any segment under a checked key, means the blob is corrupt.
+func openError(ec uploader.EncryptionContext, err error, checked bool) error {
+	switch {
+	case errors.Is(err, ErrAuthentication) && !checked:
+		return wrongKey(ec)
+	case errors.Is(err, ErrAuthentication), errors.Is(err, ErrCorrupt):
+		return corrupt(ec)
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/keystore"
+)
+
+func TestAESCheckKey(t *testing.T) {
+	aes := NewAESService(keystore.NewInMemoryKeyStore())
+	ownerKey := "12345678901234567890123456789012"
+	recipientKey := "abcdefghijklmnopqrstuvwxyz123456"
+	ctx := context.Background()
+
+	// Nothing to check against before the blob has a data key.
+	if err := aes.CheckKey(ctx, testContext, recipientKey); err != nil {
+		t.Fatalf("expected a blob without a data key to pass unchecked, got %v", err)
+	}
+
+	enc, err := aes.EncryptStream(ctx, bytes.NewBufferString("checked"), testContext, ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(enc); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := aes.CheckKey(ctx, testContext, ownerKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := aes.CheckKey(ctx, testContext, recipientKey); uploader.ErrorCode(err) != uploader.UNAUTHORIZED {
+		t.Fatalf("expected UNAUTHORIZED for a wrong key, got %v", err)
+	}
+
+	if err := aes.ShareKey(ctx, testContext.KeyID(), ownerKey, "bob", recipientKey, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := aes.CheckKey(uploader.WithRecipient(ctx, "bob"), testContext, recipientKey); err != nil {
+		t.Fatalf("expected the recipient's key to pass, got %v", err)
+	}
+	if err := aes.CheckKey(uploader.WithRecipient(ctx, "carol"), testContext, ownerKey); err != nil {
+		t.Fatalf("expected the owner's key to pass for a recipient the blob was not shared with, got %v", err)
+	}
+}
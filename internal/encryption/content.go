@@ -0,0 +1,100 @@
+package encryption
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/bencleary/uploader"
+)
+
+// CONTENT_SECRET_ID is the keystore entry holding the secret that content IDs
+// and content data keys are derived from. It is generated on first use.
+const CONTENT_SECRET_ID = "content-secret"
+
+// ContentKey derives a content ID and data key from digest, the owner and key
+// with a secret kept in the keystore, and stores the data key for the attachment
+// wrapped with key. The data key is convergent within one owner's key: only a
+// holder of that key and the plaintext can derive it, so the keystore and the
+// plaintext digests recorded in the database are not enough to read a blob. The
+// content ID is keyed as well, so blob names do not reveal which well-known
+// files are stored.
+func (a *AES) ContentKey(ctx context.Context, ec uploader.EncryptionContext, digest []byte, key string) (string, error) {
+	keyID := ec.KeyID()
+	if a.keystore == nil || keyID == "" {
+		return "", uploader.Errorf(uploader.NOTIMPLEMENTED, "content keys need a keystore")
+	}
+
+	secret, err := a.loadContentSecret()
+	if err != nil {
+		return "", err
+	}
+	identity, err := keyIdentity(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	scope := deriveContent(identity, "scope", []byte(strconv.Itoa(ec.OwnerID)+"\x00"), secret)
+	contentID := deriveContent(scope, "content-id", digest)
+	dataKey := deriveContent(scope, "data-key", digest)
+
+	existing, err := a.dataKey(ctx, keyID, key)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		if !hmac.Equal(existing, dataKey) {
+			return "", uploader.Errorf(uploader.CONFLICT, "%s already has a data key", keyID)
+		}
+		return hex.EncodeToString(contentID), nil
+	}
+
+	wrapped, err := a.seal(dataKey, key)
+	if err != nil {
+		return "", err
+	}
+	if err := a.keystore.StoreKeyWithExpiry(keyID, wrapped, ec.ExpiresAt); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(contentID), nil
+}
+
+// loadContentSecret returns the content secret, generating and storing it the
+// first time it is needed.
+func (a *AES) loadContentSecret() ([]byte, error) {
+	a.contentMu.Lock()
+	defer a.contentMu.Unlock()
+
+	if a.contentSecret != nil {
+		return a.contentSecret, nil
+	}
+
+	secret, err := a.keystore.RetrieveKey(CONTENT_SECRET_ID)
+	if uploader.ErrorCode(err) == uploader.NOTFOUND {
+		secret = make([]byte, DATA_KEY_SIZE)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		if err := a.keystore.StoreKey(CONTENT_SECRET_ID, secret); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	a.contentSecret = secret
+	return secret, nil
+}
+
+// deriveContent computes the HMAC-SHA256 of data under secret for purpose.
+func deriveContent(secret []byte, purpose string, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
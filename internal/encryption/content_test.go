@@ -0,0 +1,92 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/google/uuid"
+)
+
+func TestAESContentKey(t *testing.T) {
+	ctx := context.Background()
+	ks := keystore.NewInMemoryKeyStore()
+	aes := NewAESService(ks)
+	aliceKey := "12345678901234567890123456789012"
+	bobKey := "abcdefghijklmnopqrstuvwxyz123456"
+	digest := []byte("digest of the meme")
+
+	alice := uploader.EncryptionContext{AttachmentUID: uuid.New(), Variant: uploader.VARIANT_ORIGINAL, OwnerID: 1}
+	again := uploader.EncryptionContext{AttachmentUID: uuid.New(), Variant: uploader.VARIANT_ORIGINAL, OwnerID: 1}
+
+	aliceID, err := aes.ContentKey(ctx, alice, digest, aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	againID, err := aes.ContentKey(ctx, again, digest, aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliceID != againID {
+		t.Fatalf("expected one content ID, got %q and %q", aliceID, againID)
+	}
+	if otherID, err := aes.ContentKey(ctx, uploader.EncryptionContext{AttachmentUID: uuid.New(), OwnerID: 1}, []byte("other"), aliceKey); err != nil || otherID == aliceID {
+		t.Fatalf("expected a different content ID for different content, got %q (%v)", otherID, err)
+	}
+
+	// The content key needs the owner's key, so the same content stored by
+	// another owner or under another key is not shared.
+	for _, other := range []struct {
+		ownerID int
+		key     string
+	}{{2, bobKey}, {2, aliceKey}, {1, bobKey}} {
+		otherID, err := aes.ContentKey(ctx, uploader.EncryptionContext{AttachmentUID: uuid.New(), OwnerID: other.ownerID}, digest, other.key)
+		if err != nil || otherID == aliceID {
+			t.Fatalf("expected owner %d with %q to get its own content ID, got %q (%v)", other.ownerID, other.key, otherID, err)
+		}
+	}
+
+	// A blob sealed for one attachment decrypts for the other with its own
+	// data key entry.
+	alice.ContentID, again.ContentID = aliceID, againID
+	enc, err := aes.EncryptStream(ctx, bytes.NewBufferString("meme"), alice, aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := aes.DecryptStream(ctx, bytes.NewReader(ciphertext), again, aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := io.ReadAll(dec); err != nil || string(plaintext) != "meme" {
+		t.Fatalf("expected the shared blob to decrypt, got %q (%v)", plaintext, err)
+	}
+	if _, err := aes.DecryptStream(ctx, bytes.NewReader(ciphertext), again, bobKey); !errors.Is(err, ErrAuthentication) {
+		t.Fatalf("expected another key to fail, got %v", err)
+	}
+
+	// The secret survives the service, so content IDs are stable across restarts.
+	if restartedID, err := NewAESService(ks).ContentKey(ctx, uploader.EncryptionContext{AttachmentUID: uuid.New(), OwnerID: 1}, digest, aliceKey); err != nil || restartedID != aliceID {
+		t.Fatalf("expected the same content ID after a restart, got %q (%v)", restartedID, err)
+	}
+
+	// An attachment that already has a random data key cannot switch.
+	random := uploader.EncryptionContext{AttachmentUID: uuid.New(), Variant: uploader.VARIANT_ORIGINAL}
+	if _, err := aes.EncryptStream(ctx, bytes.NewBufferString("x"), random, aliceKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aes.ContentKey(ctx, random, digest, aliceKey); uploader.ErrorCode(err) != uploader.CONFLICT {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+
+	if _, err := NewAESService(nil).ContentKey(ctx, alice, digest, aliceKey); uploader.ErrorCode(err) != uploader.NOTIMPLEMENTED {
+		t.Fatalf("expected content keys to need a keystore, got %v", err)
+	}
+}
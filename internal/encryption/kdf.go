@@ -0,0 +1,247 @@
+package encryption
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/bencleary/uploader"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Key derivation identifiers written into the blob header.
+const (
+	KDF_NONE     byte = 0
+	KDF_ARGON2ID byte = 1
+	KDF_SCRYPT   byte = 2
+)
+
+const (
+	// PASSPHRASE_PREFIX marks a key header value as a passphrase rather than raw
+	// key material, e.g. "pass:correct horse battery staple".
+	PASSPHRASE_PREFIX = "pass:"
+
+	// MIN_PASSPHRASE_LENGTH is the shortest passphrase the strength policy accepts.
+	MIN_PASSPHRASE_LENGTH = 12
+
+	// MIN_PASSPHRASE_BITS is the lowest estimated entropy the policy accepts.
+	MIN_PASSPHRASE_BITS = 60
+
+	saltSize       = 16
+	derivedKeySize = 32
+
+	// Upper bounds for parameters read from headers, so a tampered blob cannot
+	// make the server burn unbounded memory or CPU before authentication fails.
+	// Memory is held to the 64 MiB of DefaultArgon2id, the most the server
+	// writes.
+	maxArgon2Time    = 16
+	maxArgon2Memory  = 64 * 1024
+	maxScryptLogN    = 20
+	maxScryptRTimesP = 1 << 10
+	maxScryptMemory  = 64 << 20
+)
+
+// KDFParams describes how a passphrase is stretched into a 256-bit key. The
+// parameters and the per-file salt are stored in the blob header so the cost can
+// be tuned without breaking existing blobs.
+type KDFParams struct {
+	Algorithm byte
+
+	// Argon2id cost: passes over memory, memory in KiB and lanes.
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+
+	// scrypt cost: CPU/memory cost as log2(N), block size and parallelism.
+	LogN uint8
+	R    uint32
+	P    uint32
+
+	Salt []byte
+}
+
+// DefaultArgon2id follows the RFC 9106 recommendation for memory constrained
+// environments.
+var DefaultArgon2id = KDFParams{Algorithm: KDF_ARGON2ID, Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// DefaultScrypt uses the commonly recommended interactive cost.
+var DefaultScrypt = KDFParams{Algorithm: KDF_SCRYPT, LogN: 15, R: 8, P: 1}
+
+var ErrWeakPassphrase = errors.New("passphrase is too weak")
+
+// IsPassphrase reports whether key should be stretched with a KDF. A key of
+// exactly 32 characters is always raw key material, as keys were before
+// passphrases, so existing keys that happen to start with the prefix keep
+// decrypting their files.
+func IsPassphrase(key string) bool {
+	return strings.HasPrefix(key, PASSPHRASE_PREFIX) && len(key) != 32
+}
+
+// withSalt returns a copy of the parameters with a fresh random salt.
+func (k KDFParams) withSalt(salt []byte) *KDFParams {
+	k.Salt = salt
+	return &k
+}
+
+// derive stretches the passphrase in key into key material.
+func (k *KDFParams) derive(key string) ([]byte, error) {
+	passphrase := []byte(strings.TrimPrefix(key, PASSPHRASE_PREFIX))
+
+	switch k.Algorithm {
+	case KDF_ARGON2ID:
+		return argon2.IDKey(passphrase, k.Salt, k.Time, k.Memory, k.Threads, derivedKeySize), nil
+	case KDF_SCRYPT:
+		return scrypt.Key(passphrase, k.Salt, 1<<k.LogN, int(k.R), int(k.P), derivedKeySize)
+	default:
+		return nil, fmt.Errorf("unknown key derivation function %d", k.Algorithm)
+	}
+}
+
+// deriveCached is derive, reusing the key derived from the same passphrase and
+// parameters earlier in the request when ctx carries an uploader.KeyCache.
+func (k *KDFParams) deriveCached(ctx context.Context, key string) ([]byte, error) {
+	id := sha256.New()
+	id.Write([]byte("kdf\x00"))
+	id.Write(k.marshal(nil))
+	id.Write([]byte(key))
+	return uploader.KeyCacheFromContext(ctx).Key(hex.EncodeToString(id.Sum(nil)), func() ([]byte, error) {
+		return k.derive(key)
+	})
+}
+
+// validate checks the cost parameters against the bounds accepted from
+// headers.
+func (k *KDFParams) validate() error {
+	switch k.Algorithm {
+	case KDF_ARGON2ID:
+		if k.Time == 0 || k.Time > maxArgon2Time || k.Memory == 0 || k.Memory > maxArgon2Memory || k.Threads == 0 {
+			return fmt.Errorf("argon2id cost must be at most %d passes over %d KiB with at least one thread", maxArgon2Time, maxArgon2Memory)
+		}
+	case KDF_SCRYPT:
+		// scrypt needs 128*r*N bytes.
+		if k.LogN == 0 || k.LogN > maxScryptLogN || k.R == 0 || k.P == 0 || uint64(k.R)*uint64(k.P) > maxScryptRTimesP || 128*uint64(k.R)<<k.LogN > maxScryptMemory {
+			return fmt.Errorf("scrypt cost must be at most log2(N) %d, r*p %d and %d MiB", maxScryptLogN, maxScryptRTimesP, maxScryptMemory>>20)
+		}
+	default:
+		return fmt.Errorf("unknown key derivation function %d", k.Algorithm)
+	}
+	return nil
+}
+
+// marshal appends the KDF section of a header to dst.
+func (k *KDFParams) marshal(dst []byte) []byte {
+	dst = append(dst, k.Algorithm)
+	switch k.Algorithm {
+	case KDF_ARGON2ID:
+		dst = binary.BigEndian.AppendUint32(dst, k.Time)
+		dst = binary.BigEndian.AppendUint32(dst, k.Memory)
+		dst = append(dst, k.Threads)
+	case KDF_SCRYPT:
+		dst = append(dst, k.LogN)
+		dst = binary.BigEndian.AppendUint32(dst, k.R)
+		dst = binary.BigEndian.AppendUint32(dst, k.P)
+	}
+	return append(dst, k.Salt...)
+}
+
+// readKDF consumes a KDF section from src and returns it with its raw bytes. A
+// nil KDFParams means the key is used as is.
+func readKDF(src io.Reader) (*KDFParams, []byte, error) {
+	raw := make([]byte, 1)
+	if _, err := io.ReadFull(src, raw); err != nil {
+		return nil, nil, ErrBadHeader
+	}
+
+	var size int
+	switch raw[0] {
+	case KDF_NONE:
+		return nil, raw, nil
+	case KDF_ARGON2ID:
+		size = 4 + 4 + 1 + saltSize
+	case KDF_SCRYPT:
+		size = 1 + 4 + 4 + saltSize
+	default:
+		return nil, nil, fmt.Errorf("unknown key derivation function %d", raw[0])
+	}
+
+	raw = append(raw, make([]byte, size)...)
+	if _, err := io.ReadFull(src, raw[1:]); err != nil {
+		return nil, nil, ErrBadHeader
+	}
+
+	params := raw[1:]
+	k := &KDFParams{Algorithm: raw[0]}
+	switch k.Algorithm {
+	case KDF_ARGON2ID:
+		k.Time = binary.BigEndian.Uint32(params[0:4])
+		k.Memory = binary.BigEndian.Uint32(params[4:8])
+		k.Threads = params[8]
+		k.Salt = params[9:]
+	case KDF_SCRYPT:
+		k.LogN = params[0]
+		k.R = binary.BigEndian.Uint32(params[1:5])
+		k.P = binary.BigEndian.Uint32(params[5:9])
+		k.Salt = params[9:]
+	}
+	if err := k.validate(); err != nil {
+		return nil, nil, ErrBadHeader
+	}
+	return k, raw, nil
+}
+
+// CheckPassphrase enforces the passphrase strength policy: a minimum length, a
+// reasonable variety of characters and a minimum estimated entropy based on the
+// character classes in use.
+func CheckPassphrase(passphrase string) error {
+	passphrase = strings.TrimPrefix(passphrase, PASSPHRASE_PREFIX)
+	runes := []rune(passphrase)
+
+	if len(runes) < MIN_PASSPHRASE_LENGTH {
+		return fmt.Errorf("%w: use at least %d characters", ErrWeakPassphrase, MIN_PASSPHRASE_LENGTH)
+	}
+
+	unique := make(map[rune]struct{})
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		unique[r] = struct{}{}
+		switch {
+		case r > unicode.MaxASCII:
+			other = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	if len(unique) < len(runes)/3 || len(unique) < 5 {
+		return fmt.Errorf("%w: too many repeated characters", ErrWeakPassphrase)
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+
+	if bits := float64(len(runes)) * math.Log2(float64(pool)); bits < MIN_PASSPHRASE_BITS {
+		return fmt.Errorf("%w: use a longer passphrase or more kinds of characters", ErrWeakPassphrase)
+	}
+	return nil
+}
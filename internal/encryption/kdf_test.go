@@ -0,0 +1,167 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/keystore"
+)
+
+const testPassphrase = "pass:correct horse battery staple"
+
+// cheapArgon2id keeps tests fast; production defaults are far more expensive.
+var cheapArgon2id = KDFParams{Algorithm: KDF_ARGON2ID, Time: 1, Memory: 64, Threads: 1}
+
+func newPassphraseService(t *testing.T, kdf KDFParams) *AES {
+	t.Helper()
+	service := NewAESService(nil)
+	if err := service.SetKDF(kdf); err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func encryptPassphrase(t *testing.T, service *AES, plaintext []byte, ec uploader.EncryptionContext, key string) []byte {
+	t.Helper()
+	enc, err := service.EncryptStream(context.Background(), bytes.NewReader(plaintext), ec, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func decryptPassphrase(service *AES, ciphertext []byte, ec uploader.EncryptionContext, key string) ([]byte, error) {
+	dec, err := service.DecryptStream(context.Background(), bytes.NewReader(ciphertext), ec, key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(dec)
+}
+
+func TestPassphraseRoundTrip(t *testing.T) {
+	for _, kdf := range []KDFParams{cheapArgon2id, {Algorithm: KDF_SCRYPT, LogN: 10, R: 8, P: 1}} {
+		service := newPassphraseService(t, kdf)
+		ciphertext := encryptPassphrase(t, service, []byte("some-data"), uploader.EncryptionContext{}, testPassphrase)
+
+		h, _, err := readHeader(bytes.NewReader(ciphertext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.kdf == nil || h.kdf.Algorithm != kdf.Algorithm || len(h.kdf.Salt) != saltSize {
+			t.Fatalf("expected KDF %d with salt in header, got %+v", kdf.Algorithm, h.kdf)
+		}
+
+		// Cost parameters come from the header, so a service configured
+		// differently can still decrypt.
+		decrypted, err := decryptPassphrase(NewAESService(nil), ciphertext, uploader.EncryptionContext{}, testPassphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decrypted) != "some-data" {
+			t.Fatal("decrypted data does not match")
+		}
+
+		if _, err := decryptPassphrase(service, ciphertext, uploader.EncryptionContext{}, "pass:correct horse battery stapler"); err == nil {
+			t.Fatal("expected wrong passphrase to fail")
+		}
+	}
+}
+
+func TestPassphraseUsesPerFileSalt(t *testing.T) {
+	service := newPassphraseService(t, cheapArgon2id)
+	first := encryptPassphrase(t, service, []byte("same"), uploader.EncryptionContext{}, testPassphrase)
+	second := encryptPassphrase(t, service, []byte("same"), uploader.EncryptionContext{}, testPassphrase)
+
+	h1, _, err := readHeader(bytes.NewReader(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, _, err := readHeader(bytes.NewReader(second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(h1.kdf.Salt, h2.kdf.Salt) {
+		t.Fatal("expected a fresh salt per file")
+	}
+}
+
+func TestPassphraseWrapsDataKey(t *testing.T) {
+	ks := keystore.NewInMemoryKeyStore()
+	service := NewAESService(ks)
+	if err := service.SetKDF(cheapArgon2id); err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext := encryptPassphrase(t, service, []byte("some-data"), testContext, testPassphrase)
+
+	wrapped, err := ks.RetrieveKey(testContext.KeyID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _, err := readHeader(bytes.NewReader(wrapped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.kdf == nil {
+		t.Fatal("expected wrapped data key to record the KDF")
+	}
+
+	decrypted, err := decryptPassphrase(service, ciphertext, testContext, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decrypted) != "some-data" {
+		t.Fatal("decrypted data does not match")
+	}
+}
+
+func TestReadKDFRejectsExcessiveCost(t *testing.T) {
+	for _, tooExpensive := range []KDFParams{
+		{Algorithm: KDF_ARGON2ID, Time: 1, Memory: maxArgon2Memory + 1, Threads: 1},
+		{Algorithm: KDF_ARGON2ID, Time: 1, Memory: 1024 * 1024, Threads: 1},
+		{Algorithm: KDF_SCRYPT, LogN: 20, R: 8, P: 1},
+	} {
+		raw := tooExpensive.withSalt(make([]byte, saltSize)).marshal(nil)
+		if _, _, err := readKDF(bytes.NewReader(raw)); !errors.Is(err, ErrBadHeader) {
+			t.Fatalf("expected ErrBadHeader for %+v, got %v", tooExpensive, err)
+		}
+		if err := NewAESService(nil).SetKDF(tooExpensive); err == nil {
+			t.Fatalf("expected SetKDF to reject %+v", tooExpensive)
+		}
+	}
+
+	if err := NewAESService(nil).SetKDF(DefaultArgon2id); err != nil {
+		t.Fatalf("expected the default cost to be accepted, got %v", err)
+	}
+	if err := NewAESService(nil).SetKDF(DefaultScrypt); err != nil {
+		t.Fatalf("expected the default cost to be accepted, got %v", err)
+	}
+}
+
+func TestCheckPassphrase(t *testing.T) {
+	tests := []struct {
+		passphrase string
+		valid      bool
+	}{
+		{"pass:correct horse battery staple", true},
+		{"pass:Tr0ub4dor&3xyz", true},
+		{"pass:short", false},
+		{"pass:aaaaaaaaaaaaaaaaaaaa", false},
+		{"pass:123456789012", false},
+	}
+
+	for _, tt := range tests {
+		err := CheckPassphrase(tt.passphrase)
+		if (err == nil) != tt.valid {
+			t.Errorf("CheckPassphrase(%q) = %v, want valid %v", tt.passphrase, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package encryption
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	// HEX_KEY_PREFIX marks a key header value as 256-bit binary key material
+	// encoded as 64 hex characters, e.g. "hex:00ff...".
+	HEX_KEY_PREFIX = "hex:"
+
+	// BASE64_KEY_PREFIX marks a key header value as 256-bit binary key material
+	// encoded as base64url, with or without padding.
+	BASE64_KEY_PREFIX = "b64:"
+
+	// BINARY_KEY_SIZE is the size of a decoded hex or base64 key.
+	BINARY_KEY_SIZE = 32
+)
+
+// keyMaterial returns the bytes a non-passphrase key stands for. Keys with a
+// HEX_KEY_PREFIX or BASE64_KEY_PREFIX are decoded; any other key is used as is,
+// which is how keys were always interpreted, so blobs sealed with a 32
+// character key keep decrypting with it. That includes 32 character keys that
+// happen to start with a prefix, as no encoded key is that short.
+func keyMaterial(key string) ([]byte, error) {
+	var (
+		decoded []byte
+		err     error
+	)
+	switch {
+	case strings.HasPrefix(key, HEX_KEY_PREFIX):
+		decoded, err = hex.DecodeString(strings.TrimPrefix(key, HEX_KEY_PREFIX))
+	case strings.HasPrefix(key, BASE64_KEY_PREFIX):
+		decoded, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimPrefix(key, BASE64_KEY_PREFIX), "="))
+	default:
+		return []byte(key), nil
+	}
+
+	if err != nil || len(decoded) != BINARY_KEY_SIZE {
+		if len(key) == 32 {
+			return []byte(key), nil
+		}
+		return nil, ErrInvalidKey
+	}
+	return decoded, nil
+}
+
+// isEncodedKey reports whether key uses one of the binary key encodings.
+func isEncodedKey(key string) bool {
+	return strings.HasPrefix(key, HEX_KEY_PREFIX) || strings.HasPrefix(key, BASE64_KEY_PREFIX)
+}
+
+// KeyFingerprint returns a stable identifier for a key held by the client, for
+// keeping things per key, such as recovery codes, without storing the key. The
+// hex: and b64: encodings of the same bytes share a fingerprint.
+func KeyFingerprint(key string) (string, error) {
+	identity, err := keyIdentity(context.Background(), key)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(append([]byte("uploader-key-fingerprint\x00"), identity...))
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// keyIdentity returns material that only the holder of key can compute and that
+// is the same every time, unlike the salted keys blobs are sealed with.
+// Passphrases are stretched with DefaultArgon2id and a fixed salt, so the
+// material is no quicker to test guesses against than the blobs the passphrase
+// seals.
+func keyIdentity(ctx context.Context, key string) ([]byte, error) {
+	if IsPassphrase(key) {
+		return DefaultArgon2id.withSalt([]byte("uploader-key-fp\x00")).deriveCached(ctx, key)
+	}
+	return keyMaterial(key)
+}
@@ -0,0 +1,121 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/bencleary/uploader/internal/keystore"
+)
+
+func TestEncodedKeysShareKeyMaterial(t *testing.T) {
+	aes := NewAESService(keystore.NewInMemoryKeyStore())
+	hexKey := "hex:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	base64Key := "b64:AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8"
+
+	enc, err := aes.EncryptStream(context.Background(), bytes.NewBufferString("binary key"), testContext, hexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both encodings of the same 32 bytes unlock the blob.
+	for _, key := range []string{hexKey, base64Key} {
+		dec, err := aes.DecryptStream(context.Background(), bytes.NewReader(ciphertext), testContext, key)
+		if err != nil {
+			t.Fatalf("decrypting with %s: %v", key, err)
+		}
+		content, err := io.ReadAll(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "binary key" {
+			t.Fatal("decrypted data does not match")
+		}
+	}
+
+	// The encoded text itself is not the key.
+	if _, err := aes.DecryptStream(context.Background(), bytes.NewReader(ciphertext), testContext, "000102030405060708090a0b0c0d0e0f"); err == nil {
+		t.Fatal("expected a different key to fail")
+	}
+}
+
+func TestLegacyKeyMaterial(t *testing.T) {
+	key := "12345678901234567890123456789012"
+	material, err := keyMaterial(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(material) != key {
+		t.Fatal("expected a 32 character key to be used as is")
+	}
+
+	// Keys that were always valid keep working even if they look encoded.
+	for _, key := range []string{"hex:5678901234567890123456789012", "b64:5678901234567890123456789012"} {
+		if err := ValidateKey(key); err != nil {
+			t.Fatalf("expected %q to stay valid, got %v", key, err)
+		}
+		material, err := keyMaterial(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(material) != key {
+			t.Fatalf("expected %q to be used as is", key)
+		}
+	}
+}
+
+func TestLegacyKeyWithPassphrasePrefix(t *testing.T) {
+	aes := NewAESService(nil)
+	key := "pass:678901234567890123456789012"
+	if IsPassphrase(key) {
+		t.Fatal("expected a 32 character key to be raw key material")
+	}
+
+	// Sealed the way files were before passphrases.
+	ciphertext, err := aes.encrypt([]byte("legacy"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := aes.DecryptStream(context.Background(), bytes.NewReader(ciphertext), testContext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "legacy" {
+		t.Fatal("decrypted data does not match")
+	}
+
+	if !IsPassphrase("pass:correct horse battery staple") {
+		t.Fatal("expected a longer key to be a passphrase")
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	hexKey, err := KeyFingerprint("hex:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base64Key, err := KeyFingerprint("b64:AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hexKey != base64Key {
+		t.Fatal("expected both encodings of a key to share a fingerprint")
+	}
+
+	other, err := KeyFingerprint("12345678901234567890123456789012")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == hexKey || len(other) != 32 {
+		t.Fatalf("unexpected fingerprint %q", other)
+	}
+}
@@ -0,0 +1,22 @@
+package encryption
+
+import (
+	"bytes"
+	"io"
+)
+
+// decryptLegacy reads blobs written before the versioned header existed. Those
+// are always AES-GCM in the original whole-file format (nonce || ciphertext),
+// which has to be buffered to decrypt.
+func (a *AES) decryptLegacy(src io.Reader, key []byte) (io.ReadCloser, error) {
+	ciphertext, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := a.decrypt(ciphertext, string(key))
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return io.NopCloser(bytes.NewReader(plaintext)), nil
+}
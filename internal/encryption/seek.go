@@ -0,0 +1,210 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"io"
+
+	"github.com/bencleary/uploader"
+)
+
+// maxHeaderSize is the largest header any supported version can have.
+const maxHeaderSize = 4 + 1 + 1 + 1 + 4 + 4 + 1 + saltSize + noncePrefixSize
+
+// DecryptBlob returns a seekable reader over the plaintext of blob. Segments
+// are fixed size, so a plaintext offset maps directly to the segment holding it
+// and only the segments from there on are read. The final segment is
+// authenticated up front, which checks the key and that the blob is complete
+// before any plaintext is returned.
+func (a *AES) DecryptBlob(ctx context.Context, blob uploader.Blob, ec uploader.EncryptionContext, key string) (io.ReadSeekCloser, error) {
+	start, err := blob.ReadRange(ctx, 0, min(blob.Size(), maxHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	defer start.Close()
+
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(start, head); err != nil || !hasMagic(head) {
+		return nil, uploader.Errorf(uploader.NOTIMPLEMENTED, "blob predates the seekable format")
+	}
+
+	h, raw, err := readHeader(io.MultiReader(bytes.NewReader(head), start))
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm, err := LookupAlgorithm(h.algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	source, checked, err := a.keySource(ctx, ec, key)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := source(h)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := algorithm.NewAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := associatedData(h, raw, binding(ec))
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &seekReader{
+		ctx:         ctx,
+		blob:        blob,
+		aead:        aead,
+		prefix:      h.prefix,
+		ad:          ad,
+		dataOffset:  int64(len(raw)),
+		segmentSize: int64(CHUNK_SIZE + aead.Overhead()),
+	}
+	if err := reader.init(); err != nil {
+		return nil, openError(ec, err, checked)
+	}
+	return reader, nil
+}
+
+// seekReader exposes the plaintext of a segmented blob as an io.ReadSeeker. A
+// read after a seek opens the blob at the segment holding the new offset; reads
+// in sequence continue on the same underlying reader.
+type seekReader struct {
+	ctx         context.Context
+	blob        uploader.Blob
+	aead        cipher.AEAD
+	prefix      []byte
+	ad          []byte
+	dataOffset  int64
+	segmentSize int64
+	segments    int64
+	size        int64
+
+	offset int64
+	body   io.ReadCloser
+	reader *decryptReader
+	// readerOffset is the plaintext offset that reader will return next.
+	readerOffset int64
+	// verified is set once init has authenticated a segment with the key.
+	verified bool
+}
+
+// init works out the number of segments and the plaintext size from the size
+// of the blob and authenticates the final segment.
+func (r *seekReader) init() error {
+	overhead := int64(r.aead.Overhead())
+	body := r.blob.Size() - r.dataOffset
+	if body < overhead {
+		return ErrTruncated
+	}
+
+	r.segments = (body + r.segmentSize - 1) / r.segmentSize
+	if tail := body - (r.segments-1)*r.segmentSize; tail < overhead {
+		return ErrTruncated
+	}
+	r.size = body - r.segments*overhead
+
+	if err := r.open((r.segments - 1) * CHUNK_SIZE); err != nil {
+		return err
+	}
+	err := r.reader.prime()
+	if errors.Is(err, ErrAuthentication) && r.segments > 1 {
+		// If the first segment opens, the key is right and the final segment
+		// was damaged.
+		if r.open(0) == nil && r.reader.prime() == nil {
+			return ErrCorrupt
+		}
+	}
+	if err != nil {
+		return err
+	}
+	r.verified = true
+	return nil
+}
+
+// open positions the underlying reader at the start of the segment holding
+// offset, then skips to offset itself.
+func (r *seekReader) open(offset int64) error {
+	r.closeBody()
+
+	segment := offset / CHUNK_SIZE
+	if segment >= r.segments {
+		segment = r.segments - 1
+	}
+
+	body, err := r.blob.ReadRange(r.ctx, r.dataOffset+segment*r.segmentSize, -1)
+	if err != nil {
+		return err
+	}
+
+	r.body = body
+	r.reader = newDecryptReader(r.ctx, body, r.aead, r.prefix, r.ad)
+	r.reader.counter = uint64(segment)
+	r.reader.verified = r.verified
+	r.readerOffset = segment * CHUNK_SIZE
+
+	if skip := offset - r.readerOffset; skip > 0 {
+		if _, err := io.CopyN(io.Discard, r.reader, skip); err != nil {
+			return err
+		}
+		r.readerOffset = offset
+	}
+	return nil
+}
+
+func (r *seekReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.reader == nil || r.readerOffset != r.offset {
+		if err := r.open(r.offset); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.reader.Read(p)
+	r.offset += int64(n)
+	r.readerOffset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = ErrTruncated
+	}
+	return n, err
+}
+
+func (r *seekReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *seekReader) Close() error {
+	return r.closeBody()
+}
+
+func (r *seekReader) closeBody() error {
+	r.reader = nil
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
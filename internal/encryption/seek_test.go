@@ -0,0 +1,168 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/keystore"
+)
+
+// memoryBlob serves ranges of an in-memory blob and counts the bytes read.
+type memoryBlob struct {
+	data []byte
+	read int64
+}
+
+func (b *memoryBlob) Size() int64 {
+	return int64(len(b.data))
+}
+
+func (b *memoryBlob) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (b *memoryBlob) ReadRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if length < 0 {
+		length = int64(len(b.data)) - offset
+	}
+	return io.NopCloser(&countingReader{r: bytes.NewReader(b.data[offset : offset+length]), n: &b.read}), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+func sealForSeek(t *testing.T, service *AES, plaintext []byte) *memoryBlob {
+	t.Helper()
+	enc, err := service.EncryptStream(context.Background(), bytes.NewReader(plaintext), testContext, streamTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &memoryBlob{data: ciphertext}
+}
+
+func TestDecryptBlobRanges(t *testing.T) {
+	for _, size := range []int{0, 1, CHUNK_SIZE, 3*CHUNK_SIZE + 17} {
+		plaintext := make([]byte, size)
+		if _, err := rand.Read(plaintext); err != nil {
+			t.Fatal(err)
+		}
+
+		service := NewAESService(keystore.NewInMemoryKeyStore())
+		blob := sealForSeek(t, service, plaintext)
+
+		reader, err := service.DecryptBlob(context.Background(), blob, testContext, streamTestKey)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+
+		end, err := reader.Seek(0, io.SeekEnd)
+		if err != nil || end != int64(size) {
+			t.Fatalf("size %d: expected plaintext size, got %d (%v)", size, end, err)
+		}
+
+		ranges := [][2]int{{0, size}, {size / 2, size}, {size / 3, size/3 + 10}, {CHUNK_SIZE - 1, CHUNK_SIZE + 1}, {0, 1}}
+		for _, r := range ranges {
+			start, stop := min(r[0], size), min(r[1], size)
+			if _, err := reader.Seek(int64(start), io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, stop-start)
+			if _, err := io.ReadFull(reader, got); err != nil {
+				t.Fatalf("size %d range %v: %v", size, r, err)
+			}
+			if !bytes.Equal(got, plaintext[start:stop]) {
+				t.Fatalf("size %d range %v: decrypted data does not match", size, r)
+			}
+		}
+		reader.Close()
+	}
+}
+
+func TestDecryptBlobReadsOnlyNeededSegments(t *testing.T) {
+	service := NewAESService(nil)
+	blob := sealForSeek(t, service, make([]byte, 16*CHUNK_SIZE))
+
+	reader, err := service.DecryptBlob(context.Background(), blob, testContext, streamTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if _, err := reader.Seek(8*CHUNK_SIZE+5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(reader, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The header, the final segment checked on open and the segment holding the
+	// range, with room for read-ahead of one more.
+	if limit := int64(maxHeaderSize + 3*(CHUNK_SIZE+16)); blob.read > limit {
+		t.Fatalf("read %d bytes of ciphertext, expected at most %d", blob.read, limit)
+	}
+}
+
+func TestDecryptBlobFailsOnOpen(t *testing.T) {
+	service := NewAESService(nil)
+	blob := sealForSeek(t, service, make([]byte, 2*CHUNK_SIZE+1))
+
+	if _, err := service.DecryptBlob(context.Background(), blob, testContext, "abcdefghijklmnopqrstuvwxyz123456"); err == nil {
+		t.Fatal("expected wrong key to fail")
+	}
+	if _, err := service.DecryptBlob(context.Background(), blob, previewContext, streamTestKey); err == nil {
+		t.Fatal("expected blob for another variant to fail")
+	}
+
+	truncated := &memoryBlob{data: blob.data[:len(blob.data)-1]}
+	if _, err := service.DecryptBlob(context.Background(), truncated, testContext, streamTestKey); err == nil {
+		t.Fatal("expected truncated blob to fail")
+	}
+}
+
+func TestDecryptBlobReportsDamagedFinalSegment(t *testing.T) {
+	service := NewAESService(nil)
+	blob := sealForSeek(t, service, make([]byte, 2*CHUNK_SIZE+1))
+	blob.data[len(blob.data)-1] ^= 1
+
+	// The first segment still opens, so the key is right and the blob is
+	// damaged.
+	_, err := service.DecryptBlob(context.Background(), blob, testContext, streamTestKey)
+	if uploader.ErrorCode(err) != uploader.INTERNAL || !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected INTERNAL for a damaged blob, got %v", err)
+	}
+
+	_, err = service.DecryptBlob(context.Background(), blob, testContext, "abcdefghijklmnopqrstuvwxyz123456")
+	if uploader.ErrorCode(err) != uploader.UNAUTHORIZED {
+		t.Fatalf("expected UNAUTHORIZED for a wrong key, got %v", err)
+	}
+}
+
+func TestDecryptBlobLegacyNotSeekable(t *testing.T) {
+	ciphertext, err := NewAESService(nil).encrypt([]byte("legacy"), streamTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewAESService(nil).DecryptBlob(context.Background(), &memoryBlob{data: ciphertext}, testContext, streamTestKey)
+	if uploader.ErrorCode(err) != uploader.NOTIMPLEMENTED {
+		t.Fatalf("expected NOTIMPLEMENTED error, got %v", err)
+	}
+}
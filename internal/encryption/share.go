@@ -0,0 +1,81 @@
+package encryption
+
+import (
+	"context"
+	"time"
+
+	"github.com/bencleary/uploader"
+)
+
+// recipientKeyID returns the keystore ID under which the data key for keyID is
+// kept wrapped for recipientID.
+func recipientKeyID(keyID, recipientID string) string {
+	return keyID + "/recipients/" + recipientID
+}
+
+// ShareKey wraps the data key for keyID with recipientKey so that recipientID
+// can decrypt the blobs it seals, until expiresAt if it is set. key must be the
+// owner's key. Blobs written before envelope encryption have no data key to
+// share; rotating the owner's key gives them one.
+func (a *AES) ShareKey(ctx context.Context, keyID, key, recipientID, recipientKey string, expiresAt time.Time) error {
+	dataKey, err := a.ownerDataKey(ctx, keyID, key)
+	if err != nil {
+		return err
+	}
+
+	wrapped, err := a.seal(dataKey, recipientKey)
+	if err != nil {
+		return err
+	}
+	return a.keystore.StoreKeyWithExpiry(recipientKeyID(keyID, recipientID), wrapped, expiresAt)
+}
+
+// UnshareKey deletes recipientID's copy of the data key for keyID. The blobs
+// are not re-encrypted, so a recipient who kept the data key can still read
+// them.
+func (a *AES) UnshareKey(ctx context.Context, keyID, key, recipientID string) error {
+	if _, err := a.ownerDataKey(ctx, keyID, key); err != nil {
+		return err
+	}
+	return a.keystore.DeleteKey(recipientKeyID(keyID, recipientID))
+}
+
+// VerifyKey checks that key unwraps the owner's data key for keyID.
+func (a *AES) VerifyKey(ctx context.Context, keyID, key string) error {
+	_, err := a.ownerDataKey(ctx, keyID, key)
+	return err
+}
+
+// ownerDataKey unwraps the owner's data key for keyID, failing with NOTFOUND
+// when there is none.
+func (a *AES) ownerDataKey(ctx context.Context, keyID, key string) ([]byte, error) {
+	if a.keystore == nil {
+		return nil, uploader.Errorf(uploader.NOTFOUND, "no data key for %s", keyID)
+	}
+
+	dataKey, err := a.dataKey(ctx, keyID, key)
+	if err != nil {
+		return nil, err
+	}
+	if dataKey == nil {
+		return nil, uploader.Errorf(uploader.NOTFOUND, "no data key for %s, rotate the owner's key to enable sharing", keyID)
+	}
+	return dataKey, nil
+}
+
+// recipientDataKey unwraps recipientID's copy of the data key for keyID with
+// key. It returns nil when the blob was not shared with recipientID.
+func (a *AES) recipientDataKey(ctx context.Context, keyID, key, recipientID string) ([]byte, error) {
+	wrapped, err := a.keystore.RetrieveKey(recipientKeyID(keyID, recipientID))
+	if uploader.ErrorCode(err) == uploader.NOTFOUND {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := a.open(ctx, wrapped, key)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,79 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/keystore"
+)
+
+func TestAESShareKey(t *testing.T) {
+	ks := keystore.NewInMemoryKeyStore()
+	aes := NewAESService(ks)
+	ownerKey := "12345678901234567890123456789012"
+	recipientKey := "abcdefghijklmnopqrstuvwxyz123456"
+	keyID := testContext.KeyID()
+
+	enc, err := aes.EncryptStream(context.Background(), bytes.NewBufferString("shared"), testContext, ownerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := aes.ShareKey(context.Background(), keyID, recipientKey, "bob", recipientKey, time.Time{}); err != ErrAuthentication {
+		t.Fatalf("expected sharing without the owner's key to fail, got %v", err)
+	}
+	if err := aes.ShareKey(context.Background(), keyID, ownerKey, "bob", recipientKey, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := uploader.WithRecipient(context.Background(), "bob")
+	dec, err := aes.DecryptStream(ctx, bytes.NewReader(ciphertext), testContext, recipientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "shared" {
+		t.Fatal("decrypted data does not match")
+	}
+
+	// The owner keeps access, with or without a recipient in the context.
+	for _, ctx := range []context.Context{context.Background(), uploader.WithRecipient(context.Background(), "carol")} {
+		if _, err := aes.DecryptStream(ctx, bytes.NewReader(ciphertext), testContext, ownerKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := aes.DecryptStream(uploader.WithRecipient(context.Background(), "carol"), bytes.NewReader(ciphertext), testContext, recipientKey); err == nil {
+		t.Fatal("expected a recipient the blob was not shared with to be rejected")
+	}
+
+	if err := aes.UnshareKey(context.Background(), keyID, ownerKey, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := aes.DecryptStream(ctx, bytes.NewReader(ciphertext), testContext, recipientKey); err == nil {
+		t.Fatal("expected a revoked recipient to be rejected")
+	}
+}
+
+func TestAESShareKeyWithoutDataKey(t *testing.T) {
+	aes := NewAESService(keystore.NewInMemoryKeyStore())
+	key := "12345678901234567890123456789012"
+
+	err := aes.ShareKey(context.Background(), testContext.KeyID(), key, "bob", "abcdefghijklmnopqrstuvwxyz123456", time.Time{})
+	if uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected NOTFOUND for a blob without a data key, got %v", err)
+	}
+	if err := aes.VerifyKey(context.Background(), testContext.KeyID(), key); uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected NOTFOUND for a blob without a data key, got %v", err)
+	}
+}
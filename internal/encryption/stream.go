@@ -0,0 +1,369 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/bencleary/uploader"
+)
+
+// Stream format
+//
+// A stream starts with a header and is followed by a sequence of segments:
+//
+//	header = magic ("UPLD") || version (1 byte) || algorithm (1 byte) || kdf || nonce prefix (7 bytes)
+//	kdf    = id (1 byte) || parameters and salt (see KDFParams)
+//
+// Version 1 headers have no kdf section. Each segment seals at most CHUNK_SIZE
+// bytes of plaintext with its own nonce and the header as associated data, so the
+// header cannot be altered either. From version 3 the associated data is the
+// header followed by the binding of the blob's EncryptionContext (see binding), so
+// a blob moved to another attachment or variant fails authentication:
+//
+//	nonce = prefix (7 bytes) || counter (4 bytes, big endian) || last (1 byte)
+//
+// The counter makes reordered or duplicated segments fail authentication and the
+// last flag, which is only set on the final segment, makes truncation at a segment
+// boundary detectable. Empty plaintext still produces a single (empty) final segment.
+const (
+	// CHUNK_SIZE is the amount of plaintext sealed into each segment.
+	CHUNK_SIZE = 64 * 1024
+
+	// HEADER_VERSION is the version written into new blob headers.
+	HEADER_VERSION byte = 3
+
+	noncePrefixSize = 7
+
+	// headerSize is the size of a current header without KDF parameters.
+	headerSize = 4 + 1 + 1 + 1 + noncePrefixSize
+)
+
+var magic = []byte("UPLD")
+
+var (
+	ErrTruncated      = errors.New("ciphertext is truncated")
+	ErrTooManyChunks  = errors.New("stream exceeds the maximum number of segments")
+	ErrAuthentication = errors.New("ciphertext failed authentication")
+	ErrCorrupt        = errors.New("ciphertext is corrupt")
+	ErrBadHeader      = errors.New("ciphertext header is invalid")
+)
+
+// header describes how a blob was sealed. A nil kdf means the key was used as
+// is.
+type header struct {
+	version   byte
+	algorithm byte
+	kdf       *KDFParams
+	prefix    []byte
+}
+
+func (h *header) marshal() []byte {
+	raw := make([]byte, 0, headerSize)
+	raw = append(raw, magic...)
+	raw = append(raw, h.version, h.algorithm)
+	if h.version >= 2 {
+		if h.kdf == nil {
+			raw = append(raw, KDF_NONE)
+		} else {
+			raw = h.kdf.marshal(raw)
+		}
+	}
+	return append(raw, h.prefix...)
+}
+
+// hasMagic reports whether data starts with the blob header magic.
+func hasMagic(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// readHeader consumes a header from src, returning it with its raw bytes.
+func readHeader(src io.Reader) (*header, []byte, error) {
+	raw := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(src, raw); err != nil {
+		return nil, nil, ErrBadHeader
+	}
+	if !hasMagic(raw) {
+		return nil, nil, ErrBadHeader
+	}
+
+	h := &header{
+		version:   raw[4],
+		algorithm: raw[5],
+	}
+	switch h.version {
+	case 1:
+	case 2, 3:
+		kdf, kdfRaw, err := readKDF(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.kdf = kdf
+		raw = append(raw, kdfRaw...)
+	default:
+		return nil, nil, fmt.Errorf("unsupported ciphertext version %d", h.version)
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(src, prefix); err != nil {
+		return nil, nil, ErrBadHeader
+	}
+	h.prefix = prefix
+	return h, append(raw, prefix...), nil
+}
+
+// binding encodes the fields of ec as length-prefixed strings. The zero context
+// binds nothing, which is used for values that are not attachment blobs, such as
+// wrapped data keys. Content-addressed blobs are bound to their content ID
+// instead of an attachment and owner.
+func binding(ec uploader.EncryptionContext) []byte {
+	if ec == (uploader.EncryptionContext{}) {
+		return nil
+	}
+
+	fields := []string{ec.KeyID(), ec.Variant, strconv.Itoa(ec.OwnerID)}
+	if ec.ContentID != "" {
+		fields = []string{"content", ec.ContentID, ec.Variant}
+	}
+
+	var data []byte
+	for _, field := range fields {
+		data = binary.BigEndian.AppendUint16(data, uint16(len(field)))
+		data = append(data, field...)
+	}
+	return data
+}
+
+// associatedData returns the data authenticated with every segment of a blob
+// with the given header. Headers older than version 3 are not bound, so they
+// are refused when a binding is required rather than read under any context.
+func associatedData(h *header, raw, binding []byte) ([]byte, error) {
+	if h.version < 3 {
+		if len(binding) > 0 {
+			return nil, fmt.Errorf("%w: version %d blobs are not bound to an attachment", ErrAuthentication, h.version)
+		}
+		return raw, nil
+	}
+	return append(append([]byte(nil), raw...), binding...), nil
+}
+
+// segmentNonce builds the nonce for the segment at the given position.
+func segmentNonce(dst, prefix []byte, counter uint32, last bool) []byte {
+	dst = append(dst[:0], prefix...)
+	dst = binary.BigEndian.AppendUint32(dst, counter)
+	if last {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+// encryptReader seals its source one segment at a time so memory use is bounded
+// by CHUNK_SIZE regardless of the size of the input.
+type encryptReader struct {
+	ctx     context.Context
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	ad      []byte
+	nonce   []byte
+	counter uint64
+	plain   []byte
+	sealed  []byte
+	pending []byte
+	done    bool
+	err     error
+}
+
+// newEncryptReader emits the raw header followed by the sealed segments of src.
+func newEncryptReader(ctx context.Context, src io.Reader, aead cipher.AEAD, h *header, binding []byte) *encryptReader {
+	raw := h.marshal()
+	ad, err := associatedData(h, raw, binding)
+	if err != nil {
+		return &encryptReader{err: err}
+	}
+	return &encryptReader{
+		ctx:     ctx,
+		src:     bufio.NewReaderSize(src, CHUNK_SIZE),
+		aead:    aead,
+		prefix:  h.prefix,
+		ad:      ad,
+		plain:   make([]byte, CHUNK_SIZE),
+		sealed:  make([]byte, 0, CHUNK_SIZE+aead.Overhead()),
+		pending: raw,
+	}
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.next()
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *encryptReader) Close() error {
+	return nil
+}
+
+// next seals the following segment into pending.
+func (r *encryptReader) next() error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	if r.counter > 1<<32-1 {
+		return ErrTooManyChunks
+	}
+
+	n, err := io.ReadFull(r.src, r.plain)
+	last := false
+	switch err {
+	case nil:
+		if _, err := r.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+
+	r.nonce = segmentNonce(r.nonce, r.prefix, uint32(r.counter), last)
+	r.sealed = r.aead.Seal(r.sealed[:0], r.nonce, r.plain[:n], r.ad)
+	r.pending = r.sealed
+	r.counter++
+	r.done = last
+	return nil
+}
+
+// decryptReader opens its source one segment at a time, only releasing plaintext
+// once the segment holding it has been authenticated. A segment that fails
+// authentication after another one opened under the same key is reported as
+// ErrCorrupt rather than ErrAuthentication, since the key is known to be right.
+type decryptReader struct {
+	ctx      context.Context
+	src      *bufio.Reader
+	aead     cipher.AEAD
+	prefix   []byte
+	ad       []byte
+	nonce    []byte
+	counter  uint64
+	sealed   []byte
+	plain    []byte
+	pending  []byte
+	done     bool
+	verified bool
+	err      error
+}
+
+// newDecryptReader opens the segments that follow a header in src.
+func newDecryptReader(ctx context.Context, src io.Reader, aead cipher.AEAD, prefix, ad []byte) *decryptReader {
+	return &decryptReader{
+		ctx:    ctx,
+		src:    bufio.NewReaderSize(src, CHUNK_SIZE+aead.Overhead()),
+		aead:   aead,
+		prefix: prefix,
+		ad:     ad,
+		sealed: make([]byte, CHUNK_SIZE+aead.Overhead()),
+		plain:  make([]byte, 0, CHUNK_SIZE),
+	}
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.next()
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *decryptReader) Close() error {
+	return nil
+}
+
+// next authenticates the following segment and exposes its plaintext in pending.
+func (r *decryptReader) next() error {
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	if r.counter > 1<<32-1 {
+		return ErrTooManyChunks
+	}
+
+	n, err := io.ReadFull(r.src, r.sealed)
+	last := false
+	switch err {
+	case nil:
+		if _, err := r.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return ErrTruncated
+	default:
+		return err
+	}
+
+	if n < r.aead.Overhead() {
+		return ErrTruncated
+	}
+
+	r.nonce = segmentNonce(r.nonce, r.prefix, uint32(r.counter), last)
+	plain, err := r.aead.Open(r.plain[:0], r.nonce, r.sealed[:n], r.ad)
+	if err != nil {
+		if last {
+			// A segment sealed as "not last" that ends the stream means the
+			// ciphertext was cut short on a segment boundary.
+			r.nonce = segmentNonce(r.nonce, r.prefix, uint32(r.counter), false)
+			if _, retryErr := r.aead.Open(r.plain[:0], r.nonce, r.sealed[:n], r.ad); retryErr == nil {
+				return ErrTruncated
+			}
+		}
+		if r.verified {
+			return ErrCorrupt
+		}
+		return ErrAuthentication
+	}
+
+	r.pending = plain
+	r.counter++
+	r.done = last
+	r.verified = true
+	return nil
+}
+
+// prime decrypts the first segment so that a wrong key or a corrupt header is
+// reported when the stream is opened rather than on the first Read.
+func (r *decryptReader) prime() error {
+	if len(r.pending) > 0 || r.done {
+		return nil
+	}
+	r.err = r.next()
+	return r.err
+}
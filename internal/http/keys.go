@@ -0,0 +1,110 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/encryption"
+	middlewareValidator "github.com/bencleary/uploader/internal/middleware"
+	"github.com/labstack/echo/v4"
+)
+
+type createKeyResponse struct {
+	KeyID string `json:"key_id"`
+	// RecipientID is what other users share files with. Unlike the key ID it
+	// is not a credential and can be handed out.
+	RecipientID   string   `json:"recipient_id"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+type rotateKeyRequest struct {
+	NewKey string `json:"new_key"`
+}
+
+// createKey generates a server-managed key and returns its ID, which clients
+// send in the key-id header from then on, and the recipient ID others share
+// files with. With recovery_codes=true the response
+// also carries one-time recovery codes for the key.
+func (s *Server) createKey(c echo.Context) error {
+	keyID, err := s.keys.CreateKey()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Creating key failed")
+	}
+
+	response := createKeyResponse{KeyID: keyID, RecipientID: uploader.RecipientIDForKey(keyID)}
+	if recovery, _ := strconv.ParseBool(c.QueryParam("recovery_codes")); recovery {
+		key, err := s.keys.ResolveKey(keyID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Creating key failed")
+		}
+		if response.RecoveryCodes, err = s.recovery.Issue(uploader.DEFAULT_OWNER_ID, keyID, key); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Issuing recovery codes failed")
+		}
+	}
+
+	return c.JSON(http.StatusCreated, response)
+}
+
+// rotateKey re-keys every attachment of the caller from the key in the request
+// header to the new key in the body. A failed rotation can be retried with the
+// same keys and resumes where it stopped. With server-managed keys the new key
+// is generated by the server and the key ID stays the same.
+func (s *Server) rotateKey(c echo.Context) error {
+	key := middlewareValidator.EncryptionKey(c)
+	recoveryKeyID, err := s.recoveryKeyID(c, key)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Key rotation failed, retry to resume.")
+	}
+
+	var newKey string
+	if s.keys != nil {
+		keyID := c.Request().Header.Get("key-id")
+		oldKey, pendingKey, err := s.keys.BeginRotation(keyID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Key rotation failed, retry to resume.")
+		}
+		key, newKey = oldKey, pendingKey
+	} else {
+		var request rotateKeyRequest
+		if err := c.Bind(&request); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+		}
+
+		if !encryption.IsValidKey(request.NewKey) {
+			return echo.NewHTTPError(http.StatusBadRequest, "New encryption key is invalid")
+		}
+		newKey = request.NewKey
+	}
+
+	result, err := s.rotator.Rotate(c.Request().Context(), uploader.DEFAULT_OWNER_ID, key, newKey)
+	if err != nil {
+		if errors.Is(err, encryption.ErrAuthentication) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Encryption key does not match stored files")
+		}
+		var uploaderErr *uploader.Error
+		if errors.As(err, &uploaderErr) && uploaderErr.Code == uploader.INVALID {
+			return echo.NewHTTPError(http.StatusBadRequest, uploaderErr.Message)
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Key rotation failed, retry with the same keys to resume.")
+	}
+	// Client keys are not checked until they are used, so a rotation that
+	// matched nothing most likely had the wrong old key.
+	if s.keys == nil && result.Unmatched() {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Encryption key does not match stored files")
+	}
+
+	if s.keys != nil {
+		if err := s.keys.CompleteRotation(c.Request().Header.Get("key-id")); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Key rotation failed, retry to resume.")
+		}
+	}
+
+	// Recovery codes for the old key no longer help.
+	if err := s.recovery.Revoke(recoveryKeyID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Revoking recovery codes failed")
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
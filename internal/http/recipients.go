@@ -0,0 +1,123 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/encryption"
+	middlewareValidator "github.com/bencleary/uploader/internal/middleware"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// RECIPIENT_HEADER names the recipient a download is made as when keys are
+// held by clients. With server-managed keys the recipient ID of the caller's
+// key ID is used.
+const RECIPIENT_HEADER = "recipient"
+
+type addRecipientRequest struct {
+	// Recipient is the recipient's ID. With server-managed keys it is the
+	// recipient_id returned with their key, never their key ID.
+	Recipient string `json:"recipient"`
+	// RecipientKey is the recipient's encryption key. It is only read when keys
+	// are held by clients.
+	RecipientKey string `json:"recipient_key"`
+}
+
+type recipientsResponse struct {
+	Recipients []*uploader.Recipient `json:"recipients"`
+}
+
+// listRecipients returns who the attachment has been shared with. Only the
+// owner's key is accepted.
+func (s *Server) listRecipients(c echo.Context) error {
+	attachment, err := s.attachment(c)
+	if err != nil {
+		return err
+	}
+
+	recipients, err := s.sharing.List(c.Request().Context(), attachment.UID, middlewareValidator.EncryptionKey(c))
+	if err != nil {
+		return sharingError(err)
+	}
+	if recipients == nil {
+		recipients = []*uploader.Recipient{}
+	}
+	return c.JSON(http.StatusOK, recipientsResponse{Recipients: recipients})
+}
+
+// addRecipient wraps the attachment's data key for another recipient. The blob
+// is not rewritten.
+func (s *Server) addRecipient(c echo.Context) error {
+	attachment, err := s.attachment(c)
+	if err != nil {
+		return err
+	}
+
+	var request addRecipientRequest
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+
+	recipientKey := request.RecipientKey
+	if s.keys != nil {
+		recipientKey, err = s.keys.ResolveRecipient(request.Recipient)
+		if uploader.ErrorCode(err) == uploader.NOTFOUND {
+			return echo.NewHTTPError(http.StatusBadRequest, "Recipient is unknown")
+		} else if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Resolving recipient failed")
+		}
+	} else if err := encryption.ValidateKey(recipientKey); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Recipient key is invalid: "+err.Error())
+	}
+
+	recipient, err := s.sharing.Grant(c.Request().Context(), attachment, middlewareValidator.EncryptionKey(c), request.Recipient, recipientKey)
+	if err != nil {
+		return sharingError(err)
+	}
+	return c.JSON(http.StatusCreated, recipient)
+}
+
+// removeRecipient deletes a recipient's copy of the attachment's data key.
+func (s *Server) removeRecipient(c echo.Context) error {
+	attachment, err := s.attachment(c)
+	if err != nil {
+		return err
+	}
+
+	if err := s.sharing.Revoke(c.Request().Context(), attachment.UID, middlewareValidator.EncryptionKey(c), c.Param("recipient")); err != nil {
+		return sharingError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// attachment fetches the attachment named by the uid route parameter.
+func (s *Server) attachment(c echo.Context) (*uploader.Attachment, error) {
+	uid, err := uuid.Parse(c.Param("uid"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid UID")
+	}
+	attachment, err := s.filer.Fetch(uid)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "File not found")
+	}
+	return attachment, nil
+}
+
+// sharingError maps errors from uploader.ShareManager to HTTP errors.
+func sharingError(err error) error {
+	if errors.Is(err, encryption.ErrAuthentication) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Encryption key does not match stored files")
+	}
+	var uploaderErr *uploader.Error
+	if errors.As(err, &uploaderErr) {
+		switch uploaderErr.Code {
+		case uploader.INVALID:
+			return echo.NewHTTPError(http.StatusBadRequest, uploaderErr.Message)
+		case uploader.NOTFOUND:
+			return echo.NewHTTPError(http.StatusConflict, "File has no data key to share, rotate the owner's key first")
+		}
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, "Updating recipients failed")
+}
@@ -0,0 +1,101 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/encryption"
+	middlewareValidator "github.com/bencleary/uploader/internal/middleware"
+	"github.com/labstack/echo/v4"
+)
+
+type recoveryCodesResponse struct {
+	Codes []string `json:"codes"`
+}
+
+type recoverRequest struct {
+	Code   string `json:"code"`
+	NewKey string `json:"new_key"`
+}
+
+// issueRecoveryCodes returns a fresh set of one-time recovery codes for the
+// caller's key, replacing any issued before for that key. The codes are only
+// shown once.
+func (s *Server) issueRecoveryCodes(c echo.Context) error {
+	key := middlewareValidator.EncryptionKey(c)
+	keyID, err := s.recoveryKeyID(c, key)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Issuing recovery codes failed")
+	}
+	codes, err := s.recovery.Issue(uploader.DEFAULT_OWNER_ID, keyID, key)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Issuing recovery codes failed")
+	}
+
+	return c.JSON(http.StatusCreated, recoveryCodesResponse{Codes: codes})
+}
+
+// recoveryKeyID identifies the caller's key to the recovery manager: its key ID
+// with server-managed keys, or else a fingerprint of the key itself.
+func (s *Server) recoveryKeyID(c echo.Context, key string) (string, error) {
+	if s.keys != nil {
+		return c.Request().Header.Get("key-id"), nil
+	}
+	return encryption.KeyFingerprint(key)
+}
+
+// recoverKey exchanges a recovery code for access to the caller's files. With
+// client keys every file is re-keyed from the recovered key to new_key; with
+// server-managed keys the recovered key is moved to a new key ID. Either way
+// the remaining codes for the recovered key are revoked. Failed attempts are
+// not audited, so anyone reaching this endpoint cannot fill the audit log.
+func (s *Server) recoverKey(c echo.Context) error {
+	var request recoverRequest
+	if err := c.Bind(&request); err != nil || request.Code == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+	if s.keys == nil && !encryption.IsValidKey(request.NewKey) {
+		return echo.NewHTTPError(http.StatusBadRequest, "New encryption key is invalid")
+	}
+
+	var (
+		response  interface{}
+		unmatched bool
+	)
+	err := s.recovery.Recover(request.Code, func(recovered *uploader.RecoveredKey) error {
+		if s.keys != nil {
+			keyID, err := s.keys.ImportKey([]byte(recovered.Key))
+			if err != nil {
+				return err
+			}
+			if err := s.keys.DeleteKey(recovered.KeyID); err != nil {
+				return err
+			}
+			response = createKeyResponse{KeyID: keyID, RecipientID: uploader.RecipientIDForKey(keyID)}
+			return nil
+		}
+
+		result, err := s.rotator.Rotate(c.Request().Context(), recovered.OwnerID, recovered.Key, request.NewKey)
+		if err == nil && result.Unmatched() {
+			unmatched = true
+			return uploader.Errorf(uploader.CONFLICT, "recovered key does not match stored files")
+		}
+		response = result
+		return err
+	})
+	if err != nil {
+		if uploader.ErrorCode(err) == uploader.UNAUTHORIZED {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Recovery code is invalid or has been used")
+		}
+		if errors.Is(err, encryption.ErrAuthentication) || unmatched {
+			return echo.NewHTTPError(http.StatusConflict, "Recovered key does not match stored files")
+		}
+		if uploader.ErrorCode(err) == uploader.CONFLICT {
+			return echo.NewHTTPError(http.StatusConflict, "Recovery code is already being redeemed")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Recovery failed, retry with the same code.")
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -10,14 +10,21 @@ import (
 )
 
 type Server struct {
-	http    *echo.Echo
-	filer   uploader.FilerService
-	storage uploader.StorageService
-	scaler  uploader.ScalerService
-	preview *uploader.PreviewService
+	http     *echo.Echo
+	filer    uploader.FilerService
+	storage  uploader.StorageService
+	uploads  *uploader.UploadPipeline
+	rotator  *uploader.KeyRotator
+	keys     *uploader.KeyManager
+	sharing  *uploader.ShareManager
+	shredder *uploader.Shredder
+	recovery *uploader.RecoveryManager
 }
 
-func NewServer(filer uploader.FilerService, storage uploader.StorageService, scaler uploader.ScalerService, preview *uploader.PreviewService) *Server {
+// NewServer creates the HTTP server. When keys is nil clients send their raw
+// encryption key in the key header; otherwise keys are managed by the server and
+// clients send the key ID returned by POST /keys in the key-id header.
+func NewServer(filer uploader.FilerService, storage uploader.StorageService, uploads *uploader.UploadPipeline, rotator *uploader.KeyRotator, keys *uploader.KeyManager, sharing *uploader.ShareManager, shredder *uploader.Shredder, recovery *uploader.RecoveryManager) *Server {
 	e := echo.New()
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
@@ -41,25 +48,45 @@ func NewServer(filer uploader.FilerService, storage uploader.StorageService, sca
 			}
 		},
 		AllowMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders: []string{"Content-Type", "key"},
+		AllowHeaders: []string{"Content-Type", "key", "key-id", "recipient", "Range", "If-Range"},
 		ExposeHeaders: []string{
 			"Content-Type",
 			"Content-Disposition",
+			"Content-Length",
+			"Content-Range",
+			"Accept-Ranges",
+			"ETag",
+			"Digest",
 		},
 	}))
 
-	e.Use(middlewareValidator.ValidateEncryptionKey)
-
 	server := &Server{
-		http:    e,
-		filer:   filer,
-		storage: storage,
-		scaler:  scaler,
-		preview: preview,
+		http:     e,
+		filer:    filer,
+		storage:  storage,
+		uploads:  uploads,
+		rotator:  rotator,
+		keys:     keys,
+		sharing:  sharing,
+		shredder: shredder,
+		recovery: recovery,
+	}
+
+	requireKey := middlewareValidator.ValidateEncryptionKey
+	if keys != nil {
+		requireKey = middlewareValidator.ResolveKeyID(keys)
+		server.http.POST("/keys", server.createKey)
 	}
 
-	server.http.POST("/file/upload", server.upload)
-	server.http.GET("/file/:uid", server.download)
+	server.http.POST("/file/upload", server.upload, requireKey)
+	server.http.GET("/file/:uid", server.download, requireKey)
+	server.http.DELETE("/file/:uid", server.delete, requireKey)
+	server.http.POST("/keys/rotate", server.rotateKey, requireKey)
+	server.http.POST("/keys/recovery-codes", server.issueRecoveryCodes, requireKey)
+	server.http.POST("/keys/recover", server.recoverKey)
+	server.http.GET("/file/:uid/recipients", server.listRecipients, requireKey)
+	server.http.POST("/file/:uid/recipients", server.addRecipient, requireKey)
+	server.http.DELETE("/file/:uid/recipients/:recipient", server.removeRecipient, requireKey)
 
 	return server
 }
@@ -1,11 +1,17 @@
 package http
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/encryption"
+	middlewareValidator "github.com/bencleary/uploader/internal/middleware"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 )
@@ -17,57 +23,32 @@ const (
 
 func (s *Server) upload(c echo.Context) error {
 	// Encryption Key should be header
-	key := c.Request().Header.Get("key")
+	key := middlewareValidator.EncryptionKey(c)
 
 	if key == "" {
 		return uploader.Errorf(uploader.INVALID, "")
 	}
 
-	// Read file
-	file, err := c.FormFile("file")
-	if err != nil {
-		return echo.NewHTTPError(http.StatusNoContent, "Reading file upload failed")
-	}
-
-	attachment, err := s.storage.Hold(c.Request().Context(), file)
-
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Storing uploaded file failed")
-	}
-
-	err = attachment.CopyFileToPath(attachment.CreatePreviewLocalPath())
-
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Storing uploaded file failed")
-	}
-
-	if s.scaler.Supported(attachment.MimeType) {
-		err := s.scaler.Scale(c.Request().Context(), attachment.LocalPath, MAX_IMAGE_WIDTH, attachment.MimeType)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Storing uploaded file failed")
+	// An optional TTL makes the file's key expire, after which it can never be
+	// decrypted again.
+	var ttl time.Duration
+	if value := c.FormValue("ttl"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "TTL must be a positive duration such as 24h")
 		}
-	} else {
-		return echo.NewHTTPError(http.StatusBadRequest, "File type is not supported")
-	}
-
-	err = s.preview.Generate(c.Request().Context(), attachment, PREVIEW_WIDTH)
-
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Processing uploaded file has failed, please try again.")
+		ttl = parsed
 	}
 
-	err = s.storage.Upload(c.Request().Context(), attachment, key)
-
+	// Read file
+	file, err := c.FormFile("file")
 	if err != nil {
-		// writing files has failed
-		return echo.NewHTTPError(http.StatusInternalServerError, "Processing uploaded file has failed, please try again.")
+		return echo.NewHTTPError(http.StatusNoContent, "Reading file upload failed")
 	}
 
-	err = s.filer.Record(attachment)
-
+	attachment, err := s.uploads.Upload(c.Request().Context(), file, key, ttl)
 	if err != nil {
-		// writing files has failed
-		return echo.NewHTTPError(http.StatusInternalServerError, "Processing uploaded file has failed, please try again.")
+		return uploadError(c, err)
 	}
 
 	tempURL := url.URL{
@@ -89,7 +70,7 @@ func (s *Server) upload(c echo.Context) error {
 func (s *Server) download(c echo.Context) error {
 	// Retrieve the file UID from the request parameter.
 	uid := c.Param("uid")
-	key := c.Request().Header.Get("key")
+	key := middlewareValidator.EncryptionKey(c)
 	preview := c.QueryParam("preview")
 
 	var previewValue bool
@@ -110,11 +91,21 @@ func (s *Server) download(c echo.Context) error {
 		return err
 	}
 
-	// // Load the attachment by UID.
-	decrypted, err := s.storage.Download(c.Request().Context(), attachment, previewValue, key)
-	if err != nil {
-		// return uploader.Errorf(uploader.INVALID, "Decryption failed")
-		return echo.NewHTTPError(echo.ErrBadRequest.Code, "Decryption failed")
+	if attachment.Expired(time.Now()) {
+		return echo.NewHTTPError(http.StatusGone, "File has expired")
+	}
+
+	// Recipients of a shared file decrypt it with their own copy of its data key.
+	ctx := c.Request().Context()
+	recipient := c.Request().Header.Get(RECIPIENT_HEADER)
+	if s.keys != nil {
+		recipient = uploader.RecipientIDForKey(c.Request().Header.Get("key-id"))
+	}
+	if recipient != "" {
+		if !uploader.IsRecipientID(recipient) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid recipient")
+		}
+		ctx = uploader.WithRecipient(ctx, recipient)
 	}
 
 	contentType := attachment.MimeType
@@ -122,6 +113,114 @@ func (s *Server) download(c echo.Context) error {
 		contentType = "application/octet-stream"
 	}
 
-	// Stream the file for download.
+	// Serve through http.ServeContent so Range and If-Range are honoured; only
+	// the segments covering the requested bytes are fetched and decrypted.
+	content, err := s.storage.Open(ctx, attachment, previewValue, key)
+	if err == nil {
+		defer content.Close()
+		setDigestHeaders(c, attachment, previewValue)
+		c.Response().Header().Set(echo.HeaderContentType, contentType)
+		http.ServeContent(c.Response(), c.Request(), "", content.ModTime(), content)
+		return nil
+	}
+	if uploader.ErrorCode(err) != uploader.NOTIMPLEMENTED {
+		return decryptionError(err)
+	}
+
+	// // Load the attachment by UID.
+	decrypted, err := s.storage.Download(ctx, attachment, previewValue, key)
+	if err != nil {
+		return decryptionError(err)
+	}
+	setDigestHeaders(c, attachment, previewValue)
+
+	// Older blobs can only be decrypted from the start, so they are always
+	// streamed in full.
 	return c.Stream(http.StatusOK, contentType, decrypted)
 }
+
+// setDigestHeaders sets the Digest and ETag headers from the recorded SHA-256
+// of the plaintext. The digest identifies the contents, so it is only sent
+// once the key has been shown to open the file.
+func setDigestHeaders(c echo.Context, attachment *uploader.Attachment, preview bool) {
+	variant := uploader.VARIANT_ORIGINAL
+	if preview {
+		variant = uploader.VARIANT_PREVIEW
+	}
+	digest := attachment.GetDigest(variant)
+	if digest == "" {
+		return
+	}
+
+	// The SHA-256 of the plaintext is a strong validator, so ServeContent also
+	// uses it for If-Range and If-None-Match.
+	if raw, err := hex.DecodeString(digest); err == nil {
+		c.Response().Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(raw))
+	}
+	c.Response().Header().Set("ETag", `"`+digest+`"`)
+}
+
+// uploadStepFailures describes each upload step in the response when it fails.
+var uploadStepFailures = map[string]string{
+	uploader.UPLOAD_STEP_HOLD:    "Staging uploaded file failed",
+	uploader.UPLOAD_STEP_COPY:    "Staging uploaded file failed",
+	uploader.UPLOAD_STEP_SCALE:   "Scaling uploaded image failed",
+	uploader.UPLOAD_STEP_PREVIEW: "Generating preview failed",
+	uploader.UPLOAD_STEP_STORE:   "Storing encrypted file failed",
+	uploader.UPLOAD_STEP_RECORD:  "Recording uploaded file failed",
+}
+
+// uploadError maps a failed upload to a response that names the step that
+// failed. The details are logged rather than returned.
+func uploadError(c echo.Context, err error) error {
+	var uploadErr *uploader.UploadError
+	if !errors.As(err, &uploadErr) {
+		if uploader.ErrorCode(err) == uploader.INVALID {
+			return echo.NewHTTPError(http.StatusBadRequest, "File type is not supported")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Storing uploaded file failed")
+	}
+
+	c.Logger().Error(err)
+	if uploadErr.Compensation != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, uploadStepFailures[uploadErr.Step]+", and cleaning up after it failed too.")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, uploadStepFailures[uploadErr.Step]+", nothing was kept. Please try again.")
+}
+
+// decryptionError maps a failure to open a file for download to a response. A
+// wrong key is caught by its verification value before the blob is read.
+func decryptionError(err error) error {
+	switch uploader.ErrorCode(err) {
+	case uploader.UNAUTHORIZED:
+		return echo.NewHTTPError(http.StatusUnauthorized, "Encryption key does not match stored files")
+	case uploader.EXPIRED:
+		return echo.NewHTTPError(http.StatusGone, "File has expired")
+	}
+	if errors.Is(err, encryption.ErrCorrupt) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Stored file is damaged")
+	}
+	return echo.NewHTTPError(echo.ErrBadRequest.Code, "Decryption failed")
+}
+
+// delete crypto-shreds a file: its data key is destroyed first, so copies of
+// the ciphertext kept in backups or bucket versions can no longer be read.
+func (s *Server) delete(c echo.Context) error {
+	uid, err := uuid.Parse(c.Param("uid"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid UID")
+	}
+
+	result, err := s.shredder.Delete(c.Request().Context(), uid, middlewareValidator.EncryptionKey(c))
+	if err != nil {
+		if errors.Is(err, encryption.ErrAuthentication) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Encryption key does not match stored files")
+		}
+		if uploader.ErrorCode(err) == uploader.NOTFOUND {
+			return echo.NewHTTPError(http.StatusNotFound, "File not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Deleting file failed, retry to finish.")
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
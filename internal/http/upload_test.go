@@ -0,0 +1,91 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	middlewareValidator "github.com/bencleary/uploader/internal/middleware"
+	"github.com/bencleary/uploader/internal/storage"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const testKey = "12345678901234567890123456789012"
+
+// newDownloadServer stores an attachment with contents under testKey and
+// returns a server that can download it.
+func newDownloadServer(t *testing.T, contents string) (*Server, *uploader.Attachment) {
+	t.Helper()
+
+	database, err := db.NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+	filer := db.NewSqliteFilerService(database)
+	store := storage.NewLocalStorage(t.TempDir(), t.TempDir(), encryption.NewAESService(keystore.NewInMemoryKeyStore()))
+
+	attachment := &uploader.Attachment{
+		UID:       uuid.New(),
+		OwnerID:   uploader.DEFAULT_OWNER_ID,
+		FileName:  "test.txt",
+		MimeType:  "text/plain",
+		LocalPath: filepath.Join(t.TempDir(), "test.txt"),
+	}
+	if err := os.WriteFile(attachment.LocalPath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Upload(context.Background(), attachment, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := filer.Record(attachment); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Server{filer: filer, storage: store}, attachment
+}
+
+func serveDownload(s *Server, attachment *uploader.Attachment, key string) (*httptest.ResponseRecorder, error) {
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/file/"+attachment.UID.String(), nil), rec)
+	c.SetParamNames("uid")
+	c.SetParamValues(attachment.UID.String())
+	c.Set(middlewareValidator.ENCRYPTION_KEY, key)
+	return rec, s.download(c)
+}
+
+func TestDownloadHidesDigestFromWrongKey(t *testing.T) {
+	s, attachment := newDownloadServer(t, "secret")
+
+	rec, err := serveDownload(s, attachment, "abcdefghijklmnopqrstuvwxyz123456")
+	var httpErr *echo.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong key, got %v", err)
+	}
+	if rec.Header().Get("ETag") != "" || rec.Header().Get("Digest") != "" {
+		t.Fatalf("expected no digest headers for a wrong key, got %v", rec.Header())
+	}
+
+	rec, err = serveDownload(s, attachment, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.String() != "secret" {
+		t.Fatalf("unexpected contents %q", rec.Body.String())
+	}
+	if rec.Header().Get("ETag") != `"`+attachment.Digest+`"` || rec.Header().Get("Digest") == "" {
+		t.Fatalf("expected digest headers for the right key, got %v", rec.Header())
+	}
+}
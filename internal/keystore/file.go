@@ -0,0 +1,272 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bencleary/uploader"
+)
+
+var _ uploader.KeyStoreService = (*FileKeyStore)(nil)
+
+const (
+	// MASTER_KEY_SIZE is the size of the key that seals a FileKeyStore.
+	MASTER_KEY_SIZE = 32
+
+	fileVersion byte = 1
+
+	// FILE_PERMISSIONS restricts the keystore and its lock file to the owner.
+	FILE_PERMISSIONS = 0600
+)
+
+var fileMagic = []byte("UPKS")
+
+var ErrMasterKey = errors.New("keystore could not be opened with the master key")
+
+// FileKeyStore keeps keys in a single file sealed with AES-256-GCM under a
+// master key:
+//
+//	file = magic ("UPKS") || version (1 byte) || nonce (12 bytes) || sealed JSON map of id to key and expiry
+//
+// The magic and version are authenticated as associated data. Every change
+// rewrites the file to a temporary file that is synced and renamed over the old
+// one, so a crash leaves either the old or the new keystore. Changes are
+// serialised within the process by a mutex and across processes by an advisory
+// lock on a sibling ".lock" file (where the platform supports it).
+type FileKeyStore struct {
+	mu   sync.RWMutex
+	path string
+	aead cipher.AEAD
+}
+
+// NewFileKeyStore opens the keystore at path, creating an empty one if the file
+// does not exist. An existing file that does not open with masterKey is
+// rejected with ErrMasterKey, so a wrong key fails at startup.
+func NewFileKeyStore(path string, masterKey []byte) (*FileKeyStore, error) {
+	if len(masterKey) != MASTER_KEY_SIZE {
+		return nil, fmt.Errorf("master key must be %d bytes", MASTER_KEY_SIZE)
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &FileKeyStore{
+		path: path,
+		aead: aead,
+	}
+	err = k.update(func(map[string]fileKey) bool { return false })
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// ParseMasterKey decodes a master key given as 64 hex characters or as the
+// base64 encoding of 32 bytes. Surrounding whitespace, such as the newline at
+// the end of a key file, is ignored.
+func ParseMasterKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if key, err := hex.DecodeString(value); err == nil && len(key) == MASTER_KEY_SIZE {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(value); err == nil && len(key) == MASTER_KEY_SIZE {
+		return key, nil
+	}
+	return nil, fmt.Errorf("master key must be %d bytes, hex or base64 encoded", MASTER_KEY_SIZE)
+}
+
+// fileKey is a key as stored in the file.
+type fileKey struct {
+	Key       []byte    `json:"key"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (k *FileKeyStore) StoreKey(id string, key []byte) error {
+	return k.update(func(keys map[string]fileKey) bool {
+		keys[id] = fileKey{Key: key, ExpiresAt: keys[id].ExpiresAt}
+		return true
+	})
+}
+
+func (k *FileKeyStore) StoreKeyWithExpiry(id string, key []byte, expiresAt time.Time) error {
+	return k.update(func(keys map[string]fileKey) bool {
+		keys[id] = fileKey{Key: key, ExpiresAt: expiresAt}
+		return true
+	})
+}
+
+func (k *FileKeyStore) RetrieveKey(id string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	unlock, err := lockFile(k.path+".lock", false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	keys, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	stored, ok := keys[id]
+	if !ok {
+		return nil, uploader.Errorf(uploader.NOTFOUND, "key not found")
+	}
+	if expired(stored.ExpiresAt, time.Now()) {
+		return nil, uploader.Errorf(uploader.EXPIRED, "key expired at %s", stored.ExpiresAt.Format(time.RFC3339))
+	}
+	return stored.Key, nil
+}
+
+func (k *FileKeyStore) DeleteKey(id string) error {
+	return k.update(func(keys map[string]fileKey) bool {
+		if _, ok := keys[id]; !ok {
+			return false
+		}
+		delete(keys, id)
+		return true
+	})
+}
+
+func (k *FileKeyStore) DeleteExpiredKeys(now time.Time) (int, error) {
+	deleted := 0
+	err := k.update(func(keys map[string]fileKey) bool {
+		for id, stored := range keys {
+			if expired(stored.ExpiresAt, now) {
+				delete(keys, id)
+				deleted++
+			}
+		}
+		return deleted > 0
+	})
+	return deleted, err
+}
+
+// update loads the keys under an exclusive lock and, if change reports that it
+// modified them, writes them back. A missing file is created.
+func (k *FileKeyStore) update(change func(keys map[string]fileKey) bool) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	unlock, err := lockFile(k.path+".lock", true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	keys, err := k.load()
+	exists := err == nil
+	if errors.Is(err, os.ErrNotExist) {
+		keys = make(map[string]fileKey)
+	} else if err != nil {
+		return err
+	}
+
+	if !change(keys) && exists {
+		return nil
+	}
+	return k.save(keys)
+}
+
+// load reads and opens the keystore file.
+func (k *FileKeyStore) load() (map[string]fileKey, error) {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return nil, err
+	}
+
+	headerSize := len(fileMagic) + 1
+	if len(data) < headerSize+k.aead.NonceSize() || !bytes.HasPrefix(data, fileMagic) {
+		return nil, fmt.Errorf("%s is not a keystore file", k.path)
+	}
+	version := data[len(fileMagic)]
+	if version != fileVersion {
+		return nil, fmt.Errorf("unsupported keystore version %d", version)
+	}
+
+	nonce := data[headerSize : headerSize+k.aead.NonceSize()]
+	plaintext, err := k.aead.Open(nil, nonce, data[headerSize+k.aead.NonceSize():], data[:headerSize])
+	if err != nil {
+		return nil, ErrMasterKey
+	}
+
+	keys := make(map[string]fileKey)
+	if err := json.Unmarshal(plaintext, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// save seals keys and atomically replaces the keystore file with them.
+func (k *FileKeyStore) save(keys map[string]fileKey) error {
+	plaintext, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+
+	data := append(append([]byte(nil), fileMagic...), fileVersion)
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data = k.aead.Seal(append(data, nonce...), nonce, plaintext, data)
+
+	dir, name := filepath.Split(k.path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := tmp.Chmod(FILE_PERMISSIONS); err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), k.path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes a directory so a rename inside it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Not every platform can sync a directory; the rename is still atomic.
+	_ = d.Sync()
+	return nil
+}
@@ -0,0 +1,161 @@
+package keystore_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/keystore"
+)
+
+var testMasterKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newFileKeyStore(t *testing.T, path string) *keystore.FileKeyStore {
+	t.Helper()
+
+	ks, err := keystore.NewFileKeyStore(path, testMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func TestFileKeyStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.sealed")
+	ks := newFileKeyStore(t, path)
+
+	if err := ks.StoreKey("key", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.StoreKey("other", []byte("other-secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.DeleteKey("other"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) || bytes.Contains(data, []byte("key")) {
+		t.Fatal("expected the keystore file to be sealed")
+	}
+
+	reopened := newFileKeyStore(t, path)
+	key, err := reopened.RetrieveKey("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "secret" {
+		t.Fatalf("unexpected key %q", key)
+	}
+	if _, err := reopened.RetrieveKey("other"); uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected NOTFOUND error, got %v", err)
+	}
+}
+
+func TestFileKeyStoreRejectsWrongMasterKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.sealed")
+	ks := newFileKeyStore(t, path)
+	if err := ks.StoreKey("key", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := keystore.NewFileKeyStore(path, []byte("abcdefghijklmnopqrstuvwxyz123456"))
+	if !errors.Is(err, keystore.ErrMasterKey) {
+		t.Fatalf("expected ErrMasterKey, got %v", err)
+	}
+	if _, err := keystore.NewFileKeyStore(path, []byte("short")); err == nil {
+		t.Fatal("expected a short master key to be rejected")
+	}
+}
+
+func TestFileKeyStoreConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.sealed")
+	// Two stores on one file stand in for two processes.
+	stores := []*keystore.FileKeyStore{newFileKeyStore(t, path), newFileKeyStore(t, path)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := stores[i%2].StoreKey(fmt.Sprintf("key-%d", i), []byte{byte(i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		key, err := stores[0].RetrieveKey(fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, []byte{byte(i)}) {
+			t.Fatalf("unexpected key %d: %v", i, key)
+		}
+	}
+}
+
+func TestParseMasterKey(t *testing.T) {
+	for _, value := range []string{
+		"3031323334353637383961626364656630313233343536373839616263646566\n",
+		"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+	} {
+		key, err := keystore.ParseMasterKey(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, testMasterKey) {
+			t.Fatalf("unexpected key %q", key)
+		}
+	}
+
+	if _, err := keystore.ParseMasterKey("too-short"); err == nil {
+		t.Fatal("expected an invalid master key to be rejected")
+	}
+}
+
+func TestFileKeyStoreExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.sealed")
+	ks := newFileKeyStore(t, path)
+	now := time.Now()
+
+	if err := ks.StoreKeyWithExpiry("expired", []byte("secret"), now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.StoreKeyWithExpiry("live", []byte("secret"), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.StoreKey("live", []byte("rewrapped")); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := newFileKeyStore(t, path)
+	if _, err := reopened.RetrieveKey("expired"); uploader.ErrorCode(err) != uploader.EXPIRED {
+		t.Fatalf("expected EXPIRED error, got %v", err)
+	}
+	if key, err := reopened.RetrieveKey("live"); err != nil || string(key) != "rewrapped" {
+		t.Fatalf("unexpected key %q: %v", key, err)
+	}
+
+	deleted, err := reopened.DeleteExpiredKeys(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Fatalf("expected 1 key deleted, got %d", deleted)
+	}
+	// The replaced key kept its expiry.
+	if deleted, _ := reopened.DeleteExpiredKeys(now.Add(2 * time.Hour)); deleted != 1 {
+		t.Fatalf("expected the replaced key to expire, got %d deleted", deleted)
+	}
+}
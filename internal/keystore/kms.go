@@ -0,0 +1,58 @@
+package keystore
+
+import (
+	"context"
+	"time"
+
+	"github.com/bencleary/uploader"
+)
+
+var _ uploader.KeyStoreService = (*KMSKeyStore)(nil)
+
+// KMSKeyStore wraps every key with an external KMS before storing it in another
+// keystore, and unwraps it on the way out, so the keystore only ever holds
+// ciphertext the KMS must open. The key ID is bound as associated data, so a
+// wrapped key moved to another ID fails to unwrap.
+type KMSKeyStore struct {
+	keystore uploader.KeyStoreService
+	wrapper  uploader.KeyWrapper
+}
+
+func NewKMSKeyStore(keystore uploader.KeyStoreService, wrapper uploader.KeyWrapper) *KMSKeyStore {
+	return &KMSKeyStore{
+		keystore: keystore,
+		wrapper:  wrapper,
+	}
+}
+
+func (k *KMSKeyStore) StoreKey(id string, key []byte) error {
+	wrapped, err := k.wrapper.Wrap(context.Background(), key, []byte(id))
+	if err != nil {
+		return err
+	}
+	return k.keystore.StoreKey(id, wrapped)
+}
+
+func (k *KMSKeyStore) StoreKeyWithExpiry(id string, key []byte, expiresAt time.Time) error {
+	wrapped, err := k.wrapper.Wrap(context.Background(), key, []byte(id))
+	if err != nil {
+		return err
+	}
+	return k.keystore.StoreKeyWithExpiry(id, wrapped, expiresAt)
+}
+
+func (k *KMSKeyStore) RetrieveKey(id string) ([]byte, error) {
+	wrapped, err := k.keystore.RetrieveKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return k.wrapper.Unwrap(context.Background(), wrapped, []byte(id))
+}
+
+func (k *KMSKeyStore) DeleteKey(id string) error {
+	return k.keystore.DeleteKey(id)
+}
+
+func (k *KMSKeyStore) DeleteExpiredKeys(now time.Time) (int, error) {
+	return k.keystore.DeleteExpiredKeys(now)
+}
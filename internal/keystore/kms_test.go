@@ -0,0 +1,58 @@
+package keystore_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/kms"
+)
+
+func TestKMSKeyStore(t *testing.T) {
+	server := httptest.NewServer(kms.NewEmulator(""))
+	defer server.Close()
+
+	client, err := kms.NewTransitClient(kms.TransitOptions{Address: server.URL, KeyName: "uploader"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner := keystore.NewInMemoryKeyStore()
+	ks := keystore.NewKMSKeyStore(inner, client)
+
+	if err := ks.StoreKey("a", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := inner.RetrieveKey("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("secret")) {
+		t.Fatal("expected the inner keystore to hold only wrapped keys")
+	}
+
+	key, err := ks.RetrieveKey("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "secret" {
+		t.Fatalf("expected secret, got %q", key)
+	}
+
+	// A wrapped key copied to another ID must not unwrap.
+	if err := inner.StoreKey("b", stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.RetrieveKey("b"); err == nil {
+		t.Fatal("expected a moved key to fail to unwrap")
+	}
+
+	if err := ks.DeleteKey("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.RetrieveKey("a"); uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected NOTFOUND error, got %v", err)
+	}
+}
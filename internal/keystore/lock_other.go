@@ -0,0 +1,9 @@
+//go:build !unix
+
+package keystore
+
+// lockFile is a no-op where advisory file locks are not available; the
+// keystore is then only safe for use by a single process.
+func lockFile(path string, exclusive bool) (func(), error) {
+	return func() {}, nil
+}
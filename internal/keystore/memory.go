@@ -1,37 +1,81 @@
 package keystore
 
 import (
-	"errors"
+	"sync"
+	"time"
 
 	"github.com/bencleary/uploader"
 )
 
 var _ uploader.KeyStoreService = (*InMemoryKeyStore)(nil)
 
+// InMemoryKeyStore keeps keys in a map. It is safe for concurrent use but loses
+// every key when the process exits.
 type InMemoryKeyStore struct {
-	storage map[string][]byte
+	mu      sync.RWMutex
+	storage map[string]memoryKey
+}
+
+type memoryKey struct {
+	key       []byte
+	expiresAt time.Time
 }
 
 func NewInMemoryKeyStore() *InMemoryKeyStore {
 	return &InMemoryKeyStore{
-		storage: make(map[string][]byte),
+		storage: make(map[string]memoryKey),
 	}
 }
 
 func (k *InMemoryKeyStore) StoreKey(id string, key []byte) error {
-	k.storage[id] = key
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.storage[id] = memoryKey{key: append([]byte(nil), key...), expiresAt: k.storage[id].expiresAt}
+	return nil
+}
+
+func (k *InMemoryKeyStore) StoreKeyWithExpiry(id string, key []byte, expiresAt time.Time) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.storage[id] = memoryKey{key: append([]byte(nil), key...), expiresAt: expiresAt}
 	return nil
 }
 
 func (k *InMemoryKeyStore) RetrieveKey(id string) ([]byte, error) {
-	key, ok := k.storage[id]
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	stored, ok := k.storage[id]
 	if !ok {
-		return nil, errors.New("key not found")
+		return nil, uploader.Errorf(uploader.NOTFOUND, "key not found")
+	}
+	if expired(stored.expiresAt, time.Now()) {
+		return nil, uploader.Errorf(uploader.EXPIRED, "key expired at %s", stored.expiresAt.Format(time.RFC3339))
 	}
-	return key, nil
+	return append([]byte(nil), stored.key...), nil
 }
 
 func (k *InMemoryKeyStore) DeleteKey(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 	delete(k.storage, id)
 	return nil
 }
+
+func (k *InMemoryKeyStore) DeleteExpiredKeys(now time.Time) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	deleted := 0
+	for id, stored := range k.storage {
+		if expired(stored.expiresAt, now) {
+			delete(k.storage, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// expired reports whether a key with the given expiry has expired at now. A
+// zero expiry never expires.
+func expired(expiresAt, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
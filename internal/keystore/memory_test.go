@@ -1,8 +1,12 @@
 package keystore_test
 
 import (
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/bencleary/uploader"
 	"github.com/bencleary/uploader/internal/keystore"
 )
 
@@ -47,3 +51,77 @@ func TestMemoryKeyStoreDeleteKey(t *testing.T) {
 		t.Fatal("expected error")
 	}
 }
+
+func TestMemoryKeyStoreRetrieveMissingKey(t *testing.T) {
+	ks := keystore.NewInMemoryKeyStore()
+	_, err := ks.RetrieveKey("missing")
+	if uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected NOTFOUND error, got %v", err)
+	}
+}
+
+func TestMemoryKeyStoreConcurrentUse(t *testing.T) {
+	ks := keystore.NewInMemoryKeyStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := ks.StoreKey(id, []byte(id)); err != nil {
+				t.Error(err)
+			}
+			if _, err := ks.RetrieveKey(id); err != nil {
+				t.Error(err)
+			}
+			if err := ks.DeleteKey(id); err != nil {
+				t.Error(err)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+}
+
+func TestMemoryKeyStoreExpiry(t *testing.T) {
+	ks := keystore.NewInMemoryKeyStore()
+	now := time.Now()
+
+	if err := ks.StoreKeyWithExpiry("expired", []byte("secret"), now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.StoreKeyWithExpiry("live", []byte("secret"), now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.StoreKey("forever", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ks.RetrieveKey("expired"); uploader.ErrorCode(err) != uploader.EXPIRED {
+		t.Fatalf("expected EXPIRED error, got %v", err)
+	}
+	if _, err := ks.RetrieveKey("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing a key keeps its expiry.
+	if err := ks.StoreKey("expired", []byte("rewrapped")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.RetrieveKey("expired"); uploader.ErrorCode(err) != uploader.EXPIRED {
+		t.Fatalf("expected EXPIRED error after replacing, got %v", err)
+	}
+
+	deleted, err := ks.DeleteExpiredKeys(now.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Fatalf("expected 2 keys deleted, got %d", deleted)
+	}
+	if _, err := ks.RetrieveKey("live"); uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected NOTFOUND error, got %v", err)
+	}
+	if _, err := ks.RetrieveKey("forever"); err != nil {
+		t.Fatal(err)
+	}
+}
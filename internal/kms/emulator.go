@@ -0,0 +1,273 @@
+package kms
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Emulator is a small in-memory stand-in for the Vault Transit endpoints the
+// TransitClient uses, for tests and local development. It is not a KMS: keys
+// live in memory and are lost when it stops.
+//
+//	POST /v1/transit/keys/:name         create a key (encrypt also creates it)
+//	POST /v1/transit/keys/:name/rotate  add a new key version
+//	POST /v1/transit/encrypt/:name      {"plaintext", "associated_data"} -> {"data": {"ciphertext"}}
+//	POST /v1/transit/decrypt/:name      {"ciphertext", "associated_data"} -> {"data": {"plaintext"}}
+//
+// Values are base64 encoded and ciphertexts look like Vault's,
+// "vault:v<version>:<base64 nonce || sealed>". Encryption always uses the
+// latest key version; decryption accepts any version.
+type Emulator struct {
+	mu       sync.Mutex
+	token    string
+	keys     map[string][]cipher.AEAD
+	failures int
+	decrypts int
+	mux      *http.ServeMux
+}
+
+// NewEmulator returns an emulator that requires token in the X-Vault-Token
+// header, or accepts any request if token is empty.
+func NewEmulator(token string) *Emulator {
+	e := &Emulator{
+		token: token,
+		keys:  make(map[string][]cipher.AEAD),
+		mux:   http.NewServeMux(),
+	}
+	e.mux.HandleFunc("POST /v1/transit/keys/{name}", e.createKey)
+	e.mux.HandleFunc("POST /v1/transit/keys/{name}/rotate", e.rotateKey)
+	e.mux.HandleFunc("POST /v1/transit/encrypt/{name}", e.encrypt)
+	e.mux.HandleFunc("POST /v1/transit/decrypt/{name}", e.decrypt)
+	return e
+}
+
+// FailNext makes the next n requests fail with 503 Service Unavailable, to
+// exercise client retries.
+func (e *Emulator) FailNext(n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures = n
+}
+
+// Decrypts returns how many decrypt requests have succeeded.
+func (e *Emulator) Decrypts() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.decrypts
+}
+
+func (e *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	failing := e.failures > 0
+	if failing {
+		e.failures--
+	}
+	e.mu.Unlock()
+
+	if failing {
+		writeErrors(w, http.StatusServiceUnavailable, "emulated outage")
+		return
+	}
+	if e.token != "" && r.Header.Get("X-Vault-Token") != e.token {
+		writeErrors(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	e.mux.ServeHTTP(w, r)
+}
+
+type transitRequest struct {
+	Plaintext      string `json:"plaintext"`
+	Ciphertext     string `json:"ciphertext"`
+	AssociatedData string `json:"associated_data"`
+}
+
+type transitResponse struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+func (e *Emulator) createKey(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, err := e.key(r.PathValue("name"), true); err != nil {
+		writeErrors(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *Emulator) rotateKey(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	name := r.PathValue("name")
+	if _, ok := e.keys[name]; !ok {
+		writeErrors(w, http.StatusNotFound, "encryption key not found")
+		return
+	}
+	aead, err := newKey()
+	if err != nil {
+		writeErrors(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	e.keys[name] = append(e.keys[name], aead)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *Emulator) encrypt(w http.ResponseWriter, r *http.Request) {
+	var request transitRequest
+	plaintext, ad, ok := decodeRequest(w, r, &request, &request.Plaintext)
+	if !ok {
+		return
+	}
+
+	e.mu.Lock()
+	versions, err := e.key(r.PathValue("name"), true)
+	e.mu.Unlock()
+	if err != nil {
+		writeErrors(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	version := len(versions)
+	aead := versions[version-1]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		writeErrors(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, ad)
+
+	writeData(w, map[string]interface{}{
+		"ciphertext":  fmt.Sprintf("vault:v%d:%s", version, base64.StdEncoding.EncodeToString(sealed)),
+		"key_version": version,
+	})
+}
+
+func (e *Emulator) decrypt(w http.ResponseWriter, r *http.Request) {
+	var request transitRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeErrors(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	ad, err := base64.StdEncoding.DecodeString(request.AssociatedData)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, "associated_data must be base64")
+		return
+	}
+
+	parts := strings.SplitN(request.Ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") {
+		writeErrors(w, http.StatusBadRequest, "invalid ciphertext")
+		return
+	}
+	version, err := strconv.Atoi(parts[1][1:])
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, "invalid ciphertext version")
+		return
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, "invalid ciphertext")
+		return
+	}
+
+	e.mu.Lock()
+	versions, err := e.key(r.PathValue("name"), false)
+	e.mu.Unlock()
+	if err != nil {
+		writeErrors(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if version < 1 || version > len(versions) {
+		writeErrors(w, http.StatusBadRequest, "invalid ciphertext version")
+		return
+	}
+
+	aead := versions[version-1]
+	if len(sealed) < aead.NonceSize() {
+		writeErrors(w, http.StatusBadRequest, "invalid ciphertext")
+		return
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, "cipher: message authentication failed")
+		return
+	}
+
+	e.mu.Lock()
+	e.decrypts++
+	e.mu.Unlock()
+	writeData(w, map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	})
+}
+
+// key returns the versions of the named key, creating it if create is set.
+// The caller holds e.mu.
+func (e *Emulator) key(name string, create bool) ([]cipher.AEAD, error) {
+	if versions, ok := e.keys[name]; ok {
+		return versions, nil
+	}
+	if !create {
+		return nil, fmt.Errorf("encryption key not found")
+	}
+
+	aead, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	e.keys[name] = []cipher.AEAD{aead}
+	return e.keys[name], nil
+}
+
+func newKey() (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decodeRequest reads an encrypt request, decoding the base64 field value and
+// associated data. It writes a 400 response and reports false on bad input.
+func decodeRequest(w http.ResponseWriter, r *http.Request, request *transitRequest, field *string) ([]byte, []byte, bool) {
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		writeErrors(w, http.StatusBadRequest, "invalid request body")
+		return nil, nil, false
+	}
+	value, err := base64.StdEncoding.DecodeString(*field)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, "plaintext must be base64")
+		return nil, nil, false
+	}
+	ad, err := base64.StdEncoding.DecodeString(request.AssociatedData)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, "associated_data must be base64")
+		return nil, nil, false
+	}
+	return value, ad, true
+}
+
+func writeData(w http.ResponseWriter, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(transitResponse{Data: data})
+}
+
+func writeErrors(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string][]string{"errors": {message}})
+}
@@ -0,0 +1,56 @@
+package kms
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+
+	"github.com/bencleary/uploader"
+)
+
+var _ uploader.KeyWrapper = (*LocalWrapper)(nil)
+
+// LOCAL_KEY_SIZE is the size of the key a LocalWrapper seals values with.
+const LOCAL_KEY_SIZE = 32
+
+// LocalWrapper wraps values with AES-256-GCM under a key the server holds, for
+// deployments without an external KMS. Wrapped values are nonce || ciphertext.
+type LocalWrapper struct {
+	aead cipher.AEAD
+}
+
+func NewLocalWrapper(key []byte) (*LocalWrapper, error) {
+	if len(key) != LOCAL_KEY_SIZE {
+		return nil, uploader.Errorf(uploader.INVALID, "kms: local key must be %d bytes", LOCAL_KEY_SIZE)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalWrapper{aead: aead}, nil
+}
+
+func (l *LocalWrapper) Wrap(_ context.Context, plaintext, associatedData []byte) ([]byte, error) {
+	nonce := make([]byte, l.aead.NonceSize(), l.aead.NonceSize()+len(plaintext)+l.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return l.aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+func (l *LocalWrapper) Unwrap(_ context.Context, ciphertext, associatedData []byte) ([]byte, error) {
+	if len(ciphertext) < l.aead.NonceSize()+l.aead.Overhead() {
+		return nil, uploader.Errorf(uploader.INVALID, "kms: wrapped value is too short")
+	}
+	nonce, sealed := ciphertext[:l.aead.NonceSize()], ciphertext[l.aead.NonceSize():]
+	plaintext, err := l.aead.Open(nil, nonce, sealed, associatedData)
+	if err != nil {
+		return nil, uploader.Errorf(uploader.INVALID, "kms: wrapped value failed authentication")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,42 @@
+package kms_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/kms"
+)
+
+func TestLocalWrapUnwrap(t *testing.T) {
+	wrapper, err := kms.NewLocalWrapper(bytes.Repeat([]byte{1}, kms.LOCAL_KEY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	wrapped, err := wrapper.Wrap(ctx, []byte("user key"), []byte("user-key:id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := wrapper.Unwrap(ctx, wrapped, []byte("user-key:id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "user key" {
+		t.Fatalf("expected user key, got %q", plaintext)
+	}
+
+	if _, err := wrapper.Unwrap(ctx, wrapped, []byte("user-key:other")); uploader.ErrorCode(err) != uploader.INVALID {
+		t.Fatalf("expected INVALID error for wrong associated data, got %v", err)
+	}
+
+	other, err := kms.NewLocalWrapper(bytes.Repeat([]byte{2}, kms.LOCAL_KEY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Unwrap(ctx, wrapped, []byte("user-key:id")); uploader.ErrorCode(err) != uploader.INVALID {
+		t.Fatalf("expected INVALID error for another key, got %v", err)
+	}
+}
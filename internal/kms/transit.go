@@ -0,0 +1,298 @@
+package kms
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bencleary/uploader"
+)
+
+var _ uploader.KeyWrapper = (*TransitClient)(nil)
+
+const (
+	DEFAULT_TIMEOUT    = 5 * time.Second
+	DEFAULT_RETRIES    = 2
+	DEFAULT_CACHE_TTL  = 5 * time.Minute
+	DEFAULT_CACHE_SIZE = 1024
+	DEFAULT_BACKOFF    = 100 * time.Millisecond
+)
+
+// TransitOptions configures a TransitClient. Zero values take the defaults
+// above; set CacheTTL negative to disable the cache.
+type TransitOptions struct {
+	// Address is the base URL of the KMS, e.g. http://127.0.0.1:8200.
+	Address string
+	Token   string
+	// KeyName is the transit key that wraps and unwraps values.
+	KeyName string
+	// Timeout bounds each HTTP attempt.
+	Timeout time.Duration
+	// Retries is how many times a request is retried after a network error,
+	// 429 or 5xx response. Other errors are not retried.
+	Retries int
+	// Backoff is the delay before the first retry; it doubles on each retry.
+	Backoff time.Duration
+	// CacheTTL is how long unwrapped values are kept in memory.
+	CacheTTL  time.Duration
+	CacheSize int
+}
+
+// TransitClient wraps and unwraps values with a key held by a Vault Transit
+// compatible KMS. Unwrapped values are cached for CacheTTL so hot keys do not
+// cost a round trip on every request; wrapped values are never cached, since
+// each Wrap must produce a fresh ciphertext.
+type TransitClient struct {
+	options TransitOptions
+	client  *http.Client
+	cache   *unwrapCache
+}
+
+func NewTransitClient(options TransitOptions) (*TransitClient, error) {
+	if options.Address == "" {
+		return nil, uploader.Errorf(uploader.INVALID, "kms: address is required")
+	}
+	if _, err := url.Parse(options.Address); err != nil {
+		return nil, uploader.Errorf(uploader.INVALID, "kms: invalid address: %v", err)
+	}
+	if options.KeyName == "" {
+		return nil, uploader.Errorf(uploader.INVALID, "kms: key name is required")
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DEFAULT_TIMEOUT
+	}
+	if options.Retries < 0 {
+		options.Retries = 0
+	} else if options.Retries == 0 {
+		options.Retries = DEFAULT_RETRIES
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = DEFAULT_BACKOFF
+	}
+	if options.CacheTTL == 0 {
+		options.CacheTTL = DEFAULT_CACHE_TTL
+	}
+	if options.CacheSize <= 0 {
+		options.CacheSize = DEFAULT_CACHE_SIZE
+	}
+	options.Address = strings.TrimRight(options.Address, "/")
+
+	client := &TransitClient{
+		options: options,
+		client:  &http.Client{Timeout: options.Timeout},
+	}
+	if options.CacheTTL > 0 {
+		client.cache = newUnwrapCache(options.CacheTTL, options.CacheSize)
+	}
+	return client, nil
+}
+
+func (t *TransitClient) Wrap(ctx context.Context, plaintext, associatedData []byte) ([]byte, error) {
+	var response struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	err := t.call(ctx, "encrypt", map[string]string{
+		"plaintext":       base64.StdEncoding.EncodeToString(plaintext),
+		"associated_data": base64.StdEncoding.EncodeToString(associatedData),
+	}, &response)
+	if err != nil {
+		return nil, err
+	}
+	if response.Data.Ciphertext == "" {
+		return nil, uploader.Errorf(uploader.INTERNAL, "kms: encrypt returned no ciphertext")
+	}
+	return []byte(response.Data.Ciphertext), nil
+}
+
+func (t *TransitClient) Unwrap(ctx context.Context, ciphertext, associatedData []byte) ([]byte, error) {
+	cacheKey := ""
+	if t.cache != nil {
+		cacheKey = unwrapCacheKey(ciphertext, associatedData)
+		if plaintext, ok := t.cache.get(cacheKey, time.Now()); ok {
+			return plaintext, nil
+		}
+	}
+
+	var response struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	err := t.call(ctx, "decrypt", map[string]string{
+		"ciphertext":      string(ciphertext),
+		"associated_data": base64.StdEncoding.EncodeToString(associatedData),
+	}, &response)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(response.Data.Plaintext)
+	if err != nil {
+		return nil, uploader.Errorf(uploader.INTERNAL, "kms: decrypt returned invalid plaintext")
+	}
+
+	if t.cache != nil {
+		t.cache.put(cacheKey, plaintext, time.Now())
+	}
+	return plaintext, nil
+}
+
+// call posts body to the transit operation and decodes the response into out,
+// retrying network errors, 429 and 5xx responses with exponential backoff.
+func (t *TransitClient) call(ctx context.Context, operation string, body interface{}, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/v1/transit/%s/%s", t.options.Address, operation, url.PathEscape(t.options.KeyName))
+
+	backoff := t.options.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := t.attempt(ctx, endpoint, payload, out)
+		if err == nil || !retry || attempt >= t.options.Retries {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// attempt makes one request and reports whether a failure may be retried.
+func (t *TransitClient) attempt(ctx context.Context, endpoint string, payload []byte, out interface{}) (bool, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if t.options.Token != "" {
+		request.Header.Set("X-Vault-Token", t.options.Token)
+	}
+
+	response, err := t.client.Do(request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		return true, uploader.Errorf(uploader.INTERNAL, "kms: %v", err)
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return true, uploader.Errorf(uploader.INTERNAL, "kms: reading response: %v", err)
+	}
+
+	switch {
+	case response.StatusCode == http.StatusOK:
+		if err := json.Unmarshal(data, out); err != nil {
+			return false, uploader.Errorf(uploader.INTERNAL, "kms: invalid response: %v", err)
+		}
+		return false, nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return true, uploader.Errorf(uploader.INTERNAL, "kms: %s", responseError(response.StatusCode, data))
+	case response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden:
+		return false, uploader.Errorf(uploader.UNAUTHORIZED, "kms: %s", responseError(response.StatusCode, data))
+	case response.StatusCode == http.StatusNotFound:
+		return false, uploader.Errorf(uploader.NOTFOUND, "kms: %s", responseError(response.StatusCode, data))
+	default:
+		return false, uploader.Errorf(uploader.INVALID, "kms: %s", responseError(response.StatusCode, data))
+	}
+}
+
+// responseError formats the errors list of a Vault error response.
+func responseError(status int, data []byte) string {
+	var body struct {
+		Errors []string `json:"errors"`
+	}
+	if json.Unmarshal(data, &body) == nil && len(body.Errors) > 0 {
+		return fmt.Sprintf("%d %s", status, strings.Join(body.Errors, "; "))
+	}
+	return fmt.Sprintf("%d %s", status, http.StatusText(status))
+}
+
+func unwrapCacheKey(ciphertext, associatedData []byte) string {
+	hash := sha256.New()
+	hash.Write(ciphertext)
+	hash.Write([]byte{0})
+	hash.Write(associatedData)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// unwrapCache is a size-bounded LRU of unwrapped values that expire after ttl.
+type unwrapCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func newUnwrapCache(ttl time.Duration, size int) *unwrapCache {
+	return &unwrapCache{
+		ttl:     ttl,
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *unwrapCache) get(key string, now time.Time) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return append([]byte(nil), entry.value...), true
+}
+
+func (c *unwrapCache) put(key string, value []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, value: append([]byte(nil), value...), expiresAt: now.Add(c.ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,165 @@
+package kms_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/kms"
+)
+
+func newTestClient(t *testing.T, emulator *kms.Emulator, options kms.TransitOptions) *kms.TransitClient {
+	t.Helper()
+	server := httptest.NewServer(emulator)
+	t.Cleanup(server.Close)
+
+	options.Address = server.URL
+	if options.KeyName == "" {
+		options.KeyName = "uploader"
+	}
+	options.Backoff = time.Millisecond
+	client, err := kms.NewTransitClient(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestTransitWrapUnwrap(t *testing.T) {
+	client := newTestClient(t, kms.NewEmulator("token"), kms.TransitOptions{Token: "token"})
+	ctx := context.Background()
+
+	wrapped, err := client.Wrap(ctx, []byte("data key"), []byte("attachment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := client.Unwrap(ctx, wrapped, []byte("attachment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "data key" {
+		t.Fatalf("expected data key, got %q", plaintext)
+	}
+
+	if _, err := client.Unwrap(ctx, wrapped, []byte("other")); uploader.ErrorCode(err) != uploader.INVALID {
+		t.Fatalf("expected INVALID error for wrong associated data, got %v", err)
+	}
+}
+
+func TestTransitRejectsBadToken(t *testing.T) {
+	emulator := kms.NewEmulator("token")
+	client := newTestClient(t, emulator, kms.TransitOptions{Token: "wrong"})
+
+	if _, err := client.Wrap(context.Background(), []byte("data key"), nil); uploader.ErrorCode(err) != uploader.UNAUTHORIZED {
+		t.Fatalf("expected UNAUTHORIZED error, got %v", err)
+	}
+}
+
+func TestTransitRetries(t *testing.T) {
+	emulator := kms.NewEmulator("")
+	client := newTestClient(t, emulator, kms.TransitOptions{Retries: 2})
+	ctx := context.Background()
+
+	emulator.FailNext(2)
+	wrapped, err := client.Wrap(ctx, []byte("data key"), nil)
+	if err != nil {
+		t.Fatalf("expected the wrap to succeed after retrying, got %v", err)
+	}
+
+	emulator.FailNext(3)
+	if _, err := client.Unwrap(ctx, wrapped, nil); err == nil {
+		t.Fatal("expected the unwrap to fail once retries run out")
+	}
+}
+
+func TestTransitTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client, err := kms.NewTransitClient(kms.TransitOptions{
+		Address: server.URL,
+		KeyName: "uploader",
+		Timeout: 50 * time.Millisecond,
+		Retries: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := client.Wrap(context.Background(), []byte("data key"), nil); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected the request to time out quickly, took %v", elapsed)
+	}
+}
+
+func TestTransitCachesUnwrap(t *testing.T) {
+	emulator := kms.NewEmulator("")
+	client := newTestClient(t, emulator, kms.TransitOptions{CacheTTL: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	wrapped, err := client.Wrap(ctx, []byte("data key"), []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := client.Unwrap(ctx, wrapped, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := emulator.Decrypts(); got != 1 {
+		t.Fatalf("expected 1 decrypt request, got %d", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := client.Unwrap(ctx, wrapped, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if got := emulator.Decrypts(); got != 2 {
+		t.Fatalf("expected the cache entry to expire, got %d decrypt requests", got)
+	}
+}
+
+func TestEmulatorRotate(t *testing.T) {
+	emulator := kms.NewEmulator("")
+	server := httptest.NewServer(emulator)
+	defer server.Close()
+
+	client, err := kms.NewTransitClient(kms.TransitOptions{Address: server.URL, KeyName: "uploader", CacheTTL: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	wrapped, err := client.Wrap(ctx, []byte("data key"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := http.Post(server.URL+"/v1/transit/keys/uploader/rotate", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", response.StatusCode)
+	}
+
+	// Values wrapped under an older key version still unwrap.
+	plaintext, err := client.Unwrap(ctx, wrapped, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "data key" {
+		t.Fatalf("expected data key, got %q", plaintext)
+	}
+}
@@ -1,12 +1,32 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 
+	"github.com/bencleary/uploader"
 	"github.com/bencleary/uploader/internal/encryption"
 	"github.com/labstack/echo/v4"
 )
 
+// ENCRYPTION_KEY is the echo context key holding the request's encryption key
+// once a middleware has validated or resolved it.
+const ENCRYPTION_KEY = "encryption_key"
+
+// setEncryptionKey records the request's key and gives the request a
+// uploader.KeyCache, so the key is stretched or unwrapped once however many
+// times the request uses it.
+func setEncryptionKey(c echo.Context, key string) {
+	c.Set(ENCRYPTION_KEY, key)
+	c.SetRequest(c.Request().WithContext(uploader.WithKeyCache(c.Request().Context())))
+}
+
+// EncryptionKey returns the encryption key for the request.
+func EncryptionKey(c echo.Context) string {
+	key, _ := c.Get(ENCRYPTION_KEY).(string)
+	return key
+}
+
 func ValidateEncryptionKey(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		key := c.Request().Header.Get("key")
@@ -15,10 +35,39 @@ func ValidateEncryptionKey(next echo.HandlerFunc) echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusUnauthorized, "Encryption key is required")
 		}
 
-		if !encryption.IsValidKey(key) {
+		if err := encryption.ValidateKey(key); err != nil {
+			if errors.Is(err, encryption.ErrWeakPassphrase) {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Encryption "+err.Error())
+			}
 			return echo.NewHTTPError(http.StatusUnauthorized, "Encryption key is invalid")
 		}
 
+		setEncryptionKey(c, key)
 		return next(c)
 	}
 }
+
+// ResolveKeyID is used instead of ValidateEncryptionKey when keys are managed by
+// the server. Requests carry a key ID in the key-id header, which is resolved to
+// the key itself.
+func ResolveKeyID(keys *uploader.KeyManager) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			keyID := c.Request().Header.Get("key-id")
+
+			if keyID == "" {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Key ID is required")
+			}
+
+			key, err := keys.ResolveKey(keyID)
+			if uploader.ErrorCode(err) == uploader.NOTFOUND {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Key ID is unknown")
+			} else if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "Resolving key ID failed")
+			}
+
+			setEncryptionKey(c, key)
+			return next(c)
+		}
+	}
+}
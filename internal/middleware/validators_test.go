@@ -1,11 +1,15 @@
 package middleware
 
 import (
+	"bytes"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/kms"
 	"github.com/labstack/echo/v4"
 )
 
@@ -49,6 +53,30 @@ var validationCases = []struct {
 		expectedError: "Encryption key is invalid",
 		expectedCode:  401,
 	},
+	{
+		name:          "strong passphrase",
+		key:           "pass:correct horse battery staple",
+		expectedError: "",
+		expectedCode:  200,
+	},
+	{
+		name:          "short passphrase",
+		key:           "pass:hunter2",
+		expectedError: "Encryption passphrase is too weak: use at least 12 characters",
+		expectedCode:  401,
+	},
+	{
+		name:          "repetitive passphrase",
+		key:           "pass:abababababababababab",
+		expectedError: "Encryption passphrase is too weak: too many repeated characters",
+		expectedCode:  401,
+	},
+	{
+		name:          "predictable passphrase",
+		key:           "pass:123456789012",
+		expectedError: "Encryption passphrase is too weak: use a longer passphrase or more kinds of characters",
+		expectedCode:  401,
+	},
 }
 
 func TestValidateEncryptionKey(t *testing.T) {
@@ -88,3 +116,62 @@ func TestValidateEncryptionKey(t *testing.T) {
 	}
 
 }
+
+func TestResolveKeyID(t *testing.T) {
+	wrapper, err := kms.NewLocalWrapper(bytes.Repeat([]byte{1}, kms.LOCAL_KEY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := uploader.NewKeyManager(keystore.NewInMemoryKeyStore(), wrapper)
+	keyID, err := keys.CreateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := keys.ResolveKey(keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(ResolveKeyID(keys))
+	e.GET("/", func(c echo.Context) error {
+		return c.String(http.StatusOK, EncryptionKey(c))
+	})
+
+	cases := []struct {
+		name          string
+		keyID         string
+		expectedError string
+		expectedCode  int
+	}{
+		{name: "known key ID", keyID: keyID, expectedCode: 200},
+		{name: "missing key ID", keyID: "", expectedError: "Key ID is required", expectedCode: 401},
+		{name: "unknown key ID", keyID: "0123456789abcdef0123456789abcdef", expectedError: "Key ID is unknown", expectedCode: 401},
+		{name: "raw key as key ID", keyID: "12345678901234567890123456789012", expectedError: "Key ID is unknown", expectedCode: 401},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("key-id", test.keyID)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != test.expectedCode {
+				t.Fatal("name", test.name, "expected code", test.expectedCode, "got", rec.Code)
+			}
+
+			if rec.Code != 200 {
+				var errorResponse ErrorResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &errorResponse); err != nil {
+					t.Fatal("Failed to unmarshal error response", err)
+				}
+				if errorResponse.Message != test.expectedError {
+					t.Fatal("name", test.name, "expected error", test.expectedError, "got", errorResponse.Message)
+				}
+			} else if rec.Body.String() != key {
+				t.Fatal("name", test.name, "expected the resolved key to be set on the context")
+			}
+		})
+	}
+}
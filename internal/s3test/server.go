@@ -0,0 +1,452 @@
+// Package s3test provides an in-process fake of the parts of the S3 API the
+// uploader uses, for tests that should not depend on MinIO.
+package s3test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a path-style S3 endpoint backed by memory. Buckets are created on
+// first use. It does not check signatures.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	objects    map[string]*object
+	uploads    map[string]*upload
+	nextUpload int
+	failPart   int32
+	active     int
+	maxActive  int
+}
+
+type object struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+type upload struct {
+	key   string
+	parts map[int32][]byte
+}
+
+// NewServer starts a fake S3 server. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		objects: make(map[string]*object),
+		uploads: make(map[string]*upload),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// FailPart makes every upload of part number n fail with 403 Access Denied,
+// which clients do not retry. Zero turns it off.
+func (s *Server) FailPart(n int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failPart = n
+}
+
+// Object returns the contents of bucket/key.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[bucket+"/"+key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), o.data...), true
+}
+
+// PutObject stores data at bucket/key directly.
+func (s *Server) PutObject(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[bucket+"/"+key] = newObject(data)
+}
+
+// Keys returns the keys in bucket, sorted.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for name := range s.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MultipartUploads returns how many multipart uploads are neither completed
+// nor aborted.
+func (s *Server) MultipartUploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// MaxConcurrentParts returns the most part uploads that were in flight at once.
+func (s *Server) MaxConcurrentParts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxActive
+}
+
+func newObject(data []byte) *object {
+	sum := md5.Sum(data)
+	return &object{data: data, etag: `"` + hex.EncodeToString(sum[:]) + `"`, modified: time.Now().UTC()}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	if key == "" {
+		switch r.Method {
+		case http.MethodPut, http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			s.list(w, bucket, query.Get("prefix"), query.Get("continuation-token"), query.Get("max-keys"))
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported bucket operation")
+		}
+		return
+	}
+
+	name := bucket + "/" + key
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createUpload(w, bucket, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, r, query)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeUpload(w, r, bucket, name, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s.mu.Lock()
+		delete(s.uploads, query.Get("uploadId"))
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		data, err := readBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		o := newObject(data)
+		s.mu.Lock()
+		s.objects[name] = o
+		s.mu.Unlock()
+		w.Header().Set("ETag", o.etag)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.get(w, r, name)
+	case r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(s.objects, name)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported object operation")
+	}
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	o, ok := s.objects[name]
+	s.mu.Unlock()
+	if !ok {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	w.Header().Set("ETag", o.etag)
+	w.Header().Set("Last-Modified", o.modified.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	data, status := o.data, http.StatusOK
+	if r.Header.Get("Range") == "" {
+		// Whole-object reads carry a checksum, so the SDK validates them.
+		sum := make([]byte, 4)
+		binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(o.data))
+		w.Header().Set("X-Amz-Checksum-Crc32", base64.StdEncoding.EncodeToString(sum))
+	}
+	if spec := r.Header.Get("Range"); spec != "" {
+		start, end, ok := parseRange(spec, int64(len(o.data)))
+		if !ok {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+		data, status = o.data[start:end+1], http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(o.data)))
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, bucket, key string) {
+	s.mu.Lock()
+	s.nextUpload++
+	id := strconv.Itoa(s.nextUpload)
+	s.uploads[id] = &upload{key: bucket + "/" + key, parts: make(map[int32][]byte)}
+	s.mu.Unlock()
+
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: bucket, Key: key, UploadId: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, query map[string][]string) {
+	number, err := strconv.Atoi(first(query["partNumber"]))
+	if err != nil || number < 1 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+		return
+	}
+
+	s.mu.Lock()
+	s.active++
+	s.maxActive = max(s.maxActive, s.active)
+	failing := s.failPart == int32(number)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+
+	// Give parallel part uploads a chance to overlap.
+	time.Sleep(10 * time.Millisecond)
+
+	data, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if failing {
+		writeError(w, http.StatusForbidden, "AccessDenied", "part upload refused")
+		return
+	}
+
+	s.mu.Lock()
+	u, ok := s.uploads[first(query["uploadId"])]
+	if ok {
+		u.parts[int32(number)] = data
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+
+	w.Header().Set("ETag", newObject(data).etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, bucket, name, id string) {
+	var request struct {
+		Parts []struct {
+			PartNumber int32
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+
+	var data []byte
+	for i, part := range request.Parts {
+		chunk, ok := u.parts[part.PartNumber]
+		if !ok || (i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber) {
+			writeError(w, http.StatusBadRequest, "InvalidPart", "parts are missing or out of order")
+			return
+		}
+		data = append(data, chunk...)
+	}
+	s.objects[name] = newObject(data)
+	delete(s.uploads, id)
+
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: bucket, Key: strings.TrimPrefix(name, bucket+"/"), ETag: s.objects[name].etag})
+}
+
+// list answers ListObjectsV2, continuing after the key in the continuation
+// token.
+func (s *Server) list(w http.ResponseWriter, bucket, prefix, token, maxKeys string) {
+	limit := 1000
+	if parsed, err := strconv.Atoi(maxKeys); err == nil && parsed > 0 {
+		limit = parsed
+	}
+
+	type content struct {
+		Key          string
+		Size         int64
+		ETag         string
+		LastModified string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}{Name: bucket, Prefix: prefix, MaxKeys: limit}
+
+	s.mu.Lock()
+	var keys []string
+	for name := range s.objects {
+		if key, ok := strings.CutPrefix(name, bucket+"/"); ok && strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if len(result.Contents) == limit {
+			result.IsTruncated = true
+			result.NextContinuationToken = result.Contents[limit-1].Key
+			break
+		}
+		o := s.objects[bucket+"/"+key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			Size:         int64(len(o.data)),
+			ETag:         o.etag,
+			LastModified: o.modified.Format(time.RFC3339),
+		})
+	}
+	s.mu.Unlock()
+
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+// readBody returns the request payload, decoding aws-chunked bodies the SDK
+// sends when it streams a checksum trailer.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") &&
+		!strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeField, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeField, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk size %q", sizeField)
+		}
+		if size == 0 {
+			// Trailers follow; they are not checked.
+			_, _ = io.Copy(io.Discard, reader)
+			return data, nil
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if _, err := reader.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func parseRange(spec string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(spec, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	from, to, _ := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if to != "" {
+		if end, err = strconv.ParseInt(to, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	_ = xml.NewEncoder(&body).Encode(v)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	_, _ = w.Write(body.Bytes())
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	_ = xml.NewEncoder(&body).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write(body.Bytes())
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bencleary/uploader"
+)
+
+// Ensure blob implements interface.
+var _ uploader.Blob = (*fileBlob)(nil)
+
+// fileBlob reads ranges of a local file with positioned reads, so concurrent
+// ranges share one open file.
+type fileBlob struct {
+	file *os.File
+	info os.FileInfo
+}
+
+func (b *fileBlob) Size() int64 {
+	return b.info.Size()
+}
+
+func (b *fileBlob) ModTime() time.Time {
+	return b.info.ModTime()
+}
+
+func (b *fileBlob) ReadRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if length < 0 {
+		length = b.info.Size() - offset
+	}
+	return io.NopCloser(io.NewSectionReader(b.file, offset, length)), nil
+}
+
+// seekableContent pairs decrypted content with the modification time of its
+// blob and closes the blob along with it.
+type seekableContent struct {
+	io.ReadSeekCloser
+	modTime time.Time
+	blob    io.Closer
+}
+
+func newSeekableContent(decrypted io.ReadSeekCloser, modTime time.Time, blob io.Closer) *seekableContent {
+	return &seekableContent{
+		ReadSeekCloser: decrypted,
+		modTime:        modTime,
+		blob:           blob,
+	}
+}
+
+func (c *seekableContent) ModTime() time.Time {
+	return c.modTime
+}
+
+func (c *seekableContent) Close() error {
+	return newChainedReadCloser(nil, c.ReadSeekCloser, c.blob).Close()
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/bencleary/uploader"
+	"github.com/google/uuid"
+)
+
+// CONTENT_DIRECTORY is the directory, or object key prefix, under which
+// content-addressed blobs are stored.
+const CONTENT_DIRECTORY = "content"
+
+// dedupLocks is the number of locks that content IDs are spread across.
+const dedupLocks = 64
+
+// contentBlobs is implemented by the backends that can store attachments as
+// content-addressed blobs.
+type contentBlobs interface {
+	// contentExists reports whether a variant of the blob contentID is stored.
+	contentExists(ctx context.Context, contentID string, preview bool) (bool, error)
+	// uploadFile encrypts the file at filePath and stores it as a variant of
+	// attachment.
+	uploadFile(ctx context.Context, attachment *uploader.Attachment, filePath string, preview bool, key string) error
+	// deleteContent deletes every variant of the blob contentID.
+	deleteContent(ctx context.Context, contentID string) error
+}
+
+// dedup stores attachments as content-addressed blobs that every attachment
+// with the same content, owner and key shares, with references recorded in an
+// uploader.BlobRefService. Attachments already stored under their UID are
+// unaffected. A blob is written by the first upload of its content and deleted
+// with its last reference. Locks are held per content ID while references
+// change so that an upload never relies on a blob that a concurrent delete is
+// removing; they only cover this process.
+type dedup struct {
+	refs  uploader.BlobRefService
+	locks [dedupLocks]sync.Mutex
+}
+
+func newDedup(refs uploader.BlobRefService) *dedup {
+	if refs == nil {
+		return nil
+	}
+	return &dedup{refs: refs}
+}
+
+// lock locks contentID and returns the function that unlocks it.
+func (d *dedup) lock(contentID string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(contentID))
+	mu := &d.locks[h.Sum32()%dedupLocks]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// upload stores attachment as a content-addressed blob, writing only the
+// variants that are not stored yet. It reports false, having stored nothing,
+// when ctx asks for an in-place upload or the encryption service cannot derive
+// content keys, so the caller should store the attachment under its UID
+// instead.
+func (d *dedup) upload(ctx context.Context, blobs contentBlobs, encryption uploader.EncryptionService, attachment *uploader.Attachment, key string) (bool, error) {
+	if uploader.InPlaceUpload(ctx) {
+		return false, nil
+	}
+
+	digests := make(map[bool]string)
+	content := sha256.New()
+	for _, preview := range []bool{false, true} {
+		filePath := attachment.GetLocalPath(variant(preview))
+		if filePath == "" {
+			continue
+		}
+		digest, err := fileDigest(filePath)
+		if err != nil {
+			return true, err
+		}
+		digests[preview] = digest
+		content.Write([]byte(variant(preview) + ":" + digest + "\n"))
+	}
+
+	contentID, err := encryption.ContentKey(ctx, attachment.EncryptionContext(uploader.VARIANT_ORIGINAL), content.Sum(nil), key)
+	if uploader.ErrorCode(err) == uploader.NOTIMPLEMENTED {
+		return false, nil
+	} else if err != nil {
+		return true, err
+	}
+
+	unlock := d.lock(contentID)
+	defer unlock()
+
+	if err := d.refs.AddRef(contentID, attachment.UID); err != nil {
+		return true, err
+	}
+	attachment.ContentID = contentID
+
+	for _, preview := range []bool{false, true} {
+		filePath := attachment.GetLocalPath(variant(preview))
+		if filePath == "" {
+			continue
+		}
+		exists, err := blobs.contentExists(ctx, contentID, preview)
+		if err == nil && !exists {
+			err = blobs.uploadFile(ctx, attachment, filePath, preview, key)
+		}
+		if err != nil {
+			attachment.ContentID = ""
+			if releaseErr := d.release(ctx, blobs, contentID, attachment.UID); releaseErr != nil {
+				return true, releaseErr
+			}
+			return true, err
+		}
+		attachment.SetDigest(variant(preview), digests[preview])
+	}
+	return true, nil
+}
+
+// delete drops the attachment's reference to its blob, deleting the blob with
+// the last reference. It reports false when the attachment does not reference a
+// blob.
+func (d *dedup) delete(ctx context.Context, blobs contentBlobs, attachmentUID string) (bool, error) {
+	uid, err := uuid.Parse(attachmentUID)
+	if err != nil {
+		return false, nil
+	}
+
+	contentID, err := d.refs.Ref(uid)
+	if err != nil || contentID == "" {
+		return false, err
+	}
+
+	unlock := d.lock(contentID)
+	defer unlock()
+	return true, d.release(ctx, blobs, contentID, uid)
+}
+
+// release removes uid's reference to contentID. When it is the last reference
+// the blob is deleted first, so a failed deletion can be retried. The caller
+// holds the lock for contentID.
+func (d *dedup) release(ctx context.Context, blobs contentBlobs, contentID string, uid uuid.UUID) error {
+	refs, err := d.refs.Refs(contentID)
+	if err != nil {
+		return err
+	}
+	if refs <= 1 {
+		if err := blobs.deleteContent(ctx, contentID); err != nil {
+			return err
+		}
+	}
+	return d.refs.RemoveRef(uid)
+}
+
+// fileDigest returns the hex encoded SHA-256 of the file at path.
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hashing := newHashingReader(file)
+	if _, err := io.Copy(io.Discard, hashing); err != nil {
+		return "", err
+	}
+	return hashing.Digest(), nil
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/s3test"
+)
+
+// dedupStorage is a backend that can store content-addressed blobs.
+type dedupStorage interface {
+	uploader.StorageService
+	SetDedup(refs uploader.BlobRefService)
+}
+
+func newBlobRefs(t *testing.T) uploader.BlobRefService {
+	t.Helper()
+
+	database, err := db.NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err := database.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+	return db.NewSqliteBlobRefService(database)
+}
+
+func TestDedup(t *testing.T) {
+	backends := []struct {
+		name string
+		// open returns the storage and a function counting its stored blobs.
+		open func(t *testing.T) (dedupStorage, func() int)
+	}{
+		{"local", func(t *testing.T) (dedupStorage, func() int) {
+			uploadDir := t.TempDir()
+			storage := NewLocalStorage(uploadDir, t.TempDir(), encryption.NewAESService(keystore.NewInMemoryKeyStore()))
+			if err := storage.Initialise(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			return storage, func() int {
+				blobs, err := filepath.Glob(filepath.Join(uploadDir, "*", "*", "*.enc"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				more, err := filepath.Glob(filepath.Join(uploadDir, "*", "*.enc"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return len(blobs) + len(more)
+			}
+		}},
+		{"s3", func(t *testing.T) (dedupStorage, func() int) {
+			server := s3test.NewServer()
+			t.Cleanup(server.Close)
+			return newFakeS3Storage(t, server, 2), func() int {
+				return len(server.Keys("uploader"))
+			}
+		}},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			ctx := context.Background()
+			storage, blobs := backend.open(t)
+			storage.SetDedup(newBlobRefs(t))
+
+			meme := bytes.Repeat([]byte("meme"), encryption.CHUNK_SIZE/2)
+			upload := func(contents []byte, key string) *uploader.Attachment {
+				t.Helper()
+				attachment, err := storage.Hold(ctx, createMultipartFileHeader(t, "file", "meme.png", contents))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := attachment.CopyFileToPath(attachment.CreatePreviewLocalPath()); err != nil {
+					t.Fatal(err)
+				}
+				if err := storage.Upload(ctx, attachment, key); err != nil {
+					t.Fatal(err)
+				}
+				return attachment
+			}
+			download := func(attachment *uploader.Attachment, preview bool, key string) ([]byte, error) {
+				t.Helper()
+				reader, err := storage.Download(ctx, attachment, preview, key)
+				if err != nil {
+					return nil, err
+				}
+				defer reader.Close()
+				return io.ReadAll(reader)
+			}
+
+			const aliceKey, bobKey = "alicealicealicealicealicealice12", "bobbobbobbobbobbobbobbobbobbob12"
+			first := upload(meme, aliceKey)
+			second := upload(meme, aliceKey)
+			bob := upload(meme, bobKey)
+			other := upload([]byte("something else"), aliceKey)
+
+			if first.ContentID == "" || first.ContentID != second.ContentID {
+				t.Fatalf("expected the same content ID, got %q and %q", first.ContentID, second.ContentID)
+			}
+			if other.ContentID == first.ContentID {
+				t.Fatal("different content must not share a blob")
+			}
+			// The data key is derived from the uploader's key, so another key
+			// gets a blob of its own.
+			if bob.ContentID == first.ContentID {
+				t.Fatal("uploads under different keys must not share a blob")
+			}
+			if strings.Contains(first.ContentID, first.Digest) {
+				t.Fatal("content ID must not reveal the plaintext digest")
+			}
+			// An original and a preview for each of the three blobs.
+			if count := blobs(); count != 6 {
+				t.Fatalf("expected 6 blobs, got %d", count)
+			}
+
+			for _, attachment := range []struct {
+				*uploader.Attachment
+				key string
+			}{{first, aliceKey}, {second, aliceKey}, {bob, bobKey}} {
+				for _, preview := range []bool{false, true} {
+					downloaded, err := download(attachment.Attachment, preview, attachment.key)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(downloaded, meme) {
+						t.Fatal("downloaded content does not match upload")
+					}
+				}
+			}
+			if _, err := download(second, false, bobKey); uploader.ErrorCode(err) != uploader.UNAUTHORIZED {
+				t.Fatalf("expected unauthorized with another key, got %v", err)
+			}
+
+			// The blob outlives the first reference and goes with the last.
+			if err := storage.Delete(ctx, first.UID.String()); err != nil {
+				t.Fatal(err)
+			}
+			if downloaded, err := download(second, false, aliceKey); err != nil || !bytes.Equal(downloaded, meme) {
+				t.Fatalf("expected the shared blob to survive, got %v", err)
+			}
+			if err := storage.Delete(ctx, second.UID.String()); err != nil {
+				t.Fatal(err)
+			}
+			if count := blobs(); count != 4 {
+				t.Fatalf("expected only the other blobs to remain, got %d blobs", count)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	"github.com/bencleary/uploader"
+)
+
+// digestMismatch is returned instead of the final bytes of a variant whose
+// plaintext does not match its recorded digest.
+func digestMismatch(attachment *uploader.Attachment, variant string) error {
+	return uploader.Errorf(uploader.INTERNAL, "%s of %s does not match its recorded digest", variant, attachment.UID)
+}
+
+// verifyingReader hashes plaintext as it is read. It looks one byte ahead so it
+// can check the digest before handing out the last bytes, which means a corrupt
+// file never reaches the caller in full.
+type verifyingReader struct {
+	src      *bufio.Reader
+	hash     hash.Hash
+	expected string
+	mismatch error
+	err      error
+}
+
+// newVerifyingReader verifies reader against the recorded digest of variant.
+// Attachments without a recorded digest are returned unchanged.
+func newVerifyingReader(reader io.Reader, attachment *uploader.Attachment, variant string) io.Reader {
+	expected := attachment.GetDigest(variant)
+	if expected == "" {
+		return reader
+	}
+	return &verifyingReader{
+		src:      bufio.NewReader(reader),
+		hash:     sha256.New(),
+		expected: expected,
+		mismatch: digestMismatch(attachment, variant),
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.src.Read(p)
+	r.hash.Write(p[:n])
+	if err == nil {
+		if _, peekErr := r.src.Peek(1); peekErr != nil {
+			err = peekErr
+		}
+	}
+
+	if err == io.EOF && hex.EncodeToString(r.hash.Sum(nil)) != r.expected {
+		r.err = r.mismatch
+		return 0, r.err
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// verifyingContent hashes seekable content while it is read in order from the
+// start, which is how full downloads read it, and checks the digest before
+// returning the last bytes. Reads after a seek elsewhere are not verified.
+type verifyingContent struct {
+	uploader.SeekableContent
+	hash     hash.Hash
+	expected string
+	mismatch error
+	size     int64
+	offset   int64
+	hashed   int64
+}
+
+// newVerifyingContent verifies content against the recorded digest of variant.
+// Attachments without a recorded digest are returned unchanged.
+func newVerifyingContent(content uploader.SeekableContent, attachment *uploader.Attachment, variant string) (uploader.SeekableContent, error) {
+	expected := attachment.GetDigest(variant)
+	if expected == "" {
+		return content, nil
+	}
+
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &verifyingContent{
+		SeekableContent: content,
+		hash:            sha256.New(),
+		expected:        expected,
+		mismatch:        digestMismatch(attachment, variant),
+		size:            size,
+	}, nil
+}
+
+func (c *verifyingContent) Read(p []byte) (int, error) {
+	n, err := c.SeekableContent.Read(p)
+	if c.offset == c.hashed {
+		c.hash.Write(p[:n])
+		c.hashed += int64(n)
+		if c.hashed == c.size && n > 0 && hex.EncodeToString(c.hash.Sum(nil)) != c.expected {
+			return 0, c.mismatch
+		}
+	}
+	c.offset += int64(n)
+	return n, err
+}
+
+func (c *verifyingContent) Seek(offset int64, whence int) (int64, error) {
+	position, err := c.SeekableContent.Seek(offset, whence)
+	if err == nil {
+		c.offset = position
+	}
+	return position, err
+}
+
+// hashingReader hashes everything read through it.
+type hashingReader struct {
+	reader io.Reader
+	hash   hash.Hash
+}
+
+func newHashingReader(reader io.Reader) *hashingReader {
+	return &hashingReader{reader: reader, hash: sha256.New()}
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	return n, err
+}
+
+// Digest returns the hex encoded SHA-256 of everything read so far.
+func (r *hashingReader) Digest() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
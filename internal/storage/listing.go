@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"strings"
+
+	"github.com/bencleary/uploader"
+	"github.com/google/uuid"
+)
+
+// QUARANTINE_DIRECTORY is the directory, or object key prefix, that
+// quarantined blobs are moved to, keeping their path below it.
+const QUARANTINE_DIRECTORY = "quarantine"
+
+// storedBlob recognises a blob from its file name and the directory it is in,
+// relative to where the backend stores attachment blobs: "" for blobs named
+// after their attachment UID, or CONTENT_DIRECTORY for content-addressed ones.
+func storedBlob(directory, fileName string) (uploader.StoredBlob, bool) {
+	stem, preview := strings.CutSuffix(fileName, ".preview.enc")
+	if !preview {
+		var ok bool
+		if stem, ok = strings.CutSuffix(fileName, ".enc"); !ok {
+			return uploader.StoredBlob{}, false
+		}
+	}
+	if stem == "" {
+		return uploader.StoredBlob{}, false
+	}
+
+	switch directory {
+	case "":
+		if uid, err := uuid.Parse(stem); err != nil || uid.String() != stem {
+			return uploader.StoredBlob{}, false
+		}
+		return uploader.StoredBlob{UID: stem, Preview: preview}, true
+	case CONTENT_DIRECTORY:
+		return uploader.StoredBlob{ContentID: stem, Preview: preview}, true
+	}
+	return uploader.StoredBlob{}, false
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/s3test"
+)
+
+// listingStorage is a backend that can list its blobs.
+type listingStorage interface {
+	uploader.StorageService
+	uploader.BlobLister
+}
+
+func TestListBlobs(t *testing.T) {
+	backends := []struct {
+		name string
+		// open returns the storage, a function that stores a stray file next to
+		// the blobs, and one that reports whether a quarantined blob is kept.
+		open func(t *testing.T) (listingStorage, func(name string), func(blob uploader.StoredBlob) bool)
+	}{
+		{"local", func(t *testing.T) (listingStorage, func(string), func(uploader.StoredBlob) bool) {
+			uploadDir := t.TempDir()
+			storage := NewLocalStorage(uploadDir, t.TempDir(), encryption.NewAESService(keystore.NewInMemoryKeyStore()))
+			if err := storage.Initialise(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			stray := func(name string) {
+				path := filepath.Join(uploadDir, name)
+				if err := os.MkdirAll(filepath.Dir(path), DIRECTORY_PERMISSIONS); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("stray"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			quarantined := func(blob uploader.StoredBlob) bool {
+				relative, err := filepath.Rel(uploadDir, blob.Key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = os.Stat(filepath.Join(uploadDir, QUARANTINE_DIRECTORY, relative))
+				return err == nil
+			}
+			return storage, stray, quarantined
+		}},
+		{"s3", func(t *testing.T) (listingStorage, func(string), func(uploader.StoredBlob) bool) {
+			server := s3test.NewServer()
+			t.Cleanup(server.Close)
+			storage := newFakeS3Storage(t, server, 2)
+			stray := func(name string) {
+				server.PutObject("uploader", storage.root()+name, []byte("stray"))
+			}
+			quarantined := func(blob uploader.StoredBlob) bool {
+				_, ok := server.Object("uploader", storage.root()+QUARANTINE_DIRECTORY+"/"+strings.TrimPrefix(blob.Key, storage.root()))
+				return ok
+			}
+			return storage, stray, quarantined
+		}},
+	}
+
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			ctx := context.Background()
+			storage, stray, quarantined := backend.open(t)
+
+			attachment, err := storage.Hold(ctx, createMultipartFileHeader(t, "file", "listed.png", []byte("listed")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := attachment.CopyFileToPath(attachment.CreatePreviewLocalPath()); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.Upload(ctx, attachment, "listlistlistlistlistlistlistli12"); err != nil {
+				t.Fatal(err)
+			}
+			stray("notes.txt")
+			stray("not-a-uid.enc")
+
+			blobs, err := storage.ListBlobs(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blobs) != 2 {
+				t.Fatalf("expected the original and preview, got %+v", blobs)
+			}
+			for _, blob := range blobs {
+				if blob.UID != attachment.UID.String() || blob.Size == 0 || blob.ModTime.IsZero() {
+					t.Fatalf("unexpected blob %+v", blob)
+				}
+			}
+			if blobs[0].Preview == blobs[1].Preview {
+				t.Fatal("expected one original and one preview")
+			}
+
+			if err := storage.QuarantineBlob(ctx, blobs[0]); err != nil {
+				t.Fatal(err)
+			}
+			if !quarantined(blobs[0]) {
+				t.Fatal("expected the quarantined blob to be kept")
+			}
+			remaining, err := storage.ListBlobs(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(remaining) != 1 || remaining[0].Key != blobs[1].Key {
+				t.Fatalf("expected only %s to be listed, got %+v", blobs[1].Key, remaining)
+			}
+		})
+	}
+}
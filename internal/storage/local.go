@@ -4,15 +4,22 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime/multipart"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/bencleary/uploader"
 	"github.com/google/uuid"
 )
 
+var _ uploader.StorageService = (*LocalStorage)(nil)
+var _ uploader.BlobStore = (*LocalStorage)(nil)
+var _ uploader.BlobLister = (*LocalStorage)(nil)
+var _ uploader.Stager = (*LocalStorage)(nil)
+
 const (
 	// DIRECTORY_PERMISSIONS represents the directory permission mode.
 	DIRECTORY_PERMISSIONS = 0755
@@ -23,6 +30,7 @@ type LocalStorage struct {
 	directory  string
 	vault      string
 	encryption uploader.EncryptionService
+	dedup      *dedup
 }
 
 // NewLocalStorage creates a new instance of LocalStorage.
@@ -38,6 +46,12 @@ func NewLocalStorage(uploadPath, vaultPath string, encryptionService uploader.En
 	}
 }
 
+// SetDedup turns on dedup for new uploads, storing shared blobs under content/
+// in the upload directory.
+func (l *LocalStorage) SetDedup(refs uploader.BlobRefService) {
+	l.dedup = newDedup(refs)
+}
+
 // Initialise creates the necessary directories if they don't exist.
 func (l *LocalStorage) Initialise(ctx context.Context) error {
 	directories := []string{l.directory, l.vault}
@@ -57,12 +71,33 @@ func (l *LocalStorage) Initialise(ctx context.Context) error {
 	return nil
 }
 
-// Hold stores the uploaded file in the vault directory.
+// Hold stores the uploaded file in the vault directory. Nothing is left behind
+// if it fails.
 func (l *LocalStorage) Hold(ctx context.Context, file *multipart.FileHeader) (*uploader.Attachment, error) {
-	vaultID, err := uuid.NewUUID()
+	contents, err := file.Open()
 	if err != nil {
 		return nil, err
 	}
+	defer contents.Close()
+
+	vaultPath, err := l.Stage(ctx, file.Filename, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	attachment := uploader.NewAttachment(file, uploader.DEFAULT_OWNER_ID)
+	attachment.LocalPath = vaultPath
+
+	return attachment, nil
+}
+
+// Stage writes src to fileName in a new vault directory. Nothing is left
+// behind if it fails.
+func (l *LocalStorage) Stage(ctx context.Context, fileName string, src io.Reader) (string, error) {
+	vaultID, err := uuid.NewUUID()
+	if err != nil {
+		return "", err
+	}
 
 	vaultDir := filepath.Join(l.vault, vaultID.String())
 
@@ -70,34 +105,110 @@ func (l *LocalStorage) Hold(ctx context.Context, file *multipart.FileHeader) (*u
 	if os.IsNotExist(err) {
 		err = os.MkdirAll(vaultDir, DIRECTORY_PERMISSIONS)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 		fmt.Println("Directory created:", vaultDir)
 	} else if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	vaultPath := filepath.Join(vaultDir, filepath.Base(fileName))
+	if err := writeHeldFile(vaultPath, src); err != nil {
+		_ = os.RemoveAll(vaultDir)
+		return "", err
 	}
+	return vaultPath, nil
+}
 
-	vaultPath := filepath.Join(vaultDir, file.Filename)
-	dst, err := os.Create(vaultPath)
+// writeHeldFile copies src to path.
+func writeHeldFile(path string, src io.Reader) error {
+	dst, err := os.Create(path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer dst.Close()
 
-	contents, err := file.Open()
-	if err != nil {
-		return nil, err
+	if _, err = io.Copy(dst, src); err != nil {
+		return err
 	}
-	defer contents.Close()
+	return dst.Close()
+}
+
+// Release deletes the vault directory that Hold created for attachment.
+func (l *LocalStorage) Release(ctx context.Context, attachment *uploader.Attachment) error {
+	if attachment == nil || attachment.LocalPath == "" {
+		return nil
+	}
+
+	directory := filepath.Dir(attachment.LocalPath)
+	if relative, err := filepath.Rel(l.vault, directory); err != nil || !filepath.IsLocal(relative) || filepath.Base(relative) != relative {
+		return uploader.Errorf(uploader.INVALID, "%s was not staged in the vault", attachment.LocalPath)
+	}
+	return os.RemoveAll(directory)
+}
 
-	if _, err = io.Copy(dst, contents); err != nil {
+// SweepStaging deletes the vault directories whose newest file was modified
+// before cutoff.
+func (l *LocalStorage) SweepStaging(ctx context.Context, cutoff time.Time) (*uploader.StagingSweep, error) {
+	// An empty vault path stages uploads in the working directory.
+	vault := l.vault
+	if vault == "" {
+		vault = "."
+	}
+	entries, err := os.ReadDir(vault)
+	if err != nil {
 		return nil, err
 	}
 
-	attachment := uploader.NewAttachment(file, 1)
-	attachment.LocalPath = vaultPath
+	sweep := &uploader.StagingSweep{}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return sweep, err
+		}
+		// Hold names vault directories after a UUID; anything else is not ours.
+		if _, err := uuid.Parse(entry.Name()); err != nil || !entry.IsDir() {
+			continue
+		}
 
-	return attachment, nil
+		directory := filepath.Join(vault, entry.Name())
+		modified, size, err := directoryUsage(directory)
+		if err != nil {
+			return sweep, err
+		}
+		if !modified.Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(directory); err != nil {
+			return sweep, err
+		}
+		sweep.Directories++
+		sweep.Bytes += size
+	}
+	return sweep, nil
+}
+
+// directoryUsage returns when anything in directory, or directory itself, was
+// last modified and the total size of its files.
+func directoryUsage(directory string) (time.Time, int64, error) {
+	var modified time.Time
+	var size int64
+	err := filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		if !entry.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return modified, size, err
 }
 
 // Download retrieves an encrypted attachment from the local storage, decrypts it using the specified key,
@@ -126,78 +237,271 @@ func (l *LocalStorage) Hold(ctx context.Context, file *multipart.FileHeader) (*u
 //	defer reader.Close()
 //	Use the reader to access the decrypted content.
 func (l *LocalStorage) Download(ctx context.Context, attachment *uploader.Attachment, preview bool, key string) (io.ReadCloser, error) {
-	storagePath := filepath.Join(l.directory, attachment.UID.String())
-
-	var filePath string
-	if preview {
-		filePath = filepath.Join(storagePath, attachment.UID.String()) + ".preview.enc"
-	} else {
-		filePath = filepath.Join(storagePath, attachment.UID.String()) + ".enc"
+	ctx, err := checkKey(ctx, l.encryption, attachment, preview, key)
+	if err != nil {
+		return nil, err
 	}
 
-	source, err := os.Open(filePath)
+	source, err := l.openBlob(attachment, preview)
 	if err != nil {
 		return nil, err
 	}
 
-	decrypted, err := l.encryption.DecryptStream(ctx, source, key)
+	decrypted, err := l.encryption.DecryptStream(ctx, source, attachment.EncryptionContext(variant(preview)), key)
 	if err != nil {
 		_ = source.Close()
 		return nil, err
 	}
 
-	return newChainedReadCloser(decrypted, decrypted, source), nil
+	return newChainedReadCloser(newVerifyingReader(decrypted, attachment, variant(preview)), decrypted, source), nil
+}
+
+// Open returns the decrypted attachment as a seekable reader that reads only
+// the parts of the blob it needs.
+func (l *LocalStorage) Open(ctx context.Context, attachment *uploader.Attachment, preview bool, key string) (uploader.SeekableContent, error) {
+	ctx, err := checkKey(ctx, l.encryption, attachment, preview, key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := l.openBlob(attachment, preview)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	decrypted, err := l.encryption.DecryptBlob(ctx, &fileBlob{file: file, info: info}, attachment.EncryptionContext(variant(preview)), key)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	content, err := newVerifyingContent(newSeekableContent(decrypted, info.ModTime(), file), attachment, variant(preview))
+	if err != nil {
+		_ = decrypted.Close()
+		_ = file.Close()
+		return nil, err
+	}
+	return content, nil
+}
+
+// openBlob opens the encrypted blob for an attachment variant, failing with
+// NOTFOUND when it is not stored.
+func (l *LocalStorage) openBlob(attachment *uploader.Attachment, preview bool) (*os.File, error) {
+	file, err := os.Open(l.blobPath(attachment, preview))
+	if os.IsNotExist(err) {
+		return nil, uploader.Errorf(uploader.NOTFOUND, "%s of %s is not stored", variant(preview), attachment.UID)
+	}
+	return file, err
+}
+
+// blobPath returns the path of the encrypted blob for an attachment variant.
+func (l *LocalStorage) blobPath(attachment *uploader.Attachment, preview bool) string {
+	if attachment.ContentID != "" {
+		return l.contentPath(attachment.ContentID, preview)
+	}
+	uid := attachment.UID.String()
+	if preview {
+		return filepath.Join(l.directory, uid, uid) + ".preview.enc"
+	}
+	return filepath.Join(l.directory, uid, uid) + ".enc"
+}
+
+// contentPath returns the path of a variant of a content-addressed blob.
+func (l *LocalStorage) contentPath(contentID string, preview bool) string {
+	if preview {
+		return filepath.Join(l.directory, CONTENT_DIRECTORY, contentID, contentID) + ".preview.enc"
+	}
+	return filepath.Join(l.directory, CONTENT_DIRECTORY, contentID, contentID) + ".enc"
 }
 
-// Delete removes a folder and its contents based on its unique identifier.
+// Delete removes a folder and its contents based on its unique identifier. An
+// attachment stored as a content-addressed blob only drops its reference; the
+// blob is removed with the last one.
 func (l *LocalStorage) Delete(ctx context.Context, attachmentUID string) error {
+	if l.dedup != nil {
+		if deleted, err := l.dedup.delete(ctx, l, attachmentUID); deleted || err != nil {
+			return err
+		}
+	}
 	return os.RemoveAll(filepath.Join(l.directory, attachmentUID))
 }
 
+func (l *LocalStorage) contentExists(ctx context.Context, contentID string, preview bool) (bool, error) {
+	_, err := os.Stat(l.contentPath(contentID, preview))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *LocalStorage) deleteContent(ctx context.Context, contentID string) error {
+	return os.RemoveAll(filepath.Join(l.directory, CONTENT_DIRECTORY, contentID))
+}
+
 // uploadFile encrypts and uploads a file.
-func (l *LocalStorage) uploadFile(ctx context.Context, destinationPath string, uid, filePath, key string) error {
+func (l *LocalStorage) uploadFile(ctx context.Context, attachment *uploader.Attachment, filePath string, preview bool, key string) error {
 	source, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer source.Close()
 
-	encrypted, err := l.encryption.EncryptStream(ctx, source, key)
+	plaintext := newHashingReader(source)
+	encrypted, err := l.encryption.EncryptStream(ctx, plaintext, attachment.EncryptionContext(variant(preview)), key)
+	if err != nil {
+		return err
+	}
+	defer encrypted.Close()
+
+	if err := writeFile(l.blobPath(attachment, preview), encrypted); err != nil {
+		return err
+	}
+
+	attachment.SetDigest(variant(preview), plaintext.Digest())
+	return nil
+}
+
+// ReadBlob returns the stored ciphertext of an attachment variant and its size.
+func (l *LocalStorage) ReadBlob(ctx context.Context, attachment *uploader.Attachment, preview bool) (io.ReadCloser, int64, error) {
+	file, err := l.openBlob(attachment, preview)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
 	if err != nil {
+		_ = file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// StatBlob returns the size of the stored ciphertext of an attachment variant.
+func (l *LocalStorage) StatBlob(ctx context.Context, attachment *uploader.Attachment, preview bool) (int64, error) {
+	info, err := os.Stat(l.blobPath(attachment, preview))
+	if os.IsNotExist(err) {
+		return 0, uploader.Errorf(uploader.NOTFOUND, "%s of %s is not stored", variant(preview), attachment.UID)
+	} else if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// WriteBlob stores ciphertext as an attachment variant as it is.
+func (l *LocalStorage) WriteBlob(ctx context.Context, attachment *uploader.Attachment, preview bool, ciphertext io.Reader) error {
+	return writeFile(l.blobPath(attachment, preview), ciphertext)
+}
+
+// ListBlobs returns every blob in the upload directory.
+func (l *LocalStorage) ListBlobs(ctx context.Context) ([]uploader.StoredBlob, error) {
+	var blobs []uploader.StoredBlob
+	err := filepath.WalkDir(l.directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(l.directory, path)
+		if err != nil {
+			return err
+		}
+		// Blobs are stored as <uid>/<uid>.enc or content/<id>/<id>.enc.
+		var blob uploader.StoredBlob
+		var ok bool
+		switch parts := strings.Split(filepath.ToSlash(relative), "/"); len(parts) {
+		case 2:
+			blob, ok = storedBlob("", parts[1])
+			ok = ok && blob.UID == parts[0]
+		case 3:
+			blob, ok = storedBlob(parts[0], parts[2])
+			ok = ok && blob.ContentID == parts[1]
+		}
+		if !ok {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		blob.Key = path
+		blob.Size = info.Size()
+		blob.ModTime = info.ModTime()
+		blobs = append(blobs, blob)
+		return nil
+	})
+	return blobs, err
+}
+
+// QuarantineBlob moves a blob into the quarantine directory inside the upload
+// directory.
+func (l *LocalStorage) QuarantineBlob(ctx context.Context, blob uploader.StoredBlob) error {
+	relative, err := filepath.Rel(l.directory, blob.Key)
+	if err != nil || !filepath.IsLocal(relative) {
+		return uploader.Errorf(uploader.INVALID, "%s is not in the upload directory", blob.Key)
+	}
+
+	quarantined := filepath.Join(l.directory, QUARANTINE_DIRECTORY, relative)
+	if err := getOrCreateDirectory(filepath.Dir(quarantined)); err != nil {
+		return err
+	}
+	if err := os.Rename(blob.Key, quarantined); err != nil {
 		return err
 	}
+	// The blob's directory is removed once it is empty.
+	_ = os.Remove(filepath.Dir(blob.Key))
+	return nil
+}
 
-	var fileName string
-	if strings.Contains(filePath, "preview") {
-		fileName = fmt.Sprintf("%s.preview.enc", uid)
-	} else {
-		fileName = fmt.Sprintf("%s.enc", uid)
+// writeFile writes src next to path and renames it into place, so an existing
+// file is only replaced once the new one is complete.
+func writeFile(path string, src io.Reader) error {
+	directory, fileName := filepath.Split(path)
+	if err := getOrCreateDirectory(directory); err != nil {
+		return err
 	}
 
-	uploadPath := filepath.Join(destinationPath, fileName)
-	dst, err := os.Create(uploadPath)
+	dst, err := os.CreateTemp(directory, fileName+".*.tmp")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(dst.Name())
 	defer dst.Close()
 
-	if _, err = io.Copy(dst, encrypted); err != nil {
+	if _, err = io.Copy(dst, src); err != nil {
 		return err
 	}
-	return nil
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dst.Name(), path)
 }
 
 // Upload encrypts and stores files in the specified directory.
 func (l *LocalStorage) Upload(ctx context.Context, attachment *uploader.Attachment, key string) error {
-	finalPath := filepath.Join(l.directory, attachment.UID.String())
-	err := getOrCreateDirectory(finalPath)
-	if err != nil {
-		return err
+	if l.dedup != nil {
+		if stored, err := l.dedup.upload(ctx, l, l.encryption, attachment, key); stored || err != nil {
+			return err
+		}
 	}
 
-	for _, filePath := range attachment.GetFilePaths() {
-		err := l.uploadFile(ctx, finalPath, attachment.UID.String(), filePath, key)
-		if err != nil {
+	for _, preview := range []bool{false, true} {
+		filePath := attachment.GetLocalPath(variant(preview))
+		if filePath == "" {
+			continue
+		}
+		if err := l.uploadFile(ctx, attachment, filePath, preview, key); err != nil {
 			return err
 		}
 	}
@@ -208,7 +512,7 @@ func (l *LocalStorage) Upload(ctx context.Context, attachment *uploader.Attachme
 // getOrCreateDirectory creates the directory if it doesn't exist.
 func getOrCreateDirectory(path string) error {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		if err := os.Mkdir(path, DIRECTORY_PERMISSIONS); err != nil {
+		if err := os.MkdirAll(path, DIRECTORY_PERMISSIONS); err != nil {
 			return err
 		}
 	} else if err != nil {
@@ -216,3 +520,22 @@ func getOrCreateDirectory(path string) error {
 	}
 	return nil
 }
+
+// variant names the blob variant that a preview flag refers to.
+func variant(preview bool) string {
+	if preview {
+		return uploader.VARIANT_PREVIEW
+	}
+	return uploader.VARIANT_ORIGINAL
+}
+
+// checkKey rejects a wrong key before any blob I/O. The context it returns
+// keeps the key unwrapped by the check, so decrypting with it does not unwrap
+// the key, or stretch a passphrase, a second time.
+func checkKey(ctx context.Context, encryption uploader.EncryptionService, attachment *uploader.Attachment, preview bool, key string) (context.Context, error) {
+	ctx = uploader.WithKeyCache(ctx)
+	if err := encryption.CheckKey(ctx, attachment.EncryptionContext(variant(preview)), key); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
@@ -3,6 +3,8 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"image"
 	"image/png"
 	"io"
@@ -10,9 +12,13 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/bencleary/uploader"
 	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
 )
 
 func createMultipartFileHeader(t *testing.T, fieldName, filename string, contents []byte) *multipart.FileHeader {
@@ -97,3 +103,304 @@ func TestLocalStorageHold(t *testing.T) {
 	}
 
 }
+
+func TestLocalStorageRelease(t *testing.T) {
+	ctx := context.Background()
+	vaultDir := t.TempDir()
+	storage := NewLocalStorage(t.TempDir(), vaultDir, encryption.NewAESService(nil))
+
+	attachment, err := storage.Hold(ctx, createMultipartFileHeader(t, "file", "test.png", []byte("staged")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := attachment.CopyFileToPath(attachment.CreatePreviewLocalPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Release(ctx, attachment); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(vaultDir); err != nil || len(entries) != 0 {
+		t.Fatalf("expected an empty vault, got %v, %v", entries, err)
+	}
+
+	outside := &uploader.Attachment{LocalPath: filepath.Join(t.TempDir(), "test.png")}
+	if err := storage.Release(ctx, outside); uploader.ErrorCode(err) != uploader.INVALID {
+		t.Fatalf("expected files outside the vault to be refused, got %v", err)
+	}
+}
+
+func TestLocalStorageSweepStaging(t *testing.T) {
+	ctx := context.Background()
+	vaultDir := t.TempDir()
+	storage := NewLocalStorage(t.TempDir(), vaultDir, encryption.NewAESService(nil))
+
+	stale, err := storage.Hold(ctx, createMultipartFileHeader(t, "file", "stale.png", []byte("stale")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.CopyFileToPath(stale.CreatePreviewLocalPath()); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := storage.Hold(ctx, createMultipartFileHeader(t, "file", "fresh.png", []byte("fresh")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not staged by Hold, so never swept.
+	if err := os.Mkdir(filepath.Join(vaultDir, "keep"), DIRECTORY_PERMISSIONS); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, path := range []string{stale.LocalPath, stale.PreviewLocalPath, filepath.Dir(stale.LocalPath), filepath.Join(vaultDir, "keep")} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sweep, err := storage.SweepStaging(ctx, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sweep.Directories != 1 || sweep.Bytes != int64(2*len("stale")) {
+		t.Fatalf("expected the stale upload and its preview to be swept, got %+v", sweep)
+	}
+	if _, err := os.Stat(filepath.Dir(stale.LocalPath)); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale upload to be gone, got %v", err)
+	}
+	for _, path := range []string{fresh.LocalPath, filepath.Join(vaultDir, "keep")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLocalStorageUploadDownload(t *testing.T) {
+	aes := encryption.NewAESService(nil)
+	uploadDir := t.TempDir()
+	vaultDir := t.TempDir()
+	storage := NewLocalStorage(uploadDir, vaultDir, aes)
+	key := "12345678901234567890123456789012"
+
+	if err := storage.Initialise(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Larger than a single encryption segment so the streaming path is exercised.
+	contents := bytes.Repeat([]byte("uploader"), encryption.CHUNK_SIZE/4)
+	fileHeader := createMultipartFileHeader(t, "file", "test.png", contents)
+
+	attachment, err := storage.Hold(context.Background(), fileHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := attachment.CopyFileToPath(attachment.CreatePreviewLocalPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Upload(context.Background(), attachment, key); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := storage.Download(context.Background(), attachment, false, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	downloaded, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, contents) {
+		t.Fatal("downloaded content does not match upload")
+	}
+}
+
+func TestLocalStorageRejectsSwappedBlob(t *testing.T) {
+	aes := encryption.NewAESService(nil)
+	uploadDir := t.TempDir()
+	storage := NewLocalStorage(uploadDir, t.TempDir(), aes)
+	key := "12345678901234567890123456789012"
+
+	if err := storage.Initialise(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	attachment, err := storage.Hold(context.Background(), createMultipartFileHeader(t, "file", "test.png", []byte("original")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := attachment.CopyFileToPath(attachment.CreatePreviewLocalPath()); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Upload(context.Background(), attachment, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the original with the preview blob, as an attacker with access
+	// to storage could.
+	dir := filepath.Join(uploadDir, attachment.UID.String())
+	preview, err := os.ReadFile(filepath.Join(dir, attachment.UID.String()+".preview.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, attachment.UID.String()+".enc"), preview, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := storage.Download(context.Background(), attachment, false, key); err == nil {
+		t.Fatal("expected swapped blob to fail to decrypt")
+	}
+}
+
+func TestLocalStorageOpenSeeks(t *testing.T) {
+	aes := encryption.NewAESService(nil)
+	storage := NewLocalStorage(t.TempDir(), t.TempDir(), aes)
+	key := "12345678901234567890123456789012"
+
+	if err := storage.Initialise(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := bytes.Repeat([]byte("0123456789"), encryption.CHUNK_SIZE/2)
+	attachment, err := storage.Hold(context.Background(), createMultipartFileHeader(t, "file", "test.png", contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Upload(context.Background(), attachment, key); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := storage.Open(context.Background(), attachment, false, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+
+	offset := int64(2*encryption.CHUNK_SIZE + 3)
+	if _, err := content.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 20)
+	if _, err := io.ReadFull(content, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents[offset:offset+20]) {
+		t.Fatal("ranged content does not match upload")
+	}
+}
+
+func TestLocalStorageVerifiesDigest(t *testing.T) {
+	aes := encryption.NewAESService(nil)
+	storage := NewLocalStorage(t.TempDir(), t.TempDir(), aes)
+	key := "12345678901234567890123456789012"
+
+	if err := storage.Initialise(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := bytes.Repeat([]byte("digest"), encryption.CHUNK_SIZE/3)
+	attachment, err := storage.Hold(context.Background(), createMultipartFileHeader(t, "file", "test.png", contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Upload(context.Background(), attachment, key); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(contents)
+	if attachment.Digest != hex.EncodeToString(sum[:]) {
+		t.Fatalf("expected digest of the plaintext, got %q", attachment.Digest)
+	}
+
+	readAll := func(attachment *uploader.Attachment) ([]byte, error, error) {
+		reader, err := storage.Download(context.Background(), attachment, false, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		downloaded, downloadErr := io.ReadAll(reader)
+
+		content, err := storage.Open(context.Background(), attachment, false, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer content.Close()
+		_, openErr := io.CopyN(io.Discard, content, int64(len(contents)))
+		return downloaded, downloadErr, openErr
+	}
+
+	downloaded, downloadErr, openErr := readAll(attachment)
+	if downloadErr != nil || openErr != nil || !bytes.Equal(downloaded, contents) {
+		t.Fatalf("expected matching digest to verify, got %v and %v", downloadErr, openErr)
+	}
+
+	// A filer row that does not match the blob.
+	mismatched := *attachment
+	mismatched.Digest = strings.Repeat("0", 64)
+	downloaded, downloadErr, openErr = readAll(&mismatched)
+	if uploader.ErrorCode(downloadErr) != uploader.INTERNAL || uploader.ErrorCode(openErr) != uploader.INTERNAL {
+		t.Fatalf("expected digest mismatch errors, got %v and %v", downloadErr, openErr)
+	}
+	if len(downloaded) >= len(contents) {
+		t.Fatal("expected the final bytes to be withheld on mismatch")
+	}
+}
+
+func TestLocalStorageRejectsWrongKeyBeforeReading(t *testing.T) {
+	aes := encryption.NewAESService(keystore.NewInMemoryKeyStore())
+	uploadDir := t.TempDir()
+	storage := NewLocalStorage(uploadDir, t.TempDir(), aes)
+	key := "12345678901234567890123456789012"
+
+	if err := storage.Initialise(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	attachment, err := storage.Hold(context.Background(), createMultipartFileHeader(t, "file", "test.png", []byte("original")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Upload(context.Background(), attachment, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// With the blob gone, only the key check can answer.
+	if err := os.RemoveAll(filepath.Join(uploadDir, attachment.UID.String())); err != nil {
+		t.Fatal(err)
+	}
+
+	wrongKey := "abcdefghijklmnopqrstuvwxyz123456"
+	if _, err := storage.Open(context.Background(), attachment, false, wrongKey); uploader.ErrorCode(err) != uploader.UNAUTHORIZED {
+		t.Fatalf("expected UNAUTHORIZED from Open, got %v", err)
+	}
+	if _, err := storage.Download(context.Background(), attachment, false, wrongKey); uploader.ErrorCode(err) != uploader.UNAUTHORIZED {
+		t.Fatalf("expected UNAUTHORIZED from Download, got %v", err)
+	}
+}
+
+func TestLocalStorageRejectsWrongKeyWithoutDataKey(t *testing.T) {
+	// Without a keystore blobs are sealed with the caller's key directly.
+	storage := NewLocalStorage(t.TempDir(), t.TempDir(), encryption.NewAESService(nil))
+	key := "12345678901234567890123456789012"
+
+	if err := storage.Initialise(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	attachment, err := storage.Hold(context.Background(), createMultipartFileHeader(t, "file", "test.png", []byte("original")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Upload(context.Background(), attachment, key); err != nil {
+		t.Fatal(err)
+	}
+
+	wrongKey := "abcdefghijklmnopqrstuvwxyz123456"
+	if _, err := storage.Open(context.Background(), attachment, false, wrongKey); uploader.ErrorCode(err) != uploader.UNAUTHORIZED {
+		t.Fatalf("expected UNAUTHORIZED from Open, got %v", err)
+	}
+	if _, err := storage.Download(context.Background(), attachment, false, wrongKey); uploader.ErrorCode(err) != uploader.UNAUTHORIZED {
+		t.Fatalf("expected UNAUTHORIZED from Download, got %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"time"
+
+	"github.com/bencleary/uploader"
+)
+
+var _ uploader.StorageService = (*MirrorStorage)(nil)
+var _ uploader.Repairer = (*MirrorStorage)(nil)
+
+// Replica is a backend that MirrorStorage keeps a copy of every blob in, such
+// as LocalStorage or S3Storage.
+type Replica interface {
+	uploader.StorageService
+	uploader.BlobStore
+	contentBlobs
+}
+
+// MirrorStorage writes every upload to a primary backend and copies the
+// ciphertext as it is to each secondary, so every replica holds identical
+// blobs. Reads go to the primary and fall back to the secondaries in order,
+// also when a read fails part way through a blob. An upload succeeds once the
+// primary has it; copies to secondaries that fail are logged and left for
+// Repair.
+type MirrorStorage struct {
+	primary     Replica
+	secondaries []Replica
+	encryption  uploader.EncryptionService
+	dedup       *dedup
+}
+
+// NewMirrorStorage mirrors primary to secondaries. Dedup, if wanted, must be
+// turned on for the mirror rather than for its replicas.
+func NewMirrorStorage(encryption uploader.EncryptionService, primary Replica, secondaries ...Replica) *MirrorStorage {
+	if encryption == nil || primary == nil {
+		return nil
+	}
+
+	return &MirrorStorage{
+		primary:     primary,
+		secondaries: secondaries,
+		encryption:  encryption,
+	}
+}
+
+// SetDedup turns on dedup for new uploads. References are kept here, once for
+// every replica.
+func (m *MirrorStorage) SetDedup(refs uploader.BlobRefService) {
+	m.dedup = newDedup(refs)
+}
+
+// replicas returns the primary followed by the secondaries.
+func (m *MirrorStorage) replicas() []Replica {
+	return append([]Replica{m.primary}, m.secondaries...)
+}
+
+func (m *MirrorStorage) Initialise(ctx context.Context) error {
+	for _, replica := range m.replicas() {
+		if err := replica.Initialise(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MirrorStorage) Hold(ctx context.Context, attachment *multipart.FileHeader) (*uploader.Attachment, error) {
+	return m.primary.Hold(ctx, attachment)
+}
+
+// Stage writes a working file where the primary stages uploads.
+func (m *MirrorStorage) Stage(ctx context.Context, fileName string, src io.Reader) (string, error) {
+	return m.primary.Stage(ctx, fileName, src)
+}
+
+// Release deletes the working files staged by the primary.
+func (m *MirrorStorage) Release(ctx context.Context, attachment *uploader.Attachment) error {
+	return m.primary.Release(ctx, attachment)
+}
+
+func (m *MirrorStorage) Upload(ctx context.Context, attachment *uploader.Attachment, key string) error {
+	if attachment == nil {
+		return uploader.Errorf(uploader.INVALID, "attachment is required")
+	}
+
+	if m.dedup != nil {
+		if stored, err := m.dedup.upload(ctx, m, m.encryption, attachment, key); stored || err != nil {
+			return err
+		}
+	}
+
+	if err := m.primary.Upload(ctx, attachment, key); err != nil {
+		return err
+	}
+	m.replicate(ctx, attachment, false)
+	if attachment.PreviewLocalPath != "" {
+		m.replicate(ctx, attachment, true)
+	}
+	return nil
+}
+
+// replicate copies a variant of attachment from the primary to every secondary.
+func (m *MirrorStorage) replicate(ctx context.Context, attachment *uploader.Attachment, preview bool) {
+	for _, secondary := range m.secondaries {
+		if _, err := uploader.CopyBlob(ctx, m.primary, secondary, attachment, preview); err != nil {
+			log.Printf("replicating %s of %s: %v", variant(preview), attachment.UID, err)
+		}
+	}
+}
+
+func (m *MirrorStorage) Download(ctx context.Context, attachment *uploader.Attachment, preview bool, key string) (io.ReadCloser, error) {
+	// Replicas share the key cache, so a key is unwrapped once however many
+	// are tried.
+	ctx = uploader.WithKeyCache(ctx)
+	reader := &fallbackReader{
+		ctx:    ctx,
+		mirror: m,
+		open: func(replica Replica) (io.ReadCloser, error) {
+			return replica.Download(ctx, attachment, preview, key)
+		},
+		// Streams cannot seek, so the bytes already read are skipped.
+		position: func(reader io.ReadCloser, offset int64) error {
+			_, err := io.CopyN(io.Discard, reader, offset)
+			return err
+		},
+		index: -1,
+	}
+	if err := reader.resume(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (m *MirrorStorage) Open(ctx context.Context, attachment *uploader.Attachment, preview bool, key string) (uploader.SeekableContent, error) {
+	ctx = uploader.WithKeyCache(ctx)
+	content := &fallbackContent{fallbackReader{
+		ctx:    ctx,
+		mirror: m,
+		open: func(replica Replica) (io.ReadCloser, error) {
+			return replica.Open(ctx, attachment, preview, key)
+		},
+		position: func(reader io.ReadCloser, offset int64) error {
+			_, err := reader.(io.Seeker).Seek(offset, io.SeekStart)
+			return err
+		},
+		index: -1,
+	}}
+	if err := content.resume(); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// openFrom opens a variant with open on the replicas from index start onwards,
+// and returns the first that opens along with its index.
+func (m *MirrorStorage) openFrom(ctx context.Context, start int, open func(Replica) (io.ReadCloser, error)) (io.ReadCloser, int, error) {
+	replicas := m.replicas()
+	var firstErr error
+	for i := start; i < len(replicas); i++ {
+		reader, err := open(replicas[i])
+		if err == nil {
+			return reader, i, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if !canFallBack(ctx, err) {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = uploader.Errorf(uploader.NOTFOUND, "no replica left to read from")
+	}
+	return nil, -1, firstErr
+}
+
+// fallbackReader reads a variant from one replica and, when a read fails part
+// way, as it does when a damaged chunk fails authentication, carries on from
+// the same offset on the next replica that has it.
+type fallbackReader struct {
+	ctx    context.Context
+	mirror *MirrorStorage
+	open   func(Replica) (io.ReadCloser, error)
+	// position moves a newly opened reader to offset.
+	position func(reader io.ReadCloser, offset int64) error
+
+	current io.ReadCloser
+	index   int
+	offset  int64
+}
+
+func (r *fallbackReader) Read(p []byte) (int, error) {
+	n, err := r.current.Read(p)
+	r.offset += int64(n)
+	if err == nil || err == io.EOF || !canFallBack(r.ctx, err) {
+		return n, err
+	}
+
+	log.Printf("reading from replica %d failed at offset %d, falling back: %v", r.index, r.offset, err)
+	if r.resume() != nil {
+		return n, err
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return r.Read(p)
+}
+
+// resume switches to the first replica after the current one that opens and
+// reaches the current offset.
+func (r *fallbackReader) resume() error {
+	for {
+		reader, index, err := r.mirror.openFrom(r.ctx, r.index+1, r.open)
+		if err != nil {
+			return err
+		}
+		r.index = index
+		if err := r.position(reader, r.offset); err != nil {
+			reader.Close()
+			continue
+		}
+
+		if r.current != nil {
+			r.current.Close()
+		}
+		r.current = reader
+		return nil
+	}
+}
+
+func (r *fallbackReader) Close() error {
+	return r.current.Close()
+}
+
+// fallbackContent is a fallbackReader over replicas' SeekableContent.
+type fallbackContent struct {
+	fallbackReader
+}
+
+func (c *fallbackContent) Seek(offset int64, whence int) (int64, error) {
+	position, err := c.current.(io.Seeker).Seek(offset, whence)
+	if err == nil {
+		c.offset = position
+	}
+	return position, err
+}
+
+func (c *fallbackContent) ModTime() time.Time {
+	return c.current.(uploader.SeekableContent).ModTime()
+}
+
+// canFallBack reports whether a read that failed with err may succeed on
+// another replica. Every replica holds the same ciphertext under the same key,
+// so key errors and unsupported formats fail the same way everywhere.
+func canFallBack(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch uploader.ErrorCode(err) {
+	case uploader.UNAUTHORIZED, uploader.EXPIRED, uploader.NOTIMPLEMENTED:
+		return false
+	}
+	return true
+}
+
+// Delete removes the attachment from every replica, carrying on past failures
+// so that as much as possible is removed.
+func (m *MirrorStorage) Delete(ctx context.Context, attachmentUID string) error {
+	if m.dedup != nil {
+		if deleted, err := m.dedup.delete(ctx, m, attachmentUID); deleted || err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	for _, replica := range m.replicas() {
+		errs = append(errs, replica.Delete(ctx, attachmentUID))
+	}
+	return errors.Join(errs...)
+}
+
+// Repair copies each variant of attachment to the replicas that are missing
+// it, from the first replica that has it, the primary preferred. Replicas hold
+// identical ciphertext, so copies of different sizes mean one is damaged; as
+// there is no telling which without the key, that is reported rather than
+// overwritten. Copies of the same size are not compared, so damage that keeps
+// the size goes unnoticed here; reads detect it and fall back to another
+// replica.
+func (m *MirrorStorage) Repair(ctx context.Context, attachment *uploader.Attachment) (int, error) {
+	replicas := m.replicas()
+	repaired := 0
+	for _, preview := range []bool{false, true} {
+		source := -1
+		missing := make([]bool, len(replicas))
+		sizes := make([]int64, len(replicas))
+		for i, replica := range replicas {
+			size, err := replica.StatBlob(ctx, attachment, preview)
+			if uploader.ErrorCode(err) == uploader.NOTFOUND {
+				missing[i] = true
+				continue
+			} else if err != nil {
+				return repaired, err
+			}
+			sizes[i] = size
+			if source < 0 {
+				source = i
+			} else if size != sizes[source] {
+				return repaired, uploader.Errorf(uploader.INTERNAL, "copies of %s of %s differ in size", variant(preview), attachment.UID)
+			}
+		}
+
+		if source < 0 {
+			if preview {
+				continue
+			}
+			return repaired, uploader.Errorf(uploader.NOTFOUND, "no replica has the %s of %s", variant(preview), attachment.UID)
+		}
+
+		for i, replica := range replicas {
+			if !missing[i] {
+				continue
+			}
+			if _, err := uploader.CopyBlob(ctx, replicas[source], replica, attachment, preview); err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+	}
+	return repaired, nil
+}
+
+// contentExists checks the primary; secondaries missing the blob are left for
+// Repair.
+func (m *MirrorStorage) contentExists(ctx context.Context, contentID string, preview bool) (bool, error) {
+	return m.primary.contentExists(ctx, contentID, preview)
+}
+
+func (m *MirrorStorage) uploadFile(ctx context.Context, attachment *uploader.Attachment, filePath string, preview bool, key string) error {
+	if err := m.primary.uploadFile(ctx, attachment, filePath, preview, key); err != nil {
+		return err
+	}
+	m.replicate(ctx, attachment, preview)
+	return nil
+}
+
+func (m *MirrorStorage) deleteContent(ctx context.Context, contentID string) error {
+	var errs []error
+	for _, replica := range m.replicas() {
+		errs = append(errs, replica.deleteContent(ctx, contentID))
+	}
+	return errors.Join(errs...)
+}
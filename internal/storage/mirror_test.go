@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/s3test"
+)
+
+func TestMirrorStorage(t *testing.T) {
+	ctx := context.Background()
+	const key = "mirrormirrormirrormirrormirror12"
+
+	// Replicas share the keystore holding the wrapped data keys.
+	aes := encryption.NewAESService(keystore.NewInMemoryKeyStore())
+	uploadDir := t.TempDir()
+	primary := NewLocalStorage(uploadDir, t.TempDir(), aes)
+
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+	secondary := NewS3Storage(&S3Options{
+		Endpoint:       server.URL,
+		Bucket:         "uploader",
+		Region:         "us-east-1",
+		Prefix:         t.TempDir(),
+		ForcePathStyle: true,
+		AccessKeyID:    "test",
+		SecretKey:      "test",
+	}, aes)
+
+	mirror := NewMirrorStorage(aes, primary, secondary)
+	if err := mirror.Initialise(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := bytes.Repeat([]byte("mirror"), encryption.CHUNK_SIZE/3)
+	attachment, err := mirror.Hold(ctx, createMultipartFileHeader(t, "file", "mirror.png", contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := attachment.CopyFileToPath(attachment.CreatePreviewLocalPath()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mirror.Upload(ctx, attachment, key); err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.Keys("uploader"); len(keys) != 2 {
+		t.Fatalf("expected the original and preview on the secondary, got %v", keys)
+	}
+
+	download := func(preview bool, key string) ([]byte, error) {
+		t.Helper()
+		reader, err := mirror.Download(ctx, attachment, preview, key)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	}
+
+	// Reads fall back to the secondary once the primary has lost the blobs.
+	if err := os.RemoveAll(filepath.Join(uploadDir, attachment.UID.String())); err != nil {
+		t.Fatal(err)
+	}
+	for _, preview := range []bool{false, true} {
+		downloaded, err := download(preview, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(downloaded, contents) {
+			t.Fatal("downloaded content does not match upload")
+		}
+	}
+	if _, err := download(false, "wrongwrongwrongwrongwrongwrong12"); uploader.ErrorCode(err) != uploader.UNAUTHORIZED {
+		t.Fatalf("expected unauthorized with the wrong key, got %v", err)
+	}
+
+	repaired, err := mirror.Repair(ctx, attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != 2 {
+		t.Fatalf("expected 2 blobs repaired, got %d", repaired)
+	}
+	if content, err := primary.Open(ctx, attachment, false, key); err != nil {
+		t.Fatalf("expected the primary to be repaired, got %v", err)
+	} else {
+		content.Close()
+	}
+	if repaired, err := mirror.Repair(ctx, attachment); err != nil || repaired != 0 {
+		t.Fatalf("expected nothing left to repair, got %d, %v", repaired, err)
+	}
+
+	if err := mirror.Delete(ctx, attachment.UID.String()); err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.Keys("uploader"); len(keys) != 0 {
+		t.Fatalf("expected the secondary to be emptied, got %v", keys)
+	}
+	if _, err := mirror.Repair(ctx, attachment); uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected not found with no copy left, got %v", err)
+	}
+}
+
+func TestMirrorStorageFallsBackOnDamagedChunk(t *testing.T) {
+	ctx := context.Background()
+	const key = "mirrormirrormirrormirrormirror12"
+
+	aes := encryption.NewAESService(keystore.NewInMemoryKeyStore())
+	uploadDir := t.TempDir()
+	mirror := NewMirrorStorage(aes, NewLocalStorage(uploadDir, t.TempDir(), aes), NewLocalStorage(t.TempDir(), t.TempDir(), aes))
+	if err := mirror.Initialise(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := bytes.Repeat([]byte("mirror"), encryption.CHUNK_SIZE/2)
+	attachment, err := mirror.Hold(ctx, createMultipartFileHeader(t, "file", "mirror.png", contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mirror.Upload(ctx, attachment, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage the last chunk of the primary's copy without changing its size, so
+	// it only fails once the earlier chunks have been read.
+	path := filepath.Join(uploadDir, attachment.UID.String(), attachment.UID.String()+".enc")
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob[len(blob)-20] ^= 0xff
+	if err := os.WriteFile(path, blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := mirror.Download(ctx, attachment, false, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(downloaded, contents) {
+		t.Fatalf("expected the download to carry on from the secondary, got %d bytes, %v", len(downloaded), err)
+	}
+
+	content, err := mirror.Open(ctx, attachment, false, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	if _, err := content.Seek(int64(encryption.CHUNK_SIZE), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(content)
+	if err != nil || !bytes.Equal(rest, contents[encryption.CHUNK_SIZE:]) {
+		t.Fatalf("expected the seekable read to carry on from the secondary, got %d bytes, %v", len(rest), err)
+	}
+}
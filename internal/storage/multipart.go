@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// MIN_PART_SIZE is the smallest part S3 accepts, other than the last.
+	MIN_PART_SIZE = 5 << 20
+
+	// DEFAULT_PART_SIZE is the multipart part size used when S3Options leaves
+	// it unset.
+	DEFAULT_PART_SIZE = 8 << 20
+
+	// DEFAULT_UPLOAD_CONCURRENCY is how many parts are uploaded at once when
+	// S3Options leaves it unset.
+	DEFAULT_UPLOAD_CONCURRENCY = 4
+
+	// abortTimeout bounds the cleanup of a failed multipart upload, which runs
+	// even when the request that started it was cancelled.
+	abortTimeout = 30 * time.Second
+)
+
+// partSize returns the configured part size, raised to S3's minimum.
+func (s *S3Storage) partSize() int64 {
+	if s.options.PartSize <= 0 {
+		return DEFAULT_PART_SIZE
+	}
+	return max(s.options.PartSize, MIN_PART_SIZE)
+}
+
+func (s *S3Storage) concurrency() int {
+	if s.options.Concurrency <= 0 {
+		return DEFAULT_UPLOAD_CONCURRENCY
+	}
+	return s.options.Concurrency
+}
+
+// putStream uploads body to objectKey without knowing its size up front. A
+// body that fits in one part is sent with PutObject; anything larger becomes a
+// multipart upload whose parts are read into at most concurrency buffers of
+// partSize and uploaded in parallel, so memory use does not grow with the file.
+// Every part body is an in-memory reader, so the SDK can rewind it to retry. If
+// any part fails the multipart upload is aborted so S3 does not keep its parts.
+func (s *S3Storage) putStream(ctx context.Context, objectKey string, body io.Reader) error {
+	partSize := s.partSize()
+	buffers := make(chan []byte, s.concurrency())
+	for i := 0; i < cap(buffers); i++ {
+		buffers <- nil
+	}
+
+	first := make([]byte, partSize)
+	<-buffers
+	n, err := io.ReadFull(body, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(s.options.Bucket),
+			Key:           aws.String(objectKey),
+			Body:          bytes.NewReader(first[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.options.Bucket),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return err
+	}
+	upload := &multipartUpload{storage: s, key: objectKey, id: created.UploadId}
+
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	send := func(number int32, buffer []byte, n int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { buffers <- buffer }()
+			if err := upload.part(uploadCtx, number, buffer[:n]); err != nil {
+				upload.fail(err)
+				cancel()
+			}
+		}()
+	}
+
+	number := int32(1)
+	send(number, first, n)
+
+read:
+	for {
+		var buffer []byte
+		select {
+		case buffer = <-buffers:
+		case <-uploadCtx.Done():
+			break read
+		}
+		if buffer == nil {
+			buffer = make([]byte, partSize)
+		}
+
+		n, err := io.ReadFull(body, buffer)
+		if n > 0 {
+			number++
+			send(number, buffer, n)
+		} else {
+			buffers <- buffer
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			upload.fail(err)
+			break
+		}
+	}
+	wg.Wait()
+
+	if err := upload.err(); err != nil {
+		return upload.abort(ctx, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return upload.abort(ctx, err)
+	}
+	if err := upload.complete(ctx); err != nil {
+		return upload.abort(ctx, err)
+	}
+	return nil
+}
+
+// multipartUpload collects the parts of one multipart upload and the first
+// error any of them hit.
+type multipartUpload struct {
+	storage *S3Storage
+	key     string
+	id      *string
+
+	mu     sync.Mutex
+	parts  []types.CompletedPart
+	failed error
+}
+
+func (u *multipartUpload) part(ctx context.Context, number int32, data []byte) error {
+	out, err := u.storage.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(u.storage.options.Bucket),
+		Key:           aws.String(u.key),
+		UploadId:      u.id,
+		PartNumber:    aws.Int32(number),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+	})
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.parts = append(u.parts, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(number)})
+	return nil
+}
+
+func (u *multipartUpload) fail(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.failed == nil {
+		u.failed = err
+	}
+}
+
+func (u *multipartUpload) err() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.failed
+}
+
+func (u *multipartUpload) complete(ctx context.Context) error {
+	sort.Slice(u.parts, func(i, j int) bool {
+		return aws.ToInt32(u.parts[i].PartNumber) < aws.ToInt32(u.parts[j].PartNumber)
+	})
+
+	_, err := u.storage.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.storage.options.Bucket),
+		Key:             aws.String(u.key),
+		UploadId:        u.id,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: u.parts},
+	})
+	return err
+}
+
+// abort discards the upload's parts and returns cause, joined with the abort
+// error if that fails too. It runs even if ctx has been cancelled.
+func (u *multipartUpload) abort(ctx context.Context, cause error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+
+	_, err := u.storage.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.storage.options.Bucket),
+		Key:      aws.String(u.key),
+		UploadId: u.id,
+	})
+	if err != nil {
+		return errors.Join(cause, err)
+	}
+	return cause
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/s3test"
+)
+
+// newFakeS3Storage returns S3Storage backed by an in-process fake S3.
+func newFakeS3Storage(t *testing.T, server *s3test.Server, concurrency int) *S3Storage {
+	t.Helper()
+
+	storage := NewS3Storage(&S3Options{
+		Endpoint:       server.URL,
+		Bucket:         "uploader",
+		Region:         "us-east-1",
+		Prefix:         t.TempDir(),
+		ForcePathStyle: true,
+		AccessKeyID:    "test",
+		SecretKey:      "test",
+		PartSize:       MIN_PART_SIZE,
+		Concurrency:    concurrency,
+	}, encryption.NewAESService(keystore.NewInMemoryKeyStore()))
+	if storage == nil {
+		t.Fatal("expected S3 storage to be created")
+	}
+	if err := storage.Initialise(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+// stageAttachment writes contents to a working file and returns an attachment
+// for it without a preview.
+func stageAttachment(t *testing.T, storage *S3Storage, contents []byte) *uploader.Attachment {
+	t.Helper()
+
+	attachment, err := storage.Hold(context.Background(), createMultipartFileHeader(t, "file", "large.bin", contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attachment
+}
+
+func TestS3StorageMultipartUpload(t *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+	storage := newFakeS3Storage(t, server, 3)
+	key := "12345678901234567890123456789012"
+
+	// Four parts' worth of plaintext.
+	contents := make([]byte, 3*MIN_PART_SIZE+MIN_PART_SIZE/2)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatal(err)
+	}
+	attachment := stageAttachment(t, storage, contents)
+
+	if err := storage.Upload(context.Background(), attachment, key); err != nil {
+		t.Fatal(err)
+	}
+	if server.MultipartUploads() != 0 {
+		t.Fatal("expected the multipart upload to be completed")
+	}
+	if got := server.MaxConcurrentParts(); got < 2 || got > 3 {
+		t.Fatalf("expected 2 to 3 parts in flight at once, got %d", got)
+	}
+
+	reader, err := storage.Download(context.Background(), attachment, false, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	downloaded, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, contents) {
+		t.Fatal("downloaded content does not match upload")
+	}
+
+	// Ranged reads across a part boundary.
+	content, err := storage.Open(context.Background(), attachment, false, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	if _, err := content.Seek(MIN_PART_SIZE-10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	window := make([]byte, 20)
+	if _, err := io.ReadFull(content, window); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(window, contents[MIN_PART_SIZE-10:MIN_PART_SIZE+10]) {
+		t.Fatal("ranged read does not match upload")
+	}
+}
+
+func TestS3StorageSmallUpload(t *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+	storage := newFakeS3Storage(t, server, 0)
+	key := "12345678901234567890123456789012"
+
+	attachment := stageAttachment(t, storage, []byte("small"))
+	if err := storage.Upload(context.Background(), attachment, key); err != nil {
+		t.Fatal(err)
+	}
+	if server.MaxConcurrentParts() != 0 {
+		t.Fatal("expected a single PutObject for a body smaller than a part")
+	}
+
+	reader, err := storage.Download(context.Background(), attachment, false, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	downloaded, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(downloaded) != "small" {
+		t.Fatal("downloaded content does not match upload")
+	}
+}
+
+func TestS3StorageMultipartUploadAborts(t *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+	storage := newFakeS3Storage(t, server, 2)
+	server.FailPart(2)
+
+	attachment := stageAttachment(t, storage, make([]byte, 3*MIN_PART_SIZE))
+	if err := storage.Upload(context.Background(), attachment, "12345678901234567890123456789012"); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+
+	if server.MultipartUploads() != 0 {
+		t.Fatal("expected the failed multipart upload to be aborted")
+	}
+	if _, ok := server.Object("uploader", storage.objectKey(attachment.UID.String(), false)); ok {
+		t.Fatal("expected no object after a failed upload")
+	}
+
+	// The working file is untouched, so the upload can be retried.
+	if _, err := os.Stat(filepath.Clean(attachment.LocalPath)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,22 +1,28 @@
 package storage
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/bencleary/uploader"
 )
 
 var _ uploader.StorageService = (*S3Storage)(nil)
+var _ uploader.BlobStore = (*S3Storage)(nil)
+var _ uploader.BlobLister = (*S3Storage)(nil)
+var _ uploader.Stager = (*S3Storage)(nil)
+var _ uploader.Blob = (*s3Blob)(nil)
 
 type S3Options struct {
 	Endpoint       string
@@ -26,6 +32,12 @@ type S3Options struct {
 	ForcePathStyle bool
 	AccessKeyID    string
 	SecretKey      string
+	// PartSize is the size of each multipart upload part; at least
+	// MIN_PART_SIZE, DEFAULT_PART_SIZE if unset.
+	PartSize int64
+	// Concurrency is how many parts are uploaded, and held in memory, at once;
+	// DEFAULT_UPLOAD_CONCURRENCY if unset.
+	Concurrency int
 }
 
 type S3Storage struct {
@@ -33,6 +45,7 @@ type S3Storage struct {
 	client     *s3.Client
 	options    *S3Options
 	encryption uploader.EncryptionService
+	dedup      *dedup
 }
 
 func NewS3Storage(options *S3Options, encryption uploader.EncryptionService) *S3Storage {
@@ -87,6 +100,12 @@ func NewS3Storage(options *S3Options, encryption uploader.EncryptionService) *S3
 	}
 }
 
+// SetDedup turns on dedup for new uploads, storing shared objects under
+// content/ in the prefix.
+func (s *S3Storage) SetDedup(refs uploader.BlobRefService) {
+	s.dedup = newDedup(refs)
+}
+
 func (s *S3Storage) Initialise(ctx context.Context) error {
 	if err := s.staging.Initialise(ctx); err != nil {
 		return err
@@ -99,19 +118,40 @@ func (s *S3Storage) Hold(ctx context.Context, attachment *multipart.FileHeader)
 	return s.staging.Hold(ctx, attachment)
 }
 
+// Stage writes a working file to the staging directory.
+func (s *S3Storage) Stage(ctx context.Context, fileName string, src io.Reader) (string, error) {
+	return s.staging.Stage(ctx, fileName, src)
+}
+
+// Release deletes the working files staged by Hold.
+func (s *S3Storage) Release(ctx context.Context, attachment *uploader.Attachment) error {
+	return s.staging.Release(ctx, attachment)
+}
+
+// SweepStaging deletes working files left in the staging directory.
+func (s *S3Storage) SweepStaging(ctx context.Context, cutoff time.Time) (*uploader.StagingSweep, error) {
+	return s.staging.SweepStaging(ctx, cutoff)
+}
+
 func (s *S3Storage) Upload(ctx context.Context, attachment *uploader.Attachment, key string) error {
 	if attachment == nil {
 		return uploader.Errorf(uploader.INVALID, "attachment is required")
 	}
 
+	if s.dedup != nil {
+		if stored, err := s.dedup.upload(ctx, s, s.encryption, attachment, key); stored || err != nil {
+			return err
+		}
+	}
+
 	// Upload main file
-	if err := s.uploadEncryptedFile(ctx, attachment.LocalPath, attachment.UID.String(), false, key); err != nil {
+	if err := s.uploadFile(ctx, attachment, attachment.LocalPath, false, key); err != nil {
 		return err
 	}
 
 	// Upload preview file if it exists
 	if attachment.PreviewLocalPath != "" {
-		if err := s.uploadEncryptedFile(ctx, attachment.PreviewLocalPath, attachment.UID.String(), true, key); err != nil {
+		if err := s.uploadFile(ctx, attachment, attachment.PreviewLocalPath, true, key); err != nil {
 			return err
 		}
 	}
@@ -119,8 +159,8 @@ func (s *S3Storage) Upload(ctx context.Context, attachment *uploader.Attachment,
 	return nil
 }
 
-// uploadEncryptedFile encrypts a local file and uploads it to S3
-func (s *S3Storage) uploadEncryptedFile(ctx context.Context, filePath, uid string, isPreview bool, encryptionKey string) error {
+// uploadFile encrypts a local file and uploads it to S3
+func (s *S3Storage) uploadFile(ctx context.Context, attachment *uploader.Attachment, filePath string, isPreview bool, encryptionKey string) error {
 	// Open the source file
 	source, err := os.Open(filePath)
 	if err != nil {
@@ -129,40 +169,34 @@ func (s *S3Storage) uploadEncryptedFile(ctx context.Context, filePath, uid strin
 	defer source.Close()
 
 	// Encrypt the file
-	encrypted, err := s.encryption.EncryptStream(ctx, source, encryptionKey)
+	plaintext := newHashingReader(source)
+	encrypted, err := s.encryption.EncryptStream(ctx, plaintext, attachment.EncryptionContext(variant(isPreview)), encryptionKey)
 	if err != nil {
 		return err
 	}
 	defer encrypted.Close()
 
-	// Read encrypted data into a buffer to make it seekable for S3 retries
-	encryptedData, err := io.ReadAll(encrypted)
-	if err != nil {
+	// Stream the ciphertext to S3 in parts as it is produced
+	objectKey := s.blobKey(attachment, isPreview)
+	if err := s.putStream(ctx, objectKey, encrypted); err != nil {
 		return err
 	}
 
-	// Construct the S3 object key
-	objectKey := s.objectKey(uid, isPreview)
+	attachment.SetDigest(variant(isPreview), plaintext.Digest())
+	return nil
+}
 
-	// Upload to S3
-	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(s.options.Bucket),
-		Key:    aws.String(objectKey),
-		Body:   bytes.NewReader(encryptedData),
-	})
-	if err != nil {
-		return err
+// root returns the prefix of every object key.
+func (s *S3Storage) root() string {
+	if s.options.Prefix != "" {
+		return strings.TrimSuffix(s.options.Prefix, "/") + "/"
 	}
-
-	return nil
+	return ""
 }
 
 // objectKey constructs the S3 object key for a file
 func (s *S3Storage) objectKey(uid string, isPreview bool) string {
-	var key string
-	if s.options.Prefix != "" {
-		key = strings.TrimSuffix(s.options.Prefix, "/") + "/"
-	}
+	key := s.root()
 
 	if isPreview {
 		key = fmt.Sprintf("%s%s.preview.enc", key, uid)
@@ -173,34 +207,107 @@ func (s *S3Storage) objectKey(uid string, isPreview bool) string {
 	return key
 }
 
+// blobKey returns the object key of an attachment variant, which is a
+// content-addressed blob when the attachment has a content ID.
+func (s *S3Storage) blobKey(attachment *uploader.Attachment, isPreview bool) string {
+	if attachment.ContentID != "" {
+		return s.objectKey(CONTENT_DIRECTORY+"/"+attachment.ContentID, isPreview)
+	}
+	return s.objectKey(attachment.UID.String(), isPreview)
+}
+
 func (s *S3Storage) Download(ctx context.Context, attachment *uploader.Attachment, preview bool, key string) (io.ReadCloser, error) {
 	if attachment == nil {
 		return nil, uploader.Errorf(uploader.INVALID, "attachment is required")
 	}
 
+	ctx, err := checkKey(ctx, s.encryption, attachment, preview, key)
+	if err != nil {
+		return nil, err
+	}
+
 	// Construct the S3 object key
-	objectKey := s.objectKey(attachment.UID.String(), preview)
+	objectKey := s.blobKey(attachment, preview)
 
 	// Download from S3
 	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.options.Bucket),
 		Key:    aws.String(objectKey),
 	})
-	if err != nil {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, uploader.Errorf(uploader.NOTFOUND, "%s of %s is not stored", variant(preview), attachment.UID)
+	} else if err != nil {
 		return nil, err
 	}
 
 	// Decrypt the stream
-	decrypted, err := s.encryption.DecryptStream(ctx, result.Body, key)
+	decrypted, err := s.encryption.DecryptStream(ctx, result.Body, attachment.EncryptionContext(variant(preview)), key)
 	if err != nil {
 		_ = result.Body.Close()
 		return nil, err
 	}
 
-	return newChainedReadCloser(decrypted, decrypted, result.Body), nil
+	return newChainedReadCloser(newVerifyingReader(decrypted, attachment, variant(preview)), decrypted, result.Body), nil
+}
+
+// Open returns the decrypted attachment as a seekable reader. Only the byte
+// ranges of the object that are read are fetched, using ranged GetObject calls.
+func (s *S3Storage) Open(ctx context.Context, attachment *uploader.Attachment, preview bool, key string) (uploader.SeekableContent, error) {
+	if attachment == nil {
+		return nil, uploader.Errorf(uploader.INVALID, "attachment is required")
+	}
+
+	ctx, err := checkKey(ctx, s.encryption, attachment, preview, key)
+	if err != nil {
+		return nil, err
+	}
+
+	objectKey := s.blobKey(attachment, preview)
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.options.Bucket),
+		Key:    aws.String(objectKey),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return nil, uploader.Errorf(uploader.NOTFOUND, "%s of %s is not stored", variant(preview), attachment.UID)
+	} else if err != nil {
+		return nil, err
+	}
+
+	blob := &s3Blob{
+		client: s.client,
+		bucket: s.options.Bucket,
+		key:    objectKey,
+		size:   aws.ToInt64(head.ContentLength),
+	}
+	if head.LastModified != nil {
+		blob.modTime = *head.LastModified
+	}
+
+	decrypted, err := s.encryption.DecryptBlob(ctx, blob, attachment.EncryptionContext(variant(preview)), key)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := newVerifyingContent(newSeekableContent(decrypted, blob.modTime, nil), attachment, variant(preview))
+	if err != nil {
+		_ = decrypted.Close()
+		return nil, err
+	}
+	return content, nil
 }
 
+// Delete removes the attachment's objects. An attachment stored as a
+// content-addressed blob only drops its reference; the blob is removed with the
+// last one.
 func (s *S3Storage) Delete(ctx context.Context, attachmentUID string) error {
+	if s.dedup != nil {
+		if deleted, err := s.dedup.delete(ctx, s, attachmentUID); deleted || err != nil {
+			return err
+		}
+	}
+
 	// Delete main file
 	mainKey := s.objectKey(attachmentUID, false)
 	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
@@ -220,3 +327,166 @@ func (s *S3Storage) Delete(ctx context.Context, attachmentUID string) error {
 
 	return nil
 }
+
+// ReadBlob returns the stored ciphertext of an attachment variant and its size.
+func (s *S3Storage) ReadBlob(ctx context.Context, attachment *uploader.Attachment, preview bool) (io.ReadCloser, int64, error) {
+	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.options.Bucket),
+		Key:    aws.String(s.blobKey(attachment, preview)),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, 0, uploader.Errorf(uploader.NOTFOUND, "%s of %s is not stored", variant(preview), attachment.UID)
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return result.Body, aws.ToInt64(result.ContentLength), nil
+}
+
+// StatBlob returns the size of the stored ciphertext of an attachment variant.
+func (s *S3Storage) StatBlob(ctx context.Context, attachment *uploader.Attachment, preview bool) (int64, error) {
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.options.Bucket),
+		Key:    aws.String(s.blobKey(attachment, preview)),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return 0, uploader.Errorf(uploader.NOTFOUND, "%s of %s is not stored", variant(preview), attachment.UID)
+	} else if err != nil {
+		return 0, err
+	}
+	return aws.ToInt64(head.ContentLength), nil
+}
+
+// WriteBlob stores ciphertext as an attachment variant as it is.
+func (s *S3Storage) WriteBlob(ctx context.Context, attachment *uploader.Attachment, preview bool, ciphertext io.Reader) error {
+	return s.putStream(ctx, s.blobKey(attachment, preview), ciphertext)
+}
+
+// ListBlobs returns every blob under the storage prefix.
+func (s *S3Storage) ListBlobs(ctx context.Context) ([]uploader.StoredBlob, error) {
+	root := s.root()
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.options.Bucket),
+		Prefix: aws.String(root),
+	})
+
+	var blobs []uploader.StoredBlob
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range page.Contents {
+			// Blobs are stored as <uid>.enc or content/<id>.enc.
+			var blob uploader.StoredBlob
+			var ok bool
+			switch parts := strings.Split(strings.TrimPrefix(aws.ToString(object.Key), root), "/"); len(parts) {
+			case 1:
+				blob, ok = storedBlob("", parts[0])
+			case 2:
+				blob, ok = storedBlob(parts[0], parts[1])
+			}
+			if !ok {
+				continue
+			}
+
+			blob.Key = aws.ToString(object.Key)
+			blob.Size = aws.ToInt64(object.Size)
+			blob.ModTime = aws.ToTime(object.LastModified)
+			blobs = append(blobs, blob)
+		}
+	}
+	return blobs, nil
+}
+
+// QuarantineBlob moves a blob under the quarantine prefix. The object is copied
+// through this process, as a server-side copy is limited to 5 GiB.
+func (s *S3Storage) QuarantineBlob(ctx context.Context, blob uploader.StoredBlob) error {
+	relative, ok := strings.CutPrefix(blob.Key, s.root())
+	if !ok {
+		return uploader.Errorf(uploader.INVALID, "%s is not under the storage prefix", blob.Key)
+	}
+
+	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.options.Bucket),
+		Key:    aws.String(blob.Key),
+	})
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+
+	if err := s.putStream(ctx, s.root()+QUARANTINE_DIRECTORY+"/"+relative, result.Body); err != nil {
+		return err
+	}
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.options.Bucket),
+		Key:    aws.String(blob.Key),
+	})
+	return err
+}
+
+func (s *S3Storage) contentExists(ctx context.Context, contentID string, preview bool) (bool, error) {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.options.Bucket),
+		Key:    aws.String(s.objectKey(CONTENT_DIRECTORY+"/"+contentID, preview)),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *S3Storage) deleteContent(ctx context.Context, contentID string) error {
+	for _, preview := range []bool{false, true} {
+		_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.options.Bucket),
+			Key:    aws.String(s.objectKey(CONTENT_DIRECTORY+"/"+contentID, preview)),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3Blob reads ranges of an S3 object.
+type s3Blob struct {
+	client  *s3.Client
+	bucket  string
+	key     string
+	size    int64
+	modTime time.Time
+}
+
+func (b *s3Blob) Size() int64 {
+	return b.size
+}
+
+func (b *s3Blob) ModTime() time.Time {
+	return b.modTime
+}
+
+func (b *s3Blob) ReadRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		byteRange = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	}
+
+	result, err := b.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key),
+		Range:  aws.String(byteRange),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Body, nil
+}
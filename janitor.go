@@ -0,0 +1,59 @@
+package uploader
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"time"
+)
+
+// DEFAULT_STAGING_MAX_AGE is how long staged uploads are kept before the
+// janitor deletes them, unless told otherwise.
+const DEFAULT_STAGING_MAX_AGE = time.Hour
+
+// janitorMetrics is published through expvar as "janitor", with the counters
+// sweeps, failures, directories_removed and bytes_reclaimed.
+var janitorMetrics = expvar.NewMap("janitor")
+
+// Janitor periodically deletes staged uploads that are older than maxAge, such
+// as those left behind by a crash before the upload pipeline could release
+// them.
+type Janitor struct {
+	staging  Stager
+	maxAge   time.Duration
+	interval time.Duration
+}
+
+func NewJanitor(staging Stager, maxAge, interval time.Duration) *Janitor {
+	return &Janitor{
+		staging:  staging,
+		maxAge:   maxAge,
+		interval: interval,
+	}
+}
+
+// Sweep deletes the staged uploads last modified more than maxAge before now
+// and records what was reclaimed in the janitor metrics.
+func (j *Janitor) Sweep(ctx context.Context, now time.Time) (*StagingSweep, error) {
+	sweep, err := j.staging.SweepStaging(ctx, now.Add(-j.maxAge))
+	janitorMetrics.Add("sweeps", 1)
+	if sweep != nil {
+		janitorMetrics.Add("directories_removed", int64(sweep.Directories))
+		janitorMetrics.Add("bytes_reclaimed", sweep.Bytes)
+	}
+	if err != nil {
+		janitorMetrics.Add("failures", 1)
+	}
+	return sweep, err
+}
+
+// Run sweeps every interval until ctx is done, and logs what it reclaims.
+func (j *Janitor) Run(ctx context.Context) {
+	runEvery(ctx, j.interval, "sweeping staged uploads", func(now time.Time) error {
+		sweep, err := j.Sweep(ctx, now)
+		if sweep != nil && sweep.Directories > 0 {
+			log.Printf("swept %d staged uploads, reclaiming %d bytes", sweep.Directories, sweep.Bytes)
+		}
+		return err
+	})
+}
@@ -0,0 +1,76 @@
+package uploader_test
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/storage"
+	"github.com/google/uuid"
+)
+
+// janitorMetric returns the value of a janitor counter.
+func janitorMetric(t *testing.T, name string) int64 {
+	t.Helper()
+
+	metric := expvar.Get("janitor").(*expvar.Map).Get(name)
+	if metric == nil {
+		return 0
+	}
+	return metric.(*expvar.Int).Value()
+}
+
+func TestJanitorSweep(t *testing.T) {
+	vaultDir := t.TempDir()
+	store := storage.NewLocalStorage(t.TempDir(), vaultDir, encryption.NewAESService(nil))
+
+	stale := filepath.Join(vaultDir, uuid.NewString())
+	if err := os.Mkdir(stale, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test.png", "test.preview.png"} {
+		path := filepath.Join(stale, name)
+		if err := os.WriteFile(path, []byte("plaintext"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-2 * uploader.DEFAULT_STAGING_MAX_AGE)
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sweeps, reclaimed := janitorMetric(t, "sweeps"), janitorMetric(t, "bytes_reclaimed")
+	janitor := uploader.NewJanitor(store, uploader.DEFAULT_STAGING_MAX_AGE, time.Minute)
+
+	// The directory itself was just modified, so it is not stale yet.
+	sweep, err := janitor.Sweep(context.Background(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sweep.Directories != 0 {
+		t.Fatalf("expected nothing swept yet, got %+v", sweep)
+	}
+
+	sweep, err = janitor.Sweep(context.Background(), time.Now().Add(2*uploader.DEFAULT_STAGING_MAX_AGE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sweep.Directories != 1 || sweep.Bytes != int64(2*len("plaintext")) {
+		t.Fatalf("expected the stale upload to be swept, got %+v", sweep)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be deleted, got %v", stale, err)
+	}
+
+	if got := janitorMetric(t, "sweeps") - sweeps; got != 2 {
+		t.Fatalf("expected 2 sweeps counted, got %d", got)
+	}
+	if got := janitorMetric(t, "bytes_reclaimed") - reclaimed; got != sweep.Bytes {
+		t.Fatalf("expected %d bytes reclaimed, got %d", sweep.Bytes, got)
+	}
+}
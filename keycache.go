@@ -0,0 +1,56 @@
+package uploader
+
+import (
+	"context"
+	"sync"
+)
+
+// KeyCache holds the keys derived or unwrapped while serving one request, so a
+// key that is checked and then used to decrypt is only derived once. It lives
+// in the request's context and is never shared between requests.
+type KeyCache struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+type keyCacheContextKey struct{}
+
+// WithKeyCache returns a context carrying an empty KeyCache, or ctx itself when
+// it already carries one.
+func WithKeyCache(ctx context.Context) context.Context {
+	if KeyCacheFromContext(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, keyCacheContextKey{}, &KeyCache{keys: make(map[string][]byte)})
+}
+
+// KeyCacheFromContext returns the KeyCache set by WithKeyCache, or nil.
+func KeyCacheFromContext(ctx context.Context) *KeyCache {
+	cache, _ := ctx.Value(keyCacheContextKey{}).(*KeyCache)
+	return cache
+}
+
+// Key returns the key cached under id, calling derive and caching its result
+// when there is none. id must identify everything the key depends on. A nil
+// cache always calls derive.
+func (c *KeyCache) Key(id string, derive func() ([]byte, error)) ([]byte, error) {
+	if c == nil {
+		return derive()
+	}
+
+	c.mu.Lock()
+	key, ok := c.keys[id]
+	c.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	key, err := derive()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.keys[id] = key
+	c.mu.Unlock()
+	return key, nil
+}
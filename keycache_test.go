@@ -0,0 +1,37 @@
+package uploader_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bencleary/uploader"
+)
+
+func TestKeyCacheDerivesOnce(t *testing.T) {
+	ctx := uploader.WithKeyCache(context.Background())
+	if uploader.WithKeyCache(ctx) != ctx {
+		t.Fatal("expected a context with a cache to be kept")
+	}
+
+	calls := 0
+	derive := func() ([]byte, error) {
+		calls++
+		return []byte("key"), nil
+	}
+
+	cache := uploader.KeyCacheFromContext(ctx)
+	for i := 0; i < 2; i++ {
+		if key, err := cache.Key("id", derive); err != nil || string(key) != "key" {
+			t.Fatalf("unexpected key %q, %v", key, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected one derivation, got %d", calls)
+	}
+
+	// Without a cache every call derives.
+	var none *uploader.KeyCache
+	if _, err := none.Key("id", derive); err != nil || calls != 2 {
+		t.Fatalf("expected a nil cache to derive, got %d calls, %v", calls, err)
+	}
+}
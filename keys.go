@@ -0,0 +1,212 @@
+package uploader
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const (
+	// USER_KEY_SIZE is the size of the keys generated for clients.
+	USER_KEY_SIZE = 32
+
+	// KEY_ID_LENGTH is the length of the hex encoded key IDs handed to clients.
+	KEY_ID_LENGTH = 32
+
+	userKeyPrefix = "user-key:"
+
+	// recipientKeyPrefix indexes key IDs by the recipient ID derived from them.
+	recipientKeyPrefix = "user-key-recipient:"
+)
+
+// KeyManager implements server-managed keys: the server generates each user's
+// key and keeps it in a KeyStoreService, and clients only ever hold an opaque
+// key ID that is resolved to key material per request.
+//
+// User keys wrap the data keys kept in the same keystore, so they are wrapped
+// in turn by a KeyWrapper holding a server key before they are stored. Each key
+// ID has a single entry holding its key and the key of any rotation pending for
+// it, so every change to it is one atomic write.
+//
+// A key ID is the credential for its key, so it is never used to name the key
+// to other users. Files are shared with a key's recipient ID instead, which is
+// derived from the key ID but does not reveal it.
+type KeyManager struct {
+	keystore KeyStoreService
+	wrapper  KeyWrapper
+}
+
+func NewKeyManager(keystore KeyStoreService, wrapper KeyWrapper) *KeyManager {
+	return &KeyManager{
+		keystore: keystore,
+		wrapper:  wrapper,
+	}
+}
+
+// userKey is the entry kept for a key ID. pending is empty unless a rotation
+// has begun.
+type userKey struct {
+	key     []byte
+	pending []byte
+}
+
+// CreateKey generates a new key and returns the ID that refers to it.
+func (m *KeyManager) CreateKey() (string, error) {
+	key, err := randomBytes(USER_KEY_SIZE)
+	if err != nil {
+		return "", err
+	}
+	return m.ImportKey(key)
+}
+
+// ImportKey stores an existing key under a new key ID, as when a key is
+// recovered, and returns the ID.
+func (m *KeyManager) ImportKey(key []byte) (string, error) {
+	if len(key) != USER_KEY_SIZE {
+		return "", Errorf(INVALID, "key must be %d bytes", USER_KEY_SIZE)
+	}
+
+	id, err := randomBytes(KEY_ID_LENGTH / 2)
+	if err != nil {
+		return "", err
+	}
+
+	keyID := hex.EncodeToString(id)
+	if err := m.save(keyID, &userKey{key: key}); err != nil {
+		return "", err
+	}
+
+	// The index holds the key ID, so it is wrapped like the key itself.
+	recipientID := RecipientIDForKey(keyID)
+	wrapped, err := m.wrapper.Wrap(context.Background(), []byte(keyID), []byte(recipientKeyPrefix+recipientID))
+	if err != nil {
+		return "", err
+	}
+	if err := m.keystore.StoreKey(recipientKeyPrefix+recipientID, wrapped); err != nil {
+		return "", err
+	}
+	return keyID, nil
+}
+
+// ResolveKey returns the key for keyID, or a NOTFOUND error if there is none.
+func (m *KeyManager) ResolveKey(keyID string) (string, error) {
+	k, err := m.load(keyID)
+	if err != nil {
+		return "", err
+	}
+	return string(k.key), nil
+}
+
+// ResolveRecipient returns the key whose recipient ID is recipientID, or a
+// NOTFOUND error if there is none.
+func (m *KeyManager) ResolveRecipient(recipientID string) (string, error) {
+	if !IsRecipientID(recipientID) {
+		return "", Errorf(NOTFOUND, "recipient not found")
+	}
+	stored, err := m.keystore.RetrieveKey(recipientKeyPrefix + recipientID)
+	if err != nil {
+		return "", err
+	}
+	keyID, err := m.wrapper.Unwrap(context.Background(), stored, []byte(recipientKeyPrefix+recipientID))
+	if err != nil {
+		return "", err
+	}
+	return m.ResolveKey(string(keyID))
+}
+
+// BeginRotation returns the current key for keyID and the key it is being
+// rotated to. The new key is generated on the first call and kept until
+// CompleteRotation, so an interrupted rotation resumes with the same keys.
+func (m *KeyManager) BeginRotation(keyID string) (string, string, error) {
+	k, err := m.load(keyID)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(k.pending) == 0 {
+		if k.pending, err = randomBytes(USER_KEY_SIZE); err != nil {
+			return "", "", err
+		}
+		if err := m.save(keyID, k); err != nil {
+			return "", "", err
+		}
+	}
+	return string(k.key), string(k.pending), nil
+}
+
+// CompleteRotation makes the pending key from BeginRotation the key for keyID.
+func (m *KeyManager) CompleteRotation(keyID string) error {
+	k, err := m.load(keyID)
+	if err != nil {
+		return err
+	}
+	if len(k.pending) == 0 {
+		return Errorf(NOTFOUND, "no rotation pending for key")
+	}
+	return m.save(keyID, &userKey{key: k.pending})
+}
+
+// DeleteKey removes keyID and any rotation pending for it. Files sealed with its
+// key can only be read again through another ID for the same key.
+func (m *KeyManager) DeleteKey(keyID string) error {
+	if err := m.keystore.DeleteKey(recipientKeyPrefix + RecipientIDForKey(keyID)); err != nil {
+		return err
+	}
+	return m.keystore.DeleteKey(userKeyPrefix + keyID)
+}
+
+// load unwraps the entry for keyID, or returns a NOTFOUND error if there is
+// none.
+func (m *KeyManager) load(keyID string) (*userKey, error) {
+	if !IsKeyID(keyID) {
+		return nil, Errorf(NOTFOUND, "key not found")
+	}
+	stored, err := m.keystore.RetrieveKey(userKeyPrefix + keyID)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := m.wrapper.Unwrap(context.Background(), stored, []byte(userKeyPrefix+keyID))
+	if err != nil {
+		return nil, err
+	}
+	if len(entry) != USER_KEY_SIZE && len(entry) != 2*USER_KEY_SIZE {
+		return nil, Errorf(INTERNAL, "stored key is malformed")
+	}
+	return &userKey{key: entry[:USER_KEY_SIZE], pending: entry[USER_KEY_SIZE:]}, nil
+}
+
+// save wraps k and stores it as the entry for keyID. The key ID is bound as
+// associated data, so an entry moved to another ID fails to unwrap.
+func (m *KeyManager) save(keyID string, k *userKey) error {
+	entry := append(append([]byte(nil), k.key...), k.pending...)
+	wrapped, err := m.wrapper.Wrap(context.Background(), entry, []byte(userKeyPrefix+keyID))
+	if err != nil {
+		return err
+	}
+	return m.keystore.StoreKey(userKeyPrefix+keyID, wrapped)
+}
+
+// RecipientIDForKey returns the recipient ID that files are shared with for
+// keyID. Key IDs are random, so the hash cannot be reversed to the key ID.
+func RecipientIDForKey(keyID string) string {
+	sum := sha256.Sum256([]byte("uploader-recipient\x00" + keyID))
+	return "key-" + hex.EncodeToString(sum[:16])
+}
+
+// IsKeyID reports whether id has the format of a key ID.
+func IsKeyID(id string) bool {
+	if len(id) != KEY_ID_LENGTH {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
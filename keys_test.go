@@ -0,0 +1,137 @@
+package uploader_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/kms"
+)
+
+func newKeyManager(t *testing.T, keys uploader.KeyStoreService) *uploader.KeyManager {
+	t.Helper()
+	wrapper, err := kms.NewLocalWrapper(bytes.Repeat([]byte{1}, kms.LOCAL_KEY_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uploader.NewKeyManager(keys, wrapper)
+}
+
+func TestKeyManagerCreateAndResolve(t *testing.T) {
+	keys := newKeyManager(t, keystore.NewInMemoryKeyStore())
+
+	keyID, err := keys.CreateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !uploader.IsKeyID(keyID) {
+		t.Fatalf("unexpected key ID format %q", keyID)
+	}
+
+	key, err := keys.ResolveKey(keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != uploader.USER_KEY_SIZE || key == keyID {
+		t.Fatal("expected key ID to resolve to separate key material")
+	}
+
+	if _, err := keys.ResolveKey("0123456789abcdef0123456789abcdef"); uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected NOTFOUND for unknown key ID, got %v", err)
+	}
+}
+
+func TestKeyManagerRotation(t *testing.T) {
+	keys := newKeyManager(t, keystore.NewInMemoryKeyStore())
+	keyID, err := keys.CreateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, _ := keys.ResolveKey(keyID)
+
+	oldKey, newKey, err := keys.BeginRotation(keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldKey != original || newKey == original {
+		t.Fatal("expected rotation from the current key to a new one")
+	}
+
+	// A retried rotation must reuse the pending key.
+	_, retryKey, err := keys.BeginRotation(keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retryKey != newKey {
+		t.Fatal("expected pending key to be reused")
+	}
+
+	if err := keys.CompleteRotation(keyID); err != nil {
+		t.Fatal(err)
+	}
+	if resolved, _ := keys.ResolveKey(keyID); resolved != newKey {
+		t.Fatal("expected key ID to resolve to the new key")
+	}
+}
+
+func TestKeyManagerResolvesRecipients(t *testing.T) {
+	keys := newKeyManager(t, keystore.NewInMemoryKeyStore())
+	keyID, err := keys.CreateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := keys.ResolveKey(keyID)
+
+	recipientID := uploader.RecipientIDForKey(keyID)
+	if !uploader.IsRecipientID(recipientID) || strings.Contains(recipientID, keyID) {
+		t.Fatalf("unexpected recipient ID %q", recipientID)
+	}
+	resolved, err := keys.ResolveRecipient(recipientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved != key {
+		t.Fatal("expected the recipient ID to resolve to the key")
+	}
+
+	// The key ID itself is not a recipient ID.
+	if _, err := keys.ResolveRecipient(keyID); uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected NOTFOUND for a key ID, got %v", err)
+	}
+
+	if err := keys.DeleteKey(keyID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.ResolveRecipient(recipientID); uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected NOTFOUND once the key is deleted, got %v", err)
+	}
+}
+
+func TestKeyManagerWrapsKeys(t *testing.T) {
+	store := keystore.NewInMemoryKeyStore()
+	keys := newKeyManager(t, store)
+	keyID, err := keys.CreateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := keys.ResolveKey(keyID)
+
+	stored, err := store.RetrieveKey("user-key:" + keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte(key)) {
+		t.Fatal("expected the key to be stored wrapped")
+	}
+
+	// An entry moved to another key ID does not unwrap.
+	const otherID = "0123456789abcdef0123456789abcdef"
+	if err := store.StoreKey("user-key:"+otherID, stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.ResolveKey(otherID); err == nil {
+		t.Fatal("expected a moved entry to be rejected")
+	}
+}
@@ -1,12 +1,25 @@
 package uploader
 
+import "time"
+
 type KeyStoreService interface {
-	// StoreKey stores a key with the given ID.
+	// StoreKey stores a key with the given ID. Replacing a key keeps the expiry
+	// it was stored with.
 	StoreKey(id string, key []byte) error
 
-	// RetrieveKey retrieves a key by its ID.
+	// StoreKeyWithExpiry stores a key that RetrieveKey refuses once expiresAt
+	// has passed. A zero expiresAt stores a key that never expires.
+	StoreKeyWithExpiry(id string, key []byte, expiresAt time.Time) error
+
+	// RetrieveKey retrieves a key by its ID. It returns a NOTFOUND error for
+	// unknown keys and an EXPIRED error for keys past their expiry that have not
+	// been deleted yet.
 	RetrieveKey(id string) ([]byte, error)
 
 	// DeleteKey deletes a key by its ID.
 	DeleteKey(id string) error
+
+	// DeleteExpiredKeys deletes every key whose expiry is at or before now and
+	// returns how many were deleted.
+	DeleteExpiredKeys(now time.Time) (int, error)
 }
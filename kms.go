@@ -0,0 +1,11 @@
+package uploader
+
+import "context"
+
+// KeyWrapper encrypts and decrypts small values, such as data keys, with a key
+// held by an external key management service, so that key never enters this
+// process. associatedData must match between Wrap and Unwrap.
+type KeyWrapper interface {
+	Wrap(ctx context.Context, plaintext, associatedData []byte) ([]byte, error)
+	Unwrap(ctx context.Context, ciphertext, associatedData []byte) ([]byte, error)
+}
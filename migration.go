@@ -0,0 +1,254 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DEFAULT_MIGRATION_CONCURRENCY is how many attachments a migration copies at
+// once unless told otherwise.
+const DEFAULT_MIGRATION_CONCURRENCY = 4
+
+// Migrator copies the stored ciphertext of every attachment from one backend to
+// another, such as from local storage to S3. Blobs are copied as they are, so no
+// keys are needed and the data is never decrypted.
+type Migrator struct {
+	filer       FilerService
+	source      BlobStore
+	destination BlobStore
+	checkpoints CheckpointService
+}
+
+// MigrationOptions controls a migration.
+type MigrationOptions struct {
+	// Name identifies the migration, such as "local-to-s3". Progress is
+	// checkpointed under it, so running a migration with the same name again
+	// continues where the last one stopped.
+	Name string
+	// Concurrency is how many attachments are copied at once;
+	// DEFAULT_MIGRATION_CONCURRENCY if unset.
+	Concurrency int
+	// DryRun reports what would be copied without writing anything.
+	DryRun bool
+}
+
+// MigrationResult summarises a migration.
+type MigrationResult struct {
+	// Attachments counts the attachments copied, or that would be in a dry run.
+	Attachments int   `json:"attachments"`
+	Blobs       int   `json:"blobs"`
+	Bytes       int64 `json:"bytes"`
+	// Missing lists the attachments whose original is not in the source.
+	Missing []string `json:"missing,omitempty"`
+	Resumed bool     `json:"resumed"`
+	DryRun  bool     `json:"dry_run"`
+}
+
+func NewMigrator(filer FilerService, source, destination BlobStore, checkpoints CheckpointService) *Migrator {
+	return &Migrator{
+		filer:       filer,
+		source:      source,
+		destination: destination,
+		checkpoints: checkpoints,
+	}
+}
+
+// Migrate copies every attachment known to the filer, several at a time, and
+// reads each copy back to check it matches the source byte for byte. The
+// checkpoint only moves past an attachment once it and every attachment before
+// it are done, so after a failure Migrate can be called again to continue.
+// Attachments sharing a content-addressed blob copy it once.
+func (m *Migrator) Migrate(ctx context.Context, options MigrationOptions) (*MigrationResult, error) {
+	if options.Name == "" {
+		return nil, Errorf(INVALID, "migration name is required")
+	}
+
+	attachments, err := m.filer.ListAll()
+	if err != nil {
+		return nil, err
+	}
+
+	name := "migration:" + options.Name
+	position, err := m.checkpoints.Load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &MigrationResult{DryRun: options.DryRun}
+	for i, attachment := range attachments {
+		if position != "" && attachment.UID.String() == position {
+			attachments = attachments[i+1:]
+			result.Resumed = true
+			break
+		}
+	}
+
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = DEFAULT_MIGRATION_CONCURRENCY
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		done     = make([]bool, len(attachments))
+		next     int
+		firstErr error
+		claimed  = make(map[string]bool)
+	)
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	// claim reports whether contentID still has to be copied in this run.
+	claim := func(contentID string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if claimed[contentID] {
+			return false
+		}
+		claimed[contentID] = true
+		return true
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				attachment := attachments[i]
+				copied, err := m.migrate(ctx, attachment, options.DryRun, claim)
+
+				mu.Lock()
+				if err != nil {
+					fail(fmt.Errorf("migrating %s: %w", attachment.UID, err))
+					mu.Unlock()
+					continue
+				}
+				result.Attachments++
+				result.Blobs += copied.blobs
+				result.Bytes += copied.bytes
+				if copied.missing {
+					result.Missing = append(result.Missing, attachment.UID.String())
+				}
+
+				done[i] = true
+				advanced := false
+				for next < len(done) && done[next] {
+					next++
+					advanced = true
+				}
+				if advanced && !options.DryRun {
+					if err := m.checkpoints.Save(name, attachments[next-1].UID.String()); err != nil {
+						fail(err)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for i := range attachments {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return result, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if options.DryRun {
+		return result, nil
+	}
+	return result, m.checkpoints.Clear(name)
+}
+
+// migrated is what copying one attachment did.
+type migrated struct {
+	blobs   int
+	bytes   int64
+	missing bool
+}
+
+// migrate copies both variants of attachment unless its content-addressed blob
+// has already been claimed by another attachment in this run.
+func (m *Migrator) migrate(ctx context.Context, attachment *Attachment, dryRun bool, claim func(string) bool) (migrated, error) {
+	var copied migrated
+	if attachment.ContentID != "" && !claim(attachment.ContentID) {
+		return copied, nil
+	}
+
+	for _, preview := range []bool{false, true} {
+		var size int64
+		var err error
+		if dryRun {
+			size, err = m.source.StatBlob(ctx, attachment, preview)
+		} else {
+			size, err = CopyBlob(ctx, m.source, m.destination, attachment, preview)
+		}
+		if ErrorCode(err) == NOTFOUND {
+			copied.missing = copied.missing || !preview
+			continue
+		} else if err != nil {
+			return copied, err
+		}
+		copied.blobs++
+		copied.bytes += size
+	}
+	return copied, nil
+}
+
+// CopyBlob copies the ciphertext of one variant of attachment from source to
+// destination and returns its size. The copy is read back from the destination
+// and must hash the same as what was read from the source.
+func CopyBlob(ctx context.Context, source, destination BlobStore, attachment *Attachment, preview bool) (int64, error) {
+	reader, size, err := source.ReadBlob(ctx, attachment, preview)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	sourceHash := sha256.New()
+	if err := destination.WriteBlob(ctx, attachment, preview, io.TeeReader(reader, sourceHash)); err != nil {
+		return 0, err
+	}
+
+	copied, _, err := destination.ReadBlob(ctx, attachment, preview)
+	if err != nil {
+		return 0, err
+	}
+	defer copied.Close()
+
+	copyHash := sha256.New()
+	copiedSize, err := io.Copy(copyHash, copied)
+	if err != nil {
+		return 0, err
+	}
+
+	if copiedSize != size || !bytes.Equal(copyHash.Sum(nil), sourceHash.Sum(nil)) {
+		variant := VARIANT_ORIGINAL
+		if preview {
+			variant = VARIANT_PREVIEW
+		}
+		return 0, Errorf(INTERNAL, "copy of %s of %s does not match the source", variant, attachment.UID)
+	}
+	return size, nil
+}
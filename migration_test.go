@@ -0,0 +1,186 @@
+package uploader_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/storage"
+)
+
+const migrationName = "local-to-s3"
+
+// migrationFixture is a local source of attachments to migrate.
+type migrationFixture struct {
+	filer       *db.SqliteFiler
+	checkpoints *db.SqliteCheckpoints
+	encryption  *encryption.AES
+	storage     *storage.LocalStorage
+	uploadDir   string
+}
+
+func newMigrationFixture(t *testing.T) *migrationFixture {
+	t.Helper()
+
+	database := newTestDatabase(t)
+	f := &migrationFixture{
+		filer:       db.NewSqliteFilerService(database),
+		checkpoints: db.NewSqliteCheckpointService(database),
+		encryption:  encryption.NewAESService(keystore.NewInMemoryKeyStore()),
+		uploadDir:   t.TempDir(),
+	}
+	f.storage = storage.NewLocalStorage(f.uploadDir, t.TempDir(), f.encryption)
+	return f
+}
+
+func TestMigratorMigrate(t *testing.T) {
+	ctx := context.Background()
+	f := newMigrationFixture(t)
+
+	var attachments []*uploader.Attachment
+	for i := 0; i < 5; i++ {
+		attachments = append(attachments, uploadAttachment(t, f.storage, f.filer, fmt.Sprintf("file %d", i), testKey))
+	}
+	noPreview := attachments[2]
+	uid := noPreview.UID.String()
+	if err := os.Remove(filepath.Join(f.uploadDir, uid, uid+".preview.enc")); err != nil {
+		t.Fatal(err)
+	}
+
+	destination, server := newFakeS3Storage(t, f.encryption)
+	migrator := uploader.NewMigrator(f.filer, f.storage, destination, f.checkpoints)
+
+	dryRun, err := migrator.Migrate(ctx, uploader.MigrationOptions{Name: migrationName, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dryRun.Attachments != 5 || dryRun.Blobs != 9 || dryRun.Bytes == 0 {
+		t.Fatalf("unexpected dry run %+v", dryRun)
+	}
+	if keys := server.Keys("uploader"); len(keys) != 0 {
+		t.Fatalf("expected a dry run to write nothing, got %v", keys)
+	}
+
+	result, err := migrator.Migrate(ctx, uploader.MigrationOptions{Name: migrationName, Concurrency: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Attachments != 5 || result.Blobs != 9 || result.Bytes != dryRun.Bytes || result.Resumed || len(result.Missing) != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if keys := server.Keys("uploader"); len(keys) != 9 {
+		t.Fatalf("expected 9 objects, got %v", keys)
+	}
+
+	// The copies decrypt with the keys the files were uploaded with.
+	for i, attachment := range attachments {
+		reader, err := destination.Download(ctx, attachment, false, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != fmt.Sprintf("file %d", i) {
+			t.Fatalf("unexpected contents %q", contents)
+		}
+	}
+
+	if position, err := f.checkpoints.Load("migration:" + migrationName); err != nil || position != "" {
+		t.Fatalf("expected the checkpoint to be cleared, got %q (%v)", position, err)
+	}
+}
+
+func TestMigratorResumes(t *testing.T) {
+	f := newMigrationFixture(t)
+
+	var attachments []*uploader.Attachment
+	for i := 0; i < 3; i++ {
+		attachments = append(attachments, uploadAttachment(t, f.storage, f.filer, fmt.Sprintf("file %d", i), testKey))
+	}
+	if err := f.checkpoints.Save("migration:"+migrationName, attachments[1].UID.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	destination, server := newFakeS3Storage(t, f.encryption)
+	result, err := uploader.NewMigrator(f.filer, f.storage, destination, f.checkpoints).Migrate(context.Background(), uploader.MigrationOptions{Name: migrationName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Resumed || result.Attachments != 1 {
+		t.Fatalf("expected to resume with the last attachment, got %+v", result)
+	}
+	if keys := server.Keys("uploader"); len(keys) != 2 {
+		t.Fatalf("expected only the last attachment to be copied, got %v", keys)
+	}
+}
+
+// corruptingStore flips a byte of everything written through it.
+type corruptingStore struct {
+	uploader.BlobStore
+}
+
+func (s corruptingStore) WriteBlob(ctx context.Context, attachment *uploader.Attachment, preview bool, ciphertext io.Reader) error {
+	data, err := io.ReadAll(ciphertext)
+	if err != nil {
+		return err
+	}
+	data[len(data)/2] ^= 1
+	return s.BlobStore.WriteBlob(ctx, attachment, preview, bytes.NewReader(data))
+}
+
+func TestMigratorChecksIntegrity(t *testing.T) {
+	f := newMigrationFixture(t)
+	attachment := uploadAttachment(t, f.storage, f.filer, "precious", testKey)
+
+	destination := storage.NewLocalStorage(t.TempDir(), t.TempDir(), f.encryption)
+	migrator := uploader.NewMigrator(f.filer, f.storage, corruptingStore{destination}, f.checkpoints)
+
+	_, err := migrator.Migrate(context.Background(), uploader.MigrationOptions{Name: "local-to-local"})
+	if uploader.ErrorCode(err) != uploader.INTERNAL {
+		t.Fatalf("expected a mismatch to fail the migration, got %v", err)
+	}
+	if position, err := f.checkpoints.Load("migration:local-to-local"); err != nil || position != "" {
+		t.Fatalf("expected no progress to be saved, got %q (%v)", position, err)
+	}
+
+	// Fixing the destination and running again finishes the job.
+	result, err := uploader.NewMigrator(f.filer, f.storage, destination, f.checkpoints).Migrate(context.Background(), uploader.MigrationOptions{Name: "local-to-local"})
+	if err != nil || result.Attachments != 1 {
+		t.Fatalf("expected the retry to copy the attachment, got %+v (%v)", result, err)
+	}
+	if _, _, err := destination.ReadBlob(context.Background(), attachment, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigratorCopiesSharedBlobsOnce(t *testing.T) {
+	f := newMigrationFixture(t)
+	f.storage.SetDedup(db.NewSqliteBlobRefService(newTestDatabase(t)))
+
+	for i := 0; i < 3; i++ {
+		uploadAttachment(t, f.storage, f.filer, "meme", testKey)
+	}
+
+	destination, server := newFakeS3Storage(t, f.encryption)
+	result, err := uploader.NewMigrator(f.filer, f.storage, destination, f.checkpoints).Migrate(context.Background(), uploader.MigrationOptions{Name: migrationName, Concurrency: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Attachments != 3 || result.Blobs != 2 {
+		t.Fatalf("expected the shared blob to be copied once, got %+v", result)
+	}
+	if keys := server.Keys("uploader"); len(keys) != 2 {
+		t.Fatalf("expected one original and one preview, got %v", keys)
+	}
+}
@@ -0,0 +1,171 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"time"
+)
+
+// The steps of an upload, as reported by UploadError.
+const (
+	UPLOAD_STEP_HOLD    = "hold"
+	UPLOAD_STEP_COPY    = "copy"
+	UPLOAD_STEP_SCALE   = "scale"
+	UPLOAD_STEP_PREVIEW = "preview"
+	UPLOAD_STEP_STORE   = "store"
+	UPLOAD_STEP_RECORD  = "record"
+)
+
+// UploadError reports the step at which an upload failed. By then the steps
+// before it have been undone; Compensation holds any errors from undoing them.
+type UploadError struct {
+	Step         string
+	Err          error
+	Compensation error
+}
+
+func (e *UploadError) Error() string {
+	if e.Compensation != nil {
+		return fmt.Sprintf("upload failed at %s: %v (undoing it also failed: %v)", e.Step, e.Err, e.Compensation)
+	}
+	return fmt.Sprintf("upload failed at %s: %v", e.Step, e.Err)
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// UploadPipeline takes an uploaded file through staging, scaling, preview
+// generation, encrypted storage and recording as one unit: if a step fails, the
+// ones already done are undone in reverse order, so a failed upload leaves no
+// blobs, keys or filer rows behind. Staged working files are released however
+// the upload ends.
+type UploadPipeline struct {
+	filer        FilerService
+	storage      StorageService
+	encryption   EncryptionService
+	scaler       ScalerService
+	preview      *PreviewService
+	maxWidth     int
+	previewWidth int
+}
+
+func NewUploadPipeline(filer FilerService, storage StorageService, encryption EncryptionService, scaler ScalerService, preview *PreviewService, maxWidth, previewWidth int) *UploadPipeline {
+	return &UploadPipeline{
+		filer:        filer,
+		storage:      storage,
+		encryption:   encryption,
+		scaler:       scaler,
+		preview:      preview,
+		maxWidth:     maxWidth,
+		previewWidth: previewWidth,
+	}
+}
+
+// uploadStep is one step of an upload and the action that undoes it.
+type uploadStep struct {
+	name string
+	run  func(ctx context.Context) error
+	// undo may be nil when the step leaves nothing to undo. It also runs when
+	// the step itself fails, as the step may have done part of its work.
+	undo func(ctx context.Context) error
+}
+
+// Upload stores file encrypted with key and records it. A positive ttl makes
+// the file's key, and so the file, expire after it. Unsupported file types are
+// refused with an INVALID error before anything is staged; other failures are
+// returned as an *UploadError.
+func (p *UploadPipeline) Upload(ctx context.Context, file *multipart.FileHeader, key string, ttl time.Duration) (*Attachment, error) {
+	if mimeType := file.Header.Get("Content-Type"); !p.scaler.Supported(mimeType) {
+		return nil, Errorf(INVALID, "file type %q is not supported", mimeType)
+	}
+
+	attachment, err := p.storage.Hold(ctx, file)
+	if err != nil {
+		return nil, &UploadError{Step: UPLOAD_STEP_HOLD, Err: err}
+	}
+	defer func() {
+		if err := p.storage.Release(context.WithoutCancel(ctx), attachment); err != nil {
+			log.Printf("releasing staged upload %s: %v", attachment.UID, err)
+		}
+	}()
+	if ttl > 0 {
+		attachment.ExpiresAt = time.Now().Add(ttl).UTC()
+	}
+
+	steps := []uploadStep{
+		{
+			name: UPLOAD_STEP_COPY,
+			run: func(ctx context.Context) error {
+				return attachment.CopyFileToPath(attachment.CreatePreviewLocalPath())
+			},
+		},
+		{
+			name: UPLOAD_STEP_SCALE,
+			run: func(ctx context.Context) error {
+				return p.scaler.Scale(ctx, attachment.LocalPath, p.maxWidth, attachment.MimeType)
+			},
+		},
+		{
+			name: UPLOAD_STEP_PREVIEW,
+			run: func(ctx context.Context) error {
+				return p.preview.Generate(ctx, attachment, p.previewWidth)
+			},
+		},
+		{
+			name: UPLOAD_STEP_STORE,
+			run: func(ctx context.Context) error {
+				return p.storage.Upload(ctx, attachment, key)
+			},
+			undo: func(ctx context.Context) error {
+				deleteErr := p.storage.Delete(ctx, attachment.UID.String())
+				// The data key was stored under the attachment UID. It is
+				// destroyed even if the blobs could not be deleted, so whatever
+				// is left of them can no longer be read.
+				keyErr := p.encryption.DestroyKey(ctx, attachment.UID.String(), nil)
+				if ErrorCode(keyErr) == NOTFOUND {
+					keyErr = nil
+				}
+				return errors.Join(deleteErr, keyErr)
+			},
+		},
+		{
+			name: UPLOAD_STEP_RECORD,
+			run: func(ctx context.Context) error {
+				return p.filer.Record(attachment)
+			},
+			undo: func(ctx context.Context) error {
+				return p.filer.Delete(attachment.UID)
+			},
+		},
+	}
+
+	for i, step := range steps {
+		err := ctx.Err()
+		if err == nil {
+			err = step.run(ctx)
+		}
+		if err != nil {
+			return nil, &UploadError{Step: step.name, Err: err, Compensation: compensate(context.WithoutCancel(ctx), steps[:i+1])}
+		}
+	}
+	return attachment, nil
+}
+
+// compensate undoes steps in reverse order. It carries on past failures so that
+// as much as possible is undone, and returns them all.
+func compensate(ctx context.Context, steps []uploadStep) error {
+	var errs []error
+	for i := len(steps) - 1; i >= 0; i-- {
+		if steps[i].undo == nil {
+			continue
+		}
+		if err := steps[i].undo(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("undoing %s: %w", steps[i].name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
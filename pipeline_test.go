@@ -0,0 +1,210 @@
+package uploader_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/storage"
+)
+
+// stubScaler supports PNGs and fails scaling with err.
+type stubScaler struct {
+	err error
+}
+
+func (s stubScaler) Scale(ctx context.Context, filePath string, maxWidth int, mimeType string) error {
+	return s.err
+}
+
+func (s stubScaler) Supported(mimeType string) bool {
+	return mimeType == "image/png"
+}
+
+// recordFailingFiler writes the record and then reports failure, as when a
+// commit is lost. It keeps the attachment it was given.
+type recordFailingFiler struct {
+	uploader.FilerService
+	recorded *uploader.Attachment
+}
+
+func (f *recordFailingFiler) Record(attachment *uploader.Attachment) error {
+	f.recorded = attachment
+	if err := f.FilerService.Record(attachment); err != nil {
+		return err
+	}
+	return errors.New("disk full")
+}
+
+// deleteFailingStorage stores uploads but cannot delete them.
+type deleteFailingStorage struct {
+	uploader.StorageService
+}
+
+func (deleteFailingStorage) Delete(ctx context.Context, attachmentUID string) error {
+	return errors.New("storage unreachable")
+}
+
+func newFileHeader(t *testing.T, fileName, contentType string, contents []byte) *multipart.FileHeader {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="`+fileName+`"`)
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	form, err := multipart.NewReader(&body, writer.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+	return form.File["file"][0]
+}
+
+// pipelineFixture is what an upload pipeline stages, stores and records to.
+type pipelineFixture struct {
+	filer      *db.SqliteFiler
+	keys       *keystore.InMemoryKeyStore
+	encryption *encryption.AES
+	storage    *storage.LocalStorage
+	uploadDir  string
+	vaultDir   string
+}
+
+func newPipelineFixture(t *testing.T) *pipelineFixture {
+	t.Helper()
+
+	f := &pipelineFixture{
+		filer:     db.NewSqliteFilerService(newTestDatabase(t)),
+		keys:      keystore.NewInMemoryKeyStore(),
+		uploadDir: t.TempDir(),
+		vaultDir:  t.TempDir(),
+	}
+	f.encryption = encryption.NewAESService(f.keys)
+	f.storage = storage.NewLocalStorage(f.uploadDir, f.vaultDir, f.encryption)
+	return f
+}
+
+// pipeline returns an upload pipeline that records with filer and scales with
+// scaler.
+func (f *pipelineFixture) pipeline(filer uploader.FilerService, scaler uploader.ScalerService) *uploader.UploadPipeline {
+	return uploader.NewUploadPipeline(filer, f.storage, f.encryption, scaler, uploader.NewPreviewService(), 2000, 320)
+}
+
+// assertNothingKept fails unless the upload left no staged files, blobs or filer
+// rows behind.
+func assertNothingKept(t *testing.T, f *pipelineFixture) {
+	t.Helper()
+
+	for _, dir := range []string{f.vaultDir, f.uploadDir} {
+		if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+			t.Fatalf("expected %s to be empty, got %v, %v", dir, entries, err)
+		}
+	}
+	attachments, err := f.filer.ListAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 0 {
+		t.Fatalf("expected no filer rows, got %d", len(attachments))
+	}
+}
+
+func TestUploadPipeline(t *testing.T) {
+	ctx := context.Background()
+	f := newPipelineFixture(t)
+	pipeline := f.pipeline(f.filer, stubScaler{})
+
+	attachment, err := pipeline.Upload(ctx, newFileHeader(t, "test.png", "image/png", []byte("pipeline")), testKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.filer.Fetch(attachment.UID); err != nil {
+		t.Fatal(err)
+	}
+	for _, preview := range []bool{false, true} {
+		if got := readAttachment(t, f.storage, attachment, preview, testKey); got != "pipeline" {
+			t.Fatalf("unexpected contents %q", got)
+		}
+	}
+	if entries, err := os.ReadDir(f.vaultDir); err != nil || len(entries) != 0 {
+		t.Fatalf("expected staged files to be released, got %v, %v", entries, err)
+	}
+}
+
+func TestUploadPipelineCompensates(t *testing.T) {
+	t.Run("scale", func(t *testing.T) {
+		f := newPipelineFixture(t)
+		pipeline := f.pipeline(f.filer, stubScaler{err: errors.New("corrupt image")})
+
+		_, err := pipeline.Upload(context.Background(), newFileHeader(t, "test.png", "image/png", []byte("doomed")), testKey, 0)
+		var uploadErr *uploader.UploadError
+		if !errors.As(err, &uploadErr) || uploadErr.Step != uploader.UPLOAD_STEP_SCALE || uploadErr.Compensation != nil {
+			t.Fatalf("expected the upload to fail at scale, got %v", err)
+		}
+		assertNothingKept(t, f)
+	})
+
+	t.Run("record", func(t *testing.T) {
+		f := newPipelineFixture(t)
+		filer := &recordFailingFiler{FilerService: f.filer}
+		pipeline := f.pipeline(filer, stubScaler{})
+
+		_, err := pipeline.Upload(context.Background(), newFileHeader(t, "test.png", "image/png", []byte("doomed")), testKey, 0)
+		var uploadErr *uploader.UploadError
+		if !errors.As(err, &uploadErr) || uploadErr.Step != uploader.UPLOAD_STEP_RECORD || uploadErr.Compensation != nil {
+			t.Fatalf("expected the upload to fail at record, got %v", err)
+		}
+		// The row, the blobs and the data key stored for them are all gone.
+		assertNothingKept(t, f)
+		if _, err := f.keys.RetrieveKey(filer.recorded.UID.String()); uploader.ErrorCode(err) != uploader.NOTFOUND {
+			t.Fatalf("expected the data key to be destroyed, got %v", err)
+		}
+	})
+
+	t.Run("store undo", func(t *testing.T) {
+		f := newPipelineFixture(t)
+		filer := &recordFailingFiler{FilerService: f.filer}
+		pipeline := uploader.NewUploadPipeline(filer, deleteFailingStorage{f.storage}, f.encryption, stubScaler{}, uploader.NewPreviewService(), 2000, 320)
+
+		_, err := pipeline.Upload(context.Background(), newFileHeader(t, "test.png", "image/png", []byte("doomed")), testKey, 0)
+		var uploadErr *uploader.UploadError
+		if !errors.As(err, &uploadErr) || uploadErr.Compensation == nil {
+			t.Fatalf("expected the failed delete to be reported, got %v", err)
+		}
+		// The blobs are left behind, but their data key is destroyed anyway.
+		if _, err := f.keys.RetrieveKey(filer.recorded.UID.String()); uploader.ErrorCode(err) != uploader.NOTFOUND {
+			t.Fatalf("expected the data key to be destroyed, got %v", err)
+		}
+	})
+}
+
+func TestUploadPipelineRefusesUnsupportedTypes(t *testing.T) {
+	f := newPipelineFixture(t)
+	pipeline := f.pipeline(f.filer, stubScaler{})
+
+	_, err := pipeline.Upload(context.Background(), newFileHeader(t, "test.txt", "text/plain", []byte("text")), testKey, 0)
+	if uploader.ErrorCode(err) != uploader.INVALID {
+		t.Fatalf("expected INVALID, got %v", err)
+	}
+	assertNothingKept(t, f)
+}
@@ -0,0 +1,275 @@
+package uploader
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// RECOVERY_CODE_COUNT is how many recovery codes are issued at a time.
+	RECOVERY_CODE_COUNT = 10
+
+	// AUDIT_RECOVERY_ISSUED records that an owner was issued recovery codes.
+	AUDIT_RECOVERY_ISSUED = "recovery_codes_issued"
+
+	// AUDIT_RECOVERY_USED records that a recovery code was redeemed.
+	AUDIT_RECOVERY_USED = "recovery_code_used"
+
+	recoveryCodeBytes   = 15
+	recoveryCodePrefix  = "recovery-code:"
+	recoveryIndexPrefix = "recovery-codes:"
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RecoveredKey is the key a recovery code was issued for.
+type RecoveredKey struct {
+	OwnerID int `json:"owner_id"`
+	// KeyID identifies the key the codes were issued for: its server-managed
+	// key ID, or a fingerprint of a key the client holds. It is required.
+	KeyID string `json:"key_id"`
+	Key   string `json:"key"`
+}
+
+// RecoveryManager issues one-time recovery codes for an owner's key and
+// exchanges them for the key later. Each code wraps the key with AES-256-GCM
+// under a key derived from the code, and is stored through KeyStoreService
+// under a hash of the code, so the keystore alone cannot recover anything.
+// Issuing and redeeming codes is recorded in the audit log; these events have
+// no attachment and use uuid.Nil. Rejected codes are not audited, since anyone
+// can submit them.
+type RecoveryManager struct {
+	mu       sync.Mutex
+	keystore KeyStoreService
+	audit    AuditService
+	// redeeming holds the codes whose recovery is in progress.
+	redeeming map[string]bool
+}
+
+func NewRecoveryManager(keystore KeyStoreService, audit AuditService) *RecoveryManager {
+	return &RecoveryManager{
+		keystore:  keystore,
+		audit:     audit,
+		redeeming: make(map[string]bool),
+	}
+}
+
+// Issue returns RECOVERY_CODE_COUNT new codes that each recover key for
+// ownerID, replacing any codes issued before for the same key. keyID
+// identifies key: its server-managed key ID, or a fingerprint of a key the
+// client holds.
+func (m *RecoveryManager) Issue(ownerID int, keyID, key string) ([]string, error) {
+	if keyID == "" {
+		return nil, Errorf(INVALID, "recovery codes need a key ID")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.revoke(recoveryIndex(keyID)); err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(&RecoveredKey{OwnerID: ownerID, KeyID: keyID, Key: key})
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, RECOVERY_CODE_COUNT)
+	ids := make([]string, 0, RECOVERY_CODE_COUNT)
+	for i := 0; i < RECOVERY_CODE_COUNT; i++ {
+		raw, err := randomBytes(recoveryCodeBytes)
+		if err != nil {
+			return nil, err
+		}
+		code := formatRecoveryCode(recoveryEncoding.EncodeToString(raw))
+
+		id, wrapKey := recoveryKeys(code)
+		sealed, err := sealRecovery(wrapKey, id, payload)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.keystore.StoreKey(recoveryCodePrefix+id, sealed); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		ids = append(ids, id)
+	}
+
+	if err := m.keystore.StoreKey(recoveryIndex(keyID), []byte(strings.Join(ids, "\n"))); err != nil {
+		return nil, err
+	}
+
+	return codes, m.record(AUDIT_RECOVERY_ISSUED, ownerID, fmt.Sprintf("codes=%d", len(codes)))
+}
+
+// Recover unwraps the key for code and passes it to use, which typically
+// re-keys the owner's files. The code is only consumed if use succeeds, so a
+// failed recovery can be retried with the same code. After a successful
+// recovery the other codes for the same key are revoked, since they wrap the
+// key that was just replaced. use runs without holding the manager's lock;
+// while it runs the code cannot be redeemed again and fails with CONFLICT.
+// Unknown and used codes fail with UNAUTHORIZED.
+func (m *RecoveryManager) Recover(code string, use func(*RecoveredKey) error) error {
+	id, wrapKey := recoveryKeys(code)
+	recovered, err := m.claim(id, wrapKey)
+	if err != nil {
+		return err
+	}
+	defer m.release(id)
+
+	if err := use(recovered); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.keystore.DeleteKey(recoveryCodePrefix + id); err != nil {
+		return err
+	}
+	if err := m.revoke(recoveryIndex(recovered.KeyID)); err != nil {
+		return err
+	}
+	return m.record(AUDIT_RECOVERY_USED, recovered.OwnerID, "code="+id[:8])
+}
+
+// claim unwraps the key for the code stored under id and marks the code as
+// being redeemed.
+func (m *RecoveryManager) claim(id string, wrapKey []byte) (*RecoveredKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.redeeming[id] {
+		return nil, Errorf(CONFLICT, "recovery code is already being redeemed")
+	}
+
+	sealed, err := m.keystore.RetrieveKey(recoveryCodePrefix + id)
+	if ErrorCode(err) == NOTFOUND {
+		return nil, Errorf(UNAUTHORIZED, "recovery code is invalid or has been used")
+	} else if err != nil {
+		return nil, err
+	}
+
+	payload, err := openRecovery(wrapKey, id, sealed)
+	if err != nil {
+		return nil, Errorf(UNAUTHORIZED, "recovery code is invalid or has been used")
+	}
+	var recovered RecoveredKey
+	if err := json.Unmarshal(payload, &recovered); err != nil {
+		return nil, err
+	}
+	if recovered.KeyID == "" {
+		return nil, Errorf(UNAUTHORIZED, "recovery code is invalid or has been used")
+	}
+
+	m.redeeming[id] = true
+	return &recovered, nil
+}
+
+func (m *RecoveryManager) release(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.redeeming, id)
+}
+
+// Revoke deletes every recovery code issued for the key identified by keyID.
+func (m *RecoveryManager) Revoke(keyID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.revoke(recoveryIndex(keyID))
+}
+
+func (m *RecoveryManager) revoke(indexID string) error {
+	index, err := m.keystore.RetrieveKey(indexID)
+	if ErrorCode(err) == NOTFOUND {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, id := range strings.Split(string(index), "\n") {
+		if id == "" {
+			continue
+		}
+		if err := m.keystore.DeleteKey(recoveryCodePrefix + id); err != nil {
+			return err
+		}
+	}
+	return m.keystore.DeleteKey(indexID)
+}
+
+func (m *RecoveryManager) record(action string, ownerID int, detail string) error {
+	return m.audit.Record(&AuditEvent{
+		Action:        action,
+		AttachmentUID: uuid.Nil,
+		OwnerID:       ownerID,
+		Detail:        detail,
+		CreatedAt:     time.Now().UTC(),
+	})
+}
+
+func recoveryIndex(keyID string) string {
+	return recoveryIndexPrefix + "key:" + keyID
+}
+
+// formatRecoveryCode groups a code into blocks of six characters.
+func formatRecoveryCode(code string) string {
+	var groups []string
+	for len(code) > 6 {
+		groups = append(groups, code[:6])
+		code = code[6:]
+	}
+	return strings.Join(append(groups, code), "-")
+}
+
+// recoveryKeys derives the keystore ID and the wrapping key for a code. Codes
+// carry 120 random bits, so a plain hash is enough; separators, spaces and case
+// are ignored.
+func recoveryKeys(code string) (string, []byte) {
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	id := sha256.Sum256([]byte("uploader-recovery-id\x00" + normalized))
+	wrapKey := sha256.Sum256([]byte("uploader-recovery-key\x00" + normalized))
+	return hex.EncodeToString(id[:16]), wrapKey[:]
+}
+
+func sealRecovery(key []byte, id string, plaintext []byte) ([]byte, error) {
+	gcm, err := recoveryAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, []byte(id)), nil
+}
+
+func openRecovery(key []byte, id string, sealed []byte) ([]byte, error) {
+	gcm, err := recoveryAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, Errorf(INVALID, "sealed recovery key is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(id))
+}
+
+func recoveryAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
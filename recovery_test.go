@@ -0,0 +1,146 @@
+package uploader_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/google/uuid"
+)
+
+func newRecoveryManager(t *testing.T) (*uploader.RecoveryManager, *db.SqliteAudit) {
+	t.Helper()
+
+	audit := db.NewSqliteAuditService(newTestDatabase(t))
+	return uploader.NewRecoveryManager(keystore.NewInMemoryKeyStore(), audit), audit
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	recovery, audit := newRecoveryManager(t)
+
+	codes, err := recovery.Issue(uploader.DEFAULT_OWNER_ID, "key-a", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != uploader.RECOVERY_CODE_COUNT || codes[0] == codes[1] {
+		t.Fatalf("expected %d distinct codes, got %v", uploader.RECOVERY_CODE_COUNT, codes)
+	}
+
+	// A failed recovery leaves the code usable.
+	failed := errors.New("rotation failed")
+	if err := recovery.Recover(codes[0], func(*uploader.RecoveredKey) error { return failed }); err != failed {
+		t.Fatalf("expected the callback's error, got %v", err)
+	}
+
+	// Codes are accepted regardless of case and separators.
+	var recovered *uploader.RecoveredKey
+	code := strings.ToLower(strings.ReplaceAll(codes[0], "-", ""))
+	if err := recovery.Recover(code, func(key *uploader.RecoveredKey) error {
+		recovered = key
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if recovered.Key != testKey || recovered.OwnerID != uploader.DEFAULT_OWNER_ID {
+		t.Fatalf("unexpected recovered key %+v", recovered)
+	}
+
+	// The code is used up, and the key's other codes are revoked with it.
+	for _, code := range codes[:2] {
+		err := recovery.Recover(code, func(*uploader.RecoveredKey) error { return nil })
+		if uploader.ErrorCode(err) != uploader.UNAUTHORIZED {
+			t.Fatalf("expected UNAUTHORIZED, got %v", err)
+		}
+	}
+
+	events, err := audit.List(uuid.Nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, event := range events {
+		actions = append(actions, event.Action)
+	}
+	// Rejected codes are not audited.
+	expected := []string{
+		uploader.AUDIT_RECOVERY_ISSUED,
+		uploader.AUDIT_RECOVERY_USED,
+	}
+	if strings.Join(actions, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected audit events %v, got %v", expected, actions)
+	}
+}
+
+func TestRecoveryCodesReplaced(t *testing.T) {
+	recovery, _ := newRecoveryManager(t)
+
+	first, err := recovery.Issue(uploader.DEFAULT_OWNER_ID, "key-a", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recovery.Issue(uploader.DEFAULT_OWNER_ID, "key-a", otherTestKey); err != nil {
+		t.Fatal(err)
+	}
+
+	err = recovery.Recover(first[0], func(*uploader.RecoveredKey) error { return nil })
+	if uploader.ErrorCode(err) != uploader.UNAUTHORIZED {
+		t.Fatalf("expected codes to be replaced when new ones are issued, got %v", err)
+	}
+}
+
+func TestRecoveryCodesKeptPerKey(t *testing.T) {
+	recovery, _ := newRecoveryManager(t)
+
+	codesA, err := recovery.Issue(uploader.DEFAULT_OWNER_ID, "key-a", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codesB, err := recovery.Issue(uploader.DEFAULT_OWNER_ID, "key-b", otherTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Redeeming a code for key B, or revoking key B's codes, leaves key A's.
+	if err := recovery.Recover(codesB[0], func(*uploader.RecoveredKey) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := recovery.Revoke("key-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	var recovered *uploader.RecoveredKey
+	if err := recovery.Recover(codesA[0], func(key *uploader.RecoveredKey) error {
+		recovered = key
+		return nil
+	}); err != nil {
+		t.Fatalf("expected key A's codes to survive, got %v", err)
+	}
+	if recovered.Key != testKey || recovered.KeyID != "key-a" {
+		t.Fatalf("unexpected recovered key %+v", recovered)
+	}
+}
+
+func TestRecoveryCodeRedeemedOnce(t *testing.T) {
+	recovery, _ := newRecoveryManager(t)
+
+	codes, err := recovery.Issue(uploader.DEFAULT_OWNER_ID, "key-a", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The manager is not locked while a recovery runs, but the same code cannot
+	// be redeemed twice at once.
+	var nested error
+	if err := recovery.Recover(codes[0], func(*uploader.RecoveredKey) error {
+		nested = recovery.Recover(codes[0], func(*uploader.RecoveredKey) error { return nil })
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if uploader.ErrorCode(nested) != uploader.CONFLICT {
+		t.Fatalf("expected CONFLICT for a code being redeemed, got %v", nested)
+	}
+}
@@ -0,0 +1,79 @@
+package uploader
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Repairer is storage that keeps redundant copies of each blob and can restore
+// the ones that have gone missing, such as mirrored storage.
+type Repairer interface {
+	// Repair checks that every copy of attachment's blobs is present and copies
+	// the missing ones from a copy that is, returning how many were copied.
+	// Copies that are present are not verified, since that needs the key. It
+	// returns a NOTFOUND error when no copy of the original is left.
+	Repair(ctx context.Context, attachment *Attachment) (int, error)
+}
+
+// RepairResult summarises one pass of a RepairJob.
+type RepairResult struct {
+	Attachments int `json:"attachments"`
+	Repaired    int `json:"repaired"`
+	// Lost lists the attachments with no copy of their original anywhere.
+	Lost []string `json:"lost,omitempty"`
+}
+
+// RepairJob periodically repairs every attachment known to the filer.
+type RepairJob struct {
+	filer    FilerService
+	storage  Repairer
+	interval time.Duration
+}
+
+func NewRepairJob(filer FilerService, storage Repairer, interval time.Duration) *RepairJob {
+	return &RepairJob{
+		filer:    filer,
+		storage:  storage,
+		interval: interval,
+	}
+}
+
+// RepairAll repairs every attachment once. An attachment that cannot be
+// repaired does not stop the others; the first such error is returned along
+// with the result.
+func (j *RepairJob) RepairAll(ctx context.Context) (*RepairResult, error) {
+	attachments, err := j.filer.ListAll()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RepairResult{}
+	var firstErr error
+	for _, attachment := range attachments {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		repaired, err := j.storage.Repair(ctx, attachment)
+		result.Attachments++
+		result.Repaired += repaired
+		if ErrorCode(err) == NOTFOUND {
+			result.Lost = append(result.Lost, attachment.UID.String())
+		} else if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return result, firstErr
+}
+
+// Run repairs every interval until ctx is done, and logs what it repairs.
+func (j *RepairJob) Run(ctx context.Context) {
+	runEvery(ctx, j.interval, "repairing replicas", func(time.Time) error {
+		result, err := j.RepairAll(ctx)
+		if result != nil && (result.Repaired > 0 || len(result.Lost) > 0) {
+			log.Printf("repaired %d blobs; %d attachments have no copy left", result.Repaired, len(result.Lost))
+		}
+		return err
+	})
+}
@@ -0,0 +1,52 @@
+package uploader_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/storage"
+)
+
+func TestRepairJobRepairAll(t *testing.T) {
+	ctx := context.Background()
+	filer := db.NewSqliteFilerService(newTestDatabase(t))
+	aes := encryption.NewAESService(keystore.NewInMemoryKeyStore())
+	secondary, server := newFakeS3Storage(t, aes)
+	mirror := storage.NewMirrorStorage(aes, storage.NewLocalStorage(t.TempDir(), t.TempDir(), aes), secondary)
+
+	var attachments []*uploader.Attachment
+	for i := 0; i < 3; i++ {
+		attachments = append(attachments, uploadAttachment(t, mirror, filer, fmt.Sprintf("file %d", i), testKey))
+	}
+	if keys := server.Keys("uploader"); len(keys) != 6 {
+		t.Fatalf("expected every blob on the secondary, got %d", len(keys))
+	}
+
+	damaged, lost := attachments[0], attachments[2]
+	if err := secondary.Delete(ctx, damaged.UID.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mirror.Delete(ctx, lost.UID.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := uploader.NewRepairJob(filer, mirror, time.Hour).RepairAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Attachments != 3 || result.Repaired != 2 {
+		t.Fatalf("expected 2 blobs of 3 attachments repaired, got %+v", result)
+	}
+	if len(result.Lost) != 1 || result.Lost[0] != lost.UID.String() {
+		t.Fatalf("expected %s to be lost, got %v", lost.UID, result.Lost)
+	}
+	if keys := server.Keys("uploader"); len(keys) != 4 {
+		t.Fatalf("expected the damaged attachment to be back on the secondary, got %d blobs", len(keys))
+	}
+}
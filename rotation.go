@@ -0,0 +1,201 @@
+package uploader
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// KeyRotator moves every attachment an owner has sealed under one encryption
+// key to another. Attachments with a wrapped data key are re-wrapped; older
+// attachments sealed directly with the owner's key are decrypted and encrypted
+// again. Attachments sealed under any other key are left alone.
+type KeyRotator struct {
+	filer       FilerService
+	storage     StorageService
+	encryption  EncryptionService
+	checkpoints CheckpointService
+}
+
+// RotationResult summarises a completed key rotation.
+type RotationResult struct {
+	OwnerID     int  `json:"owner_id"`
+	Rewrapped   int  `json:"rewrapped"`
+	Reencrypted int  `json:"reencrypted"`
+	Resumed     bool `json:"resumed"`
+	// Expired counts attachments skipped because their key has expired.
+	Expired int `json:"expired"`
+	// Skipped counts attachments sealed under a key other than the old one.
+	Skipped int `json:"skipped"`
+}
+
+// Unmatched reports whether the rotation found attachments but none sealed
+// under the old key, which usually means the old key is wrong.
+func (r *RotationResult) Unmatched() bool {
+	return !r.Resumed && r.Skipped > 0 && r.Rewrapped+r.Reencrypted == 0
+}
+
+func NewKeyRotator(filer FilerService, storage StorageService, encryption EncryptionService, checkpoints CheckpointService) *KeyRotator {
+	return &KeyRotator{
+		filer:       filer,
+		storage:     storage,
+		encryption:  encryption,
+		checkpoints: checkpoints,
+	}
+}
+
+// Rotate re-keys the attachments owned by ownerID that are sealed under oldKey
+// to newKey, and skips the rest. Progress is checkpointed after every
+// attachment, so calling Rotate again with the same keys after a failure
+// continues from the last attachment that completed.
+func (r *KeyRotator) Rotate(ctx context.Context, ownerID int, oldKey, newKey string) (*RotationResult, error) {
+	if oldKey == newKey {
+		return nil, Errorf(INVALID, "new key must differ from the old key")
+	}
+
+	attachments, err := r.filer.List(ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	name := rotationCheckpoint(ownerID, oldKey, newKey)
+	position, err := r.checkpoints.Load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RotationResult{OwnerID: ownerID}
+	start := 0
+	for i, attachment := range attachments {
+		if position != "" && attachment.UID.String() == position {
+			start = i + 1
+			result.Resumed = true
+			break
+		}
+	}
+
+	for _, attachment := range attachments[start:] {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		// Expired attachments can no longer be decrypted, so there is nothing
+		// to re-key.
+		if attachment.Expired(time.Now()) {
+			result.Expired++
+			if err := r.checkpoints.Save(name, attachment.UID.String()); err != nil {
+				return result, err
+			}
+			continue
+		}
+
+		reencrypted, err := r.rotate(ctx, attachment, oldKey, newKey)
+		switch {
+		case ErrorCode(err) == UNAUTHORIZED:
+			result.Skipped++
+		case err != nil:
+			return result, fmt.Errorf("rotating %s: %w", attachment.UID, err)
+		case reencrypted:
+			result.Reencrypted++
+		default:
+			result.Rewrapped++
+		}
+
+		if err := r.checkpoints.Save(name, attachment.UID.String()); err != nil {
+			return result, err
+		}
+	}
+
+	return result, r.checkpoints.Clear(name)
+}
+
+// rotate re-keys a single attachment and reports whether its blobs had to be
+// re-encrypted. It fails with UNAUTHORIZED when the attachment is sealed under
+// neither key.
+func (r *KeyRotator) rotate(ctx context.Context, attachment *Attachment, oldKey, newKey string) (bool, error) {
+	ec := attachment.EncryptionContext(VARIANT_ORIGINAL)
+	if err := r.encryption.CheckKey(ctx, ec, oldKey); ErrorCode(err) == UNAUTHORIZED {
+		// An interrupted rotation may have re-keyed it already.
+		if r.encryption.CheckKey(ctx, ec, newKey) == nil {
+			return false, nil
+		}
+		return false, err
+	} else if err != nil {
+		return false, err
+	}
+
+	err := r.encryption.RotateKey(ctx, attachment.UID.String(), oldKey, newKey)
+	if ErrorCode(err) != NOTFOUND {
+		return false, err
+	}
+	return true, r.reencrypt(ctx, attachment, oldKey, newKey)
+}
+
+// reencrypt decrypts an attachment's blobs into the storage staging area and
+// uploads them again under newKey, in place of the old ones.
+func (r *KeyRotator) reencrypt(ctx context.Context, attachment *Attachment, oldKey, newKey string) error {
+	original, err := r.storage.Download(ctx, attachment, false, oldKey)
+	if err != nil {
+		return err
+	}
+	defer original.Close()
+
+	staged := *attachment
+	staged.LocalPath, err = r.storage.Stage(ctx, attachment.UID.String(), original)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := r.storage.Release(context.WithoutCancel(ctx), &staged); err != nil {
+			log.Printf("releasing staged rotation of %s: %v", attachment.UID, err)
+		}
+	}()
+
+	staged.PreviewLocalPath = staged.LocalPath + ".preview"
+	switch err := r.stagePreview(ctx, attachment, oldKey, staged.PreviewLocalPath); {
+	case ErrorCode(err) == NOTFOUND:
+		staged.PreviewLocalPath = ""
+	case ErrorCode(err) == UNAUTHORIZED:
+		// The original opened with oldKey, so the preview is damaged rather
+		// than sealed under another key, and must not be skipped as such.
+		return Errorf(INTERNAL, "preview of %s is damaged: %v", attachment.UID, err)
+	case err != nil:
+		return err
+	}
+
+	return r.storage.Upload(WithInPlaceUpload(ctx), &staged, newKey)
+}
+
+// stagePreview writes the decrypted preview of attachment to path, next to its
+// staged original. It fails with NOTFOUND when the attachment has no preview.
+func (r *KeyRotator) stagePreview(ctx context.Context, attachment *Attachment, key, path string) error {
+	decrypted, err := r.storage.Download(ctx, attachment, true, key)
+	if err != nil {
+		return err
+	}
+	defer decrypted.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.ReadFrom(decrypted); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// rotationCheckpoint names the checkpoint for one rotation. The name includes a
+// MAC over both keys so a checkpoint is only resumed by the same rotation.
+func rotationCheckpoint(ownerID int, oldKey, newKey string) string {
+	mac := hmac.New(sha256.New, []byte(newKey))
+	mac.Write([]byte(oldKey))
+	return fmt.Sprintf("key-rotation:%d:%s", ownerID, hex.EncodeToString(mac.Sum(nil)[:8]))
+}
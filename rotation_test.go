@@ -0,0 +1,221 @@
+package uploader_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/storage"
+)
+
+type rotationFixture struct {
+	filer       *db.SqliteFiler
+	checkpoints *db.SqliteCheckpoints
+	encryption  *encryption.AES
+	keys        *keystore.InMemoryKeyStore
+	storage     *storage.LocalStorage
+	legacy      *storage.LocalStorage
+	rotator     *uploader.KeyRotator
+	uploadDir   string
+	vaultDir    string
+}
+
+func newRotationFixture(t *testing.T) *rotationFixture {
+	t.Helper()
+
+	database := newTestDatabase(t)
+	uploadDir := t.TempDir()
+	vaultDir := t.TempDir()
+	keys := keystore.NewInMemoryKeyStore()
+	aes := encryption.NewAESService(keys)
+
+	f := &rotationFixture{
+		filer:       db.NewSqliteFilerService(database),
+		checkpoints: db.NewSqliteCheckpointService(database),
+		encryption:  aes,
+		keys:        keys,
+		storage:     storage.NewLocalStorage(uploadDir, vaultDir, aes),
+		// Writes blobs the way they were written before envelope encryption.
+		legacy:    storage.NewLocalStorage(uploadDir, vaultDir, encryption.NewAESService(nil)),
+		uploadDir: uploadDir,
+		vaultDir:  vaultDir,
+	}
+	f.rotator = uploader.NewKeyRotator(f.filer, f.storage, f.encryption, f.checkpoints)
+	return f
+}
+
+// upload stores an attachment with contents through store and records it.
+func (f *rotationFixture) upload(t *testing.T, store uploader.StorageService, contents, key string) *uploader.Attachment {
+	t.Helper()
+	return uploadAttachment(t, store, f.filer, contents, key)
+}
+
+func (f *rotationFixture) read(t *testing.T, attachment *uploader.Attachment, preview bool, key string) string {
+	t.Helper()
+	return readAttachment(t, f.storage, attachment, preview, key)
+}
+
+func TestKeyRotatorRotate(t *testing.T) {
+	f := newRotationFixture(t)
+	envelope := f.upload(t, f.storage, "envelope", testKey)
+	legacy := f.upload(t, f.legacy, "legacy", testKey)
+
+	result, err := f.rotator.Rotate(context.Background(), uploader.DEFAULT_OWNER_ID, testKey, otherTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Rewrapped != 1 || result.Reencrypted != 1 {
+		t.Fatalf("expected one re-wrapped and one re-encrypted attachment, got %+v", result)
+	}
+
+	for _, preview := range []bool{false, true} {
+		if got := f.read(t, envelope, preview, otherTestKey); got != "envelope" {
+			t.Fatalf("unexpected envelope contents %q", got)
+		}
+		if got := f.read(t, legacy, preview, otherTestKey); got != "legacy" {
+			t.Fatalf("unexpected legacy contents %q", got)
+		}
+	}
+
+	if _, err := f.storage.Download(context.Background(), envelope, false, testKey); err == nil {
+		t.Fatal("expected old key to be rejected after rotation")
+	}
+}
+
+func TestKeyRotatorResumes(t *testing.T) {
+	f := newRotationFixture(t)
+	first := f.upload(t, f.storage, "first", testKey)
+	// A legacy attachment whose blob has gone cannot be re-encrypted, so
+	// rotation stops here.
+	broken := f.upload(t, f.legacy, "broken", testKey)
+	if err := os.RemoveAll(filepath.Join(f.uploadDir, broken.UID.String())); err != nil {
+		t.Fatal(err)
+	}
+	last := f.upload(t, f.storage, "last", testKey)
+
+	if _, err := f.rotator.Rotate(context.Background(), uploader.DEFAULT_OWNER_ID, testKey, otherTestKey); err == nil {
+		t.Fatal("expected rotation to fail on the attachment without a blob")
+	}
+
+	if err := f.filer.Delete(broken.UID); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := f.rotator.Rotate(context.Background(), uploader.DEFAULT_OWNER_ID, testKey, otherTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Resumed || result.Rewrapped != 1 {
+		t.Fatalf("expected rotation to resume after the first attachment, got %+v", result)
+	}
+
+	if got := f.read(t, first, false, otherTestKey); got != "first" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	if got := f.read(t, last, false, otherTestKey); got != "last" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+}
+
+func TestKeyRotatorSkipsOtherKeys(t *testing.T) {
+	const otherKey = "zyxwvutsrqponmlkjihgfedcba654321"
+	f := newRotationFixture(t)
+	mine := f.upload(t, f.storage, "mine", testKey)
+	// Every attachment is listed under the same owner, whatever its key.
+	other := f.upload(t, f.storage, "other", otherKey)
+
+	result, err := f.rotator.Rotate(context.Background(), uploader.DEFAULT_OWNER_ID, testKey, otherTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rewrapped != 1 || result.Skipped != 1 || result.Unmatched() {
+		t.Fatalf("expected one attachment re-wrapped and one skipped, got %+v", result)
+	}
+	if got := f.read(t, mine, false, otherTestKey); got != "mine" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+	if got := f.read(t, other, false, otherKey); got != "other" {
+		t.Fatalf("expected the other key's attachment to be untouched, got %q", got)
+	}
+
+	wrong, err := f.rotator.Rotate(context.Background(), uploader.DEFAULT_OWNER_ID, "000000000000000000000000000wrong", testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wrong.Unmatched() {
+		t.Fatalf("expected a wrong old key to match nothing, got %+v", wrong)
+	}
+}
+
+func TestKeyRotatorKeepsPreviews(t *testing.T) {
+	f := newRotationFixture(t)
+	noPreview := f.upload(t, f.legacy, "no preview", testKey)
+	if err := os.Remove(filepath.Join(f.uploadDir, noPreview.UID.String(), noPreview.UID.String()+".preview.enc")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := f.rotator.Rotate(context.Background(), uploader.DEFAULT_OWNER_ID, testKey, otherTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Reencrypted != 1 {
+		t.Fatalf("expected the attachment without a preview to be re-encrypted, got %+v", result)
+	}
+	if got := f.read(t, noPreview, false, otherTestKey); got != "no preview" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+
+	// A preview that fails to decrypt stops the rotation rather than being
+	// dropped.
+	damaged := f.upload(t, f.legacy, "damaged", otherTestKey)
+	if err := os.WriteFile(filepath.Join(f.uploadDir, damaged.UID.String(), damaged.UID.String()+".preview.enc"), []byte("damaged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.rotator.Rotate(context.Background(), uploader.DEFAULT_OWNER_ID, otherTestKey, testKey); err == nil {
+		t.Fatal("expected rotation to fail on the damaged preview")
+	}
+	if entries, err := os.ReadDir(f.vaultDir); err != nil || len(entries) != 0 {
+		t.Fatalf("expected staged files to be released, got %v, %v", entries, err)
+	}
+}
+
+func TestKeyRotatorReencryptsWithDedup(t *testing.T) {
+	f := newRotationFixture(t)
+	legacy := f.upload(t, f.legacy, "legacy", testKey)
+
+	f.storage.SetDedup(db.NewSqliteBlobRefService(newTestDatabase(t)))
+
+	result, err := f.rotator.Rotate(context.Background(), uploader.DEFAULT_OWNER_ID, testKey, otherTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Reencrypted != 1 {
+		t.Fatalf("expected the legacy attachment to be re-encrypted, got %+v", result)
+	}
+
+	// The re-encrypted blobs stay under the UID the filer records.
+	recorded, err := f.filer.Fetch(legacy.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, preview := range []bool{false, true} {
+		if got := f.read(t, recorded, preview, otherTestKey); got != "legacy" {
+			t.Fatalf("unexpected contents %q", got)
+		}
+	}
+}
+
+func TestKeyRotatorRejectsSameKey(t *testing.T) {
+	f := newRotationFixture(t)
+
+	_, err := f.rotator.Rotate(context.Background(), uploader.DEFAULT_OWNER_ID, testKey, testKey)
+	if uploader.ErrorCode(err) != uploader.INVALID {
+		t.Fatalf("expected INVALID error, got %v", err)
+	}
+}
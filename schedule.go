@@ -0,0 +1,25 @@
+package uploader
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// runEvery calls task every interval until ctx is done. A failed task is
+// logged after what it was doing, and runs again on the next tick.
+func runEvery(ctx context.Context, interval time.Duration, doing string, task func(now time.Time) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := task(now); err != nil {
+				log.Printf("%s: %v", doing, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package uploader
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Recipient is a user, other than the owner, who can decrypt an attachment.
+type Recipient struct {
+	AttachmentUID uuid.UUID `json:"attachment_uid"`
+	RecipientID   string    `json:"recipient"`
+	GrantedAt     time.Time `json:"granted_at"`
+}
+
+// RecipientService records who an attachment has been shared with. The wrapped
+// keys themselves live in the KeyStoreService.
+type RecipientService interface {
+	AddRecipient(recipient *Recipient) error
+	RemoveRecipient(attachmentUID uuid.UUID, recipientID string) error
+	// ListRecipients returns the recipients of an attachment in the order they
+	// were granted access.
+	ListRecipients(attachmentUID uuid.UUID) ([]*Recipient, error)
+}
+
+var recipientIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,64}$`)
+
+// IsRecipientID reports whether id can be used to name a recipient.
+func IsRecipientID(id string) bool {
+	return recipientIDPattern.MatchString(id)
+}
+
+type recipientContextKey struct{}
+
+// WithRecipient returns a context in which attachments are decrypted with the
+// copy of their data key wrapped for recipientID, when there is one, rather
+// than the owner's.
+func WithRecipient(ctx context.Context, recipientID string) context.Context {
+	return context.WithValue(ctx, recipientContextKey{}, recipientID)
+}
+
+// RecipientFromContext returns the recipient set by WithRecipient, or "".
+func RecipientFromContext(ctx context.Context) string {
+	recipientID, _ := ctx.Value(recipientContextKey{}).(string)
+	return recipientID
+}
+
+// ShareManager grants and revokes access to attachments for recipients other
+// than the owner. Granting wraps the attachment's data key with the recipient's
+// key; the blob itself is never rewritten. Only the owner's key can change or
+// list the recipients of an attachment.
+type ShareManager struct {
+	recipients RecipientService
+	encryption EncryptionService
+}
+
+func NewShareManager(recipients RecipientService, encryption EncryptionService) *ShareManager {
+	return &ShareManager{
+		recipients: recipients,
+		encryption: encryption,
+	}
+}
+
+// Grant lets recipientID decrypt the attachment with recipientKey. Granting an
+// existing recipient again replaces their wrapped key. The recipient's copy
+// expires with the attachment.
+func (m *ShareManager) Grant(ctx context.Context, attachment *Attachment, key, recipientID, recipientKey string) (*Recipient, error) {
+	if !IsRecipientID(recipientID) {
+		return nil, Errorf(INVALID, "recipient must be 1-64 letters, digits or . _ @ -")
+	}
+
+	if err := m.encryption.ShareKey(ctx, attachment.UID.String(), key, recipientID, recipientKey, attachment.ExpiresAt); err != nil {
+		return nil, err
+	}
+
+	recipient := &Recipient{
+		AttachmentUID: attachment.UID,
+		RecipientID:   recipientID,
+		GrantedAt:     time.Now().UTC(),
+	}
+	if err := m.recipients.AddRecipient(recipient); err != nil {
+		return nil, err
+	}
+	return recipient, nil
+}
+
+// Revoke removes recipientID's access to the attachment.
+func (m *ShareManager) Revoke(ctx context.Context, attachmentUID uuid.UUID, key, recipientID string) error {
+	if err := m.encryption.UnshareKey(ctx, attachmentUID.String(), key, recipientID); err != nil {
+		return err
+	}
+	return m.recipients.RemoveRecipient(attachmentUID, recipientID)
+}
+
+// List returns the recipients of the attachment.
+func (m *ShareManager) List(ctx context.Context, attachmentUID uuid.UUID, key string) ([]*Recipient, error) {
+	if err := m.encryption.VerifyKey(ctx, attachmentUID.String(), key); err != nil {
+		return nil, err
+	}
+	return m.recipients.ListRecipients(attachmentUID)
+}
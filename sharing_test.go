@@ -0,0 +1,80 @@
+package uploader_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/storage"
+)
+
+const sharingRecipientKey = "zyxwvutsrqponmlkjihgfedcba654321"
+
+func TestShareManager(t *testing.T) {
+	database := newTestDatabase(t)
+	aes := encryption.NewAESService(keystore.NewInMemoryKeyStore())
+	store := storage.NewLocalStorage(t.TempDir(), t.TempDir(), aes)
+	attachment := uploadAttachment(t, store, db.NewSqliteFilerService(database), "shared", testKey)
+
+	shares := uploader.NewShareManager(db.NewSqliteRecipientService(database), aes)
+	ctx := context.Background()
+
+	if _, err := shares.Grant(ctx, attachment, testKey, "bob/../x", sharingRecipientKey); uploader.ErrorCode(err) != uploader.INVALID {
+		t.Fatalf("expected INVALID for a bad recipient ID, got %v", err)
+	}
+	if _, err := shares.Grant(ctx, attachment, sharingRecipientKey, "bob", sharingRecipientKey); err == nil {
+		t.Fatal("expected granting without the owner's key to fail")
+	}
+	if _, err := shares.Grant(ctx, attachment, testKey, "bob", sharingRecipientKey); err != nil {
+		t.Fatal(err)
+	}
+
+	recipients, err := shares.List(ctx, attachment.UID, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 1 || recipients[0].RecipientID != "bob" {
+		t.Fatalf("unexpected recipients %+v", recipients)
+	}
+	if _, err := shares.List(ctx, attachment.UID, sharingRecipientKey); err == nil {
+		t.Fatal("expected listing with a recipient's key to fail")
+	}
+
+	// The recipient can read both variants with their own key.
+	bob := uploader.WithRecipient(ctx, "bob")
+	for _, preview := range []bool{false, true} {
+		reader, err := store.Download(bob, attachment, preview, sharingRecipientKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != "shared" {
+			t.Fatalf("unexpected contents %q", contents)
+		}
+	}
+
+	if err := shares.Revoke(ctx, attachment.UID, testKey, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Download(bob, attachment, false, sharingRecipientKey); err == nil {
+		t.Fatal("expected a revoked recipient to be rejected")
+	}
+	if got := readAttachment(t, store, attachment, false, testKey); got != "shared" {
+		t.Fatalf("expected the owner to keep access, got %q", got)
+	}
+	recipients, err = shares.List(ctx, attachment.UID, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 0 {
+		t.Fatalf("expected no recipients, got %+v", recipients)
+	}
+}
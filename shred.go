@@ -0,0 +1,166 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ShredResult reports the outcome of Shredder.Delete.
+type ShredResult struct {
+	AttachmentUID uuid.UUID `json:"attachment_uid"`
+	// KeyDestroyed is false for attachments sealed directly with the owner's key,
+	// which have no data key of their own to destroy.
+	KeyDestroyed bool      `json:"key_destroyed"`
+	ShreddedAt   time.Time `json:"shredded_at"`
+}
+
+// Shredder deletes attachments by destroying their data keys before removing
+// their blobs and metadata. Once the key is gone any copy of the ciphertext
+// left behind, in bucket versions or backups, can no longer be decrypted.
+type Shredder struct {
+	filer      FilerService
+	storage    StorageService
+	encryption EncryptionService
+	recipients RecipientService
+	audit      AuditService
+}
+
+func NewShredder(filer FilerService, storage StorageService, encryption EncryptionService, recipients RecipientService, audit AuditService) *Shredder {
+	return &Shredder{
+		filer:      filer,
+		storage:    storage,
+		encryption: encryption,
+		recipients: recipients,
+		audit:      audit,
+	}
+}
+
+// Delete shreds the attachment after checking that key is the owner's. The key
+// is destroyed and the shred audited before anything else is removed, so a
+// failure afterwards leaves only unreadable ciphertext and calling Delete again
+// finishes the job. The shred is audited as pending before the key is
+// destroyed, so a retry after the final audit failed does not mistake the
+// missing key for an attachment sealed with the owner's key.
+func (s *Shredder) Delete(ctx context.Context, attachmentUID uuid.UUID, key string) (*ShredResult, error) {
+	attachment, err := s.filer.Fetch(attachmentUID)
+	if err != nil {
+		return nil, Errorf(NOTFOUND, "attachment %s not found", attachmentUID)
+	}
+
+	result, pending, err := s.previousShred(attachment)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		if result, err = s.shred(ctx, attachment, key, pending); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.storage.Delete(ctx, attachmentUID.String()); err != nil {
+		return nil, err
+	}
+	recipients, err := s.recipients.ListRecipients(attachmentUID)
+	if err != nil {
+		return nil, err
+	}
+	for _, recipient := range recipients {
+		if err := s.recipients.RemoveRecipient(attachmentUID, recipient.RecipientID); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.filer.Delete(attachmentUID); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// shred destroys the attachment's keys and records the audit events. pending
+// reports that an earlier call recorded AUDIT_SHRED_PENDING, so the key may
+// already be gone.
+func (s *Shredder) shred(ctx context.Context, attachment *Attachment, key string, pending bool) (*ShredResult, error) {
+	keyID := attachment.UID.String()
+	keyDestroyed := true
+	// An expired key can no longer be unwrapped by anyone, so there is nothing
+	// to check the caller's key against; whatever is left is destroyed.
+	if !attachment.Expired(time.Now()) {
+		err := s.encryption.VerifyKey(ctx, keyID, key)
+		switch {
+		case ErrorCode(err) == NOTFOUND && pending:
+			// Destroyed by the call that recorded the pending event.
+		case ErrorCode(err) == NOTFOUND:
+			// Sealed directly with the owner's key: prove it by opening the blob.
+			content, err := s.storage.Download(ctx, attachment, false, key)
+			if err != nil {
+				return nil, err
+			}
+			_ = content.Close()
+			keyDestroyed = false
+		case err != nil:
+			return nil, err
+		}
+	}
+
+	if keyDestroyed {
+		if !pending {
+			if err := s.audit.Record(&AuditEvent{
+				Action:        AUDIT_SHRED_PENDING,
+				AttachmentUID: attachment.UID,
+				OwnerID:       attachment.OwnerID,
+				CreatedAt:     time.Now().UTC(),
+			}); err != nil {
+				return nil, err
+			}
+		}
+		recipients, err := s.recipients.ListRecipients(attachment.UID)
+		if err != nil {
+			return nil, err
+		}
+		recipientIDs := make([]string, 0, len(recipients))
+		for _, recipient := range recipients {
+			recipientIDs = append(recipientIDs, recipient.RecipientID)
+		}
+		if err := s.encryption.DestroyKey(ctx, keyID, recipientIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	event := &AuditEvent{
+		Action:        AUDIT_SHRED,
+		AttachmentUID: attachment.UID,
+		OwnerID:       attachment.OwnerID,
+		Detail:        fmt.Sprintf("key_destroyed=%t", keyDestroyed),
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err := s.audit.Record(event); err != nil {
+		return nil, err
+	}
+	return &ShredResult{AttachmentUID: attachment.UID, KeyDestroyed: keyDestroyed, ShreddedAt: event.CreatedAt}, nil
+}
+
+// previousShred returns the result of an earlier Delete that destroyed the
+// attachment's key but did not finish removing it, or nil. Without a result it
+// reports whether an earlier Delete got as far as recording a pending shred.
+func (s *Shredder) previousShred(attachment *Attachment) (*ShredResult, bool, error) {
+	events, err := s.audit.List(attachment.UID)
+	if err != nil {
+		return nil, false, err
+	}
+	pending := false
+	for _, event := range events {
+		switch event.Action {
+		case AUDIT_SHRED:
+			return &ShredResult{
+				AttachmentUID: attachment.UID,
+				KeyDestroyed:  event.Detail == "key_destroyed=true",
+				ShreddedAt:    event.CreatedAt,
+			}, false, nil
+		case AUDIT_SHRED_PENDING:
+			pending = true
+		}
+	}
+	return nil, pending, nil
+}
@@ -0,0 +1,164 @@
+package uploader_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/storage"
+)
+
+type shredFixture struct {
+	filer      *db.SqliteFiler
+	encryption *encryption.AES
+	storage    *storage.LocalStorage
+	audit      *db.SqliteAudit
+	recipients *db.SqliteRecipients
+	shredder   *uploader.Shredder
+	uploadDir  string
+}
+
+func newShredFixture(t *testing.T) *shredFixture {
+	t.Helper()
+
+	database := newTestDatabase(t)
+	f := &shredFixture{
+		filer:      db.NewSqliteFilerService(database),
+		encryption: encryption.NewAESService(keystore.NewInMemoryKeyStore()),
+		audit:      db.NewSqliteAuditService(database),
+		recipients: db.NewSqliteRecipientService(database),
+		uploadDir:  t.TempDir(),
+	}
+	f.storage = storage.NewLocalStorage(f.uploadDir, t.TempDir(), f.encryption)
+	f.shredder = uploader.NewShredder(f.filer, f.storage, f.encryption, f.recipients, f.audit)
+	return f
+}
+
+func TestShredderDestroysKey(t *testing.T) {
+	f := newShredFixture(t)
+	attachment := uploadAttachment(t, f.storage, f.filer, "secret", testKey)
+	shares := uploader.NewShareManager(f.recipients, f.encryption)
+	if _, err := shares.Grant(context.Background(), attachment, testKey, "bob", sharingRecipientKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep a copy of the ciphertext, as a backup or bucket version would.
+	backup := t.TempDir()
+
+	if _, err := f.shredder.Delete(context.Background(), attachment.UID, sharingRecipientKey); err == nil {
+		t.Fatal("expected a recipient's key to be refused")
+	}
+
+	uploadDir := filepath.Join(f.uploadDir, attachment.UID.String())
+	if err := os.CopyFS(backup, os.DirFS(uploadDir)); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := f.shredder.Delete(context.Background(), attachment.UID, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.KeyDestroyed || result.AttachmentUID != attachment.UID || result.ShreddedAt.IsZero() {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	if _, err := f.filer.Fetch(attachment.UID); err == nil {
+		t.Fatal("expected the metadata to be deleted")
+	}
+	if _, err := os.Stat(uploadDir); !os.IsNotExist(err) {
+		t.Fatal("expected the blobs to be deleted")
+	}
+	if recipients, _ := f.recipients.ListRecipients(attachment.UID); len(recipients) != 0 {
+		t.Fatalf("expected no recipients, got %+v", recipients)
+	}
+
+	// The surviving copy can no longer be decrypted by anyone.
+	if err := os.CopyFS(uploadDir, os.DirFS(backup)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.storage.Download(context.Background(), attachment, false, testKey); err == nil {
+		t.Fatal("expected the restored blob to be unreadable")
+	}
+	bob := uploader.WithRecipient(context.Background(), "bob")
+	if _, err := f.storage.Download(bob, attachment, false, sharingRecipientKey); err == nil {
+		t.Fatal("expected the restored blob to be unreadable by recipients")
+	}
+
+	events, err := f.audit.List(attachment.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Action != uploader.AUDIT_SHRED_PENDING || events[1].Action != uploader.AUDIT_SHRED || !events[1].CreatedAt.Equal(result.ShreddedAt) {
+		t.Fatalf("unexpected audit events %+v", events)
+	}
+}
+
+// shredFailingAudit fails to record the first shred event, after the key has
+// been destroyed.
+type shredFailingAudit struct {
+	uploader.AuditService
+	failed bool
+}
+
+func (a *shredFailingAudit) Record(event *uploader.AuditEvent) error {
+	if event.Action == uploader.AUDIT_SHRED && !a.failed {
+		a.failed = true
+		return errors.New("audit log unavailable")
+	}
+	return a.AuditService.Record(event)
+}
+
+func TestShredderRetriesAfterAuditFailure(t *testing.T) {
+	f := newShredFixture(t)
+	audit := &shredFailingAudit{AuditService: f.audit}
+	shredder := uploader.NewShredder(f.filer, f.storage, f.encryption, f.recipients, audit)
+	attachment := uploadAttachment(t, f.storage, f.filer, "secret", testKey)
+
+	if _, err := shredder.Delete(context.Background(), attachment.UID, testKey); err == nil {
+		t.Fatal("expected the audit failure to be returned")
+	}
+
+	// The key is gone, but the retry must not take the attachment for one
+	// sealed with the owner's key.
+	result, err := shredder.Delete(context.Background(), attachment.UID, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.KeyDestroyed {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if _, err := f.filer.Fetch(attachment.UID); err == nil {
+		t.Fatal("expected the metadata to be deleted")
+	}
+}
+
+func TestShredderLegacyAttachment(t *testing.T) {
+	f := newShredFixture(t)
+	// Written the way blobs were before envelope encryption.
+	legacy := storage.NewLocalStorage(f.uploadDir, t.TempDir(), encryption.NewAESService(nil))
+	attachment := uploadAttachment(t, legacy, f.filer, "legacy", testKey)
+
+	if _, err := f.shredder.Delete(context.Background(), attachment.UID, otherTestKey); err == nil {
+		t.Fatal("expected the wrong key to be refused")
+	}
+	if _, err := f.filer.Fetch(attachment.UID); err != nil {
+		t.Fatal("expected a refused delete to keep the attachment")
+	}
+
+	result, err := f.shredder.Delete(context.Background(), attachment.UID, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.KeyDestroyed {
+		t.Fatal("expected no data key to destroy for a legacy attachment")
+	}
+	if _, err := f.filer.Fetch(attachment.UID); err == nil {
+		t.Fatal("expected the metadata to be deleted")
+	}
+}
@@ -4,12 +4,113 @@ import (
 	"context"
 	"io"
 	"mime/multipart"
+	"time"
 )
 
 type StorageService interface {
 	Initialise(ctx context.Context) error
 	Hold(ctx context.Context, attachment *multipart.FileHeader) (*Attachment, error)
+	// Stage writes src to a new working file called fileName, where Hold keeps
+	// uploads, and returns its path. Release an attachment with that LocalPath
+	// once done with it.
+	Stage(ctx context.Context, fileName string, src io.Reader) (string, error)
 	Upload(ctx context.Context, attachment *Attachment, key string) error
+	// Download returns the decrypted attachment. It returns a NOTFOUND error when
+	// the variant is not stored.
 	Download(ctx context.Context, attachment *Attachment, preview bool, key string) (io.ReadCloser, error)
+	// Open returns the decrypted attachment as a seekable reader that only
+	// fetches and decrypts the parts that are read. Blobs in a format that cannot
+	// be read in parts return a NOTIMPLEMENTED error; use Download instead. A
+	// variant that is not stored returns a NOTFOUND error.
+	Open(ctx context.Context, attachment *Attachment, preview bool, key string) (SeekableContent, error)
 	Delete(ctx context.Context, attachmentUID string) error
+	// Release deletes the plaintext working files that Hold staged for
+	// attachment, and any preview made next to them. Call it once the upload has
+	// been stored or has failed.
+	Release(ctx context.Context, attachment *Attachment) error
+}
+
+type inPlaceContextKey struct{}
+
+// WithInPlaceUpload returns a context in which StorageService.Upload stores an
+// attachment under its UID even when dedup is on. Rewriting the blobs of an
+// attachment that is already recorded, as key rotation does, must not move it
+// to a content-addressed blob the filer does not know about.
+func WithInPlaceUpload(ctx context.Context) context.Context {
+	return context.WithValue(ctx, inPlaceContextKey{}, true)
+}
+
+// InPlaceUpload reports whether ctx was returned by WithInPlaceUpload.
+func InPlaceUpload(ctx context.Context) bool {
+	inPlace, _ := ctx.Value(inPlaceContextKey{}).(bool)
+	return inPlace
+}
+
+// Stager is storage that stages uploads in working files before storing them.
+type Stager interface {
+	// SweepStaging deletes staged uploads that were last modified before cutoff,
+	// such as those left by a crash before Release.
+	SweepStaging(ctx context.Context, cutoff time.Time) (*StagingSweep, error)
+}
+
+// StagingSweep is what one SweepStaging call removed.
+type StagingSweep struct {
+	Directories int   `json:"directories"`
+	Bytes       int64 `json:"bytes"`
+}
+
+// BlobStore reads and writes the stored ciphertext of attachments as it is,
+// without decrypting it, so blobs can be moved between backends.
+type BlobStore interface {
+	// ReadBlob returns the ciphertext of a variant of attachment and its size.
+	// It returns a NOTFOUND error when the variant is not stored.
+	ReadBlob(ctx context.Context, attachment *Attachment, preview bool) (io.ReadCloser, int64, error)
+	// StatBlob returns the size of the ciphertext of a variant of attachment
+	// without reading it, or a NOTFOUND error when the variant is not stored.
+	StatBlob(ctx context.Context, attachment *Attachment, preview bool) (int64, error)
+	// WriteBlob stores ciphertext as a variant of attachment, replacing any
+	// blob already there once the new one is complete.
+	WriteBlob(ctx context.Context, attachment *Attachment, preview bool, ciphertext io.Reader) error
+}
+
+// Blob is stored ciphertext that can be read from any offset, such as a local
+// file or an S3 object.
+type Blob interface {
+	Size() int64
+	ModTime() time.Time
+	// ReadRange returns a reader for length bytes starting at offset, or for
+	// everything from offset when length is negative.
+	ReadRange(ctx context.Context, offset, length int64) (io.ReadCloser, error)
+}
+
+// SeekableContent is a decrypted attachment variant that supports seeking, for
+// serving byte ranges.
+type SeekableContent interface {
+	io.ReadSeekCloser
+	ModTime() time.Time
+}
+
+// StoredBlob is a blob found by listing a storage backend.
+type StoredBlob struct {
+	// Key is where the backend keeps the blob, such as a file path or an object
+	// key.
+	Key string `json:"key"`
+	// UID is the attachment the blob belongs to. Content-addressed blobs have
+	// a ContentID instead.
+	UID       string    `json:"uid,omitempty"`
+	ContentID string    `json:"content_id,omitempty"`
+	Preview   bool      `json:"preview"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+}
+
+// BlobLister lists the blobs a backend holds, so they can be checked against
+// the filer.
+type BlobLister interface {
+	// ListBlobs returns every blob in the backend. Anything not named like a
+	// blob, including quarantined blobs, is left out.
+	ListBlobs(ctx context.Context) ([]StoredBlob, error)
+	// QuarantineBlob moves a blob aside, where neither ListBlobs nor downloads
+	// find it, without deleting it.
+	QuarantineBlob(ctx context.Context, blob StoredBlob) error
 }
@@ -0,0 +1,33 @@
+package uploader
+
+import (
+	"context"
+	"time"
+)
+
+// KeySweeper periodically deletes expired keys from a KeyStoreService. Keystores
+// already refuse expired keys; sweeping removes the key material itself.
+type KeySweeper struct {
+	keystore KeyStoreService
+	interval time.Duration
+}
+
+func NewKeySweeper(keystore KeyStoreService, interval time.Duration) *KeySweeper {
+	return &KeySweeper{
+		keystore: keystore,
+		interval: interval,
+	}
+}
+
+// Sweep deletes the keys that have expired by now.
+func (s *KeySweeper) Sweep(now time.Time) (int, error) {
+	return s.keystore.DeleteExpiredKeys(now)
+}
+
+// Run sweeps every interval until ctx is done.
+func (s *KeySweeper) Run(ctx context.Context) {
+	runEvery(ctx, s.interval, "sweeping expired keys", func(now time.Time) error {
+		_, err := s.Sweep(now)
+		return err
+	})
+}
@@ -0,0 +1,72 @@
+package uploader_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bencleary/uploader"
+	"github.com/bencleary/uploader/internal/db"
+	"github.com/bencleary/uploader/internal/encryption"
+	"github.com/bencleary/uploader/internal/keystore"
+	"github.com/bencleary/uploader/internal/storage"
+	"github.com/google/uuid"
+)
+
+func TestExpiringAttachment(t *testing.T) {
+	database := newTestDatabase(t)
+	filer := db.NewSqliteFilerService(database)
+	keys := keystore.NewInMemoryKeyStore()
+	aes := encryption.NewAESService(keys)
+	store := storage.NewLocalStorage(t.TempDir(), t.TempDir(), aes)
+
+	dir := t.TempDir()
+	attachment := &uploader.Attachment{
+		UID:       uuid.New(),
+		OwnerID:   uploader.DEFAULT_OWNER_ID,
+		FileName:  "test.png",
+		LocalPath: filepath.Join(dir, "test.png"),
+		ExpiresAt: time.Now().Add(200 * time.Millisecond),
+	}
+	if err := os.WriteFile(attachment.LocalPath, []byte("ephemeral"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Upload(context.Background(), attachment, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := filer.Record(attachment); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readAttachment(t, store, attachment, false, testKey); got != "ephemeral" {
+		t.Fatalf("unexpected contents %q", got)
+	}
+
+	time.Sleep(time.Until(attachment.ExpiresAt))
+	if _, err := store.Download(context.Background(), attachment, false, testKey); uploader.ErrorCode(err) != uploader.EXPIRED {
+		t.Fatalf("expected EXPIRED error, got %v", err)
+	}
+
+	// Rotation has nothing to re-key once the attachment has expired.
+	rotator := uploader.NewKeyRotator(filer, store, aes, db.NewSqliteCheckpointService(database))
+	result, err := rotator.Rotate(context.Background(), uploader.DEFAULT_OWNER_ID, testKey, otherTestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Expired != 1 || result.Rewrapped != 0 {
+		t.Fatalf("expected the expired attachment to be skipped, got %+v", result)
+	}
+
+	deleted, err := uploader.NewKeySweeper(keys, time.Minute).Sweep(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Fatalf("expected 1 key swept, got %d", deleted)
+	}
+	if _, err := keys.RetrieveKey(attachment.UID.String()); uploader.ErrorCode(err) != uploader.NOTFOUND {
+		t.Fatalf("expected the key to be gone, got %v", err)
+	}
+}